@@ -0,0 +1,440 @@
+// Package client sends entries to a quicklog server.
+//
+// Entries are queued and sent in batches to POST /entries by a background
+// goroutine, so logging never waits on the network. Failed batches are retried
+// with backoff (or after the server's Retry-After) while the queue keeps being
+// drained and, if a spill directory is configured, the batches filled meanwhile
+// and those that couldn't be sent are written to disk to be resent once the
+// server is reachable again.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("quicklog: queue full, entry dropped")
+	ErrClosed    = errors.New("quicklog: client closed")
+)
+
+type Config struct {
+	// URL of the quicklog server, e.g. http://localhost:8124
+	URL string
+	// ProjectId and Source are used for entries that don't specify them.
+	ProjectId int32
+	Source    string
+
+	QueueSize     int           // default 10000
+	BatchSize     int           // default 100 (at most 1000)
+	FlushInterval time.Duration // default 1s
+
+	// A 429 or 503 response's Retry-After is waited for even if over MaxBackoff.
+	MaxRetries int           // default 5
+	MinBackoff time.Duration // default 100ms
+	MaxBackoff time.Duration // default 10s
+
+	// SpillDir, if set, is where batches that couldn't be sent, or were filled
+	// while another was being retried, are saved.
+	SpillDir string
+
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	config  Config
+	queue   chan Entry
+	flushes chan chan error
+	quit    chan struct{}
+	done    chan struct{}
+	spill   *spill
+
+	closeOnce sync.Once
+	dropped   int64
+}
+
+func New(config Config) (*Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("quicklog: URL is required")
+	}
+	config.URL = strings.TrimRight(config.URL, "/")
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.BatchSize > 1000 {
+		config.BatchSize = 1000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 5
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = 10 * time.Second
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	c := &Client{
+		config:  config,
+		queue:   make(chan Entry, config.QueueSize),
+		flushes: make(chan chan error),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if config.SpillDir != "" {
+		var err error
+		if c.spill, err = newSpill(config.SpillDir); err != nil {
+			return nil, err
+		}
+	}
+
+	go c.run()
+	return c, nil
+}
+
+// Log queues the entry to be sent without blocking. Missing ProjectId, Source
+// and Published are filled in, and an EventId is assigned so that retries are
+// idempotent. If the queue is full the entry is spilled to disk (if configured)
+// or dropped with ErrQueueFull.
+func (c *Client) Log(e Entry) error {
+	select {
+	case <-c.quit:
+		return ErrClosed
+	default:
+	}
+
+	if e.ProjectId == 0 {
+		e.ProjectId = c.config.ProjectId
+	}
+	if e.Source == "" {
+		e.Source = c.config.Source
+	}
+	if e.Published.IsZero() {
+		e.Published = time.Now().UTC()
+	}
+	if e.EventId == "" {
+		e.EventId = newId(16)
+	}
+
+	select {
+	case c.queue <- e:
+		return nil
+	default:
+	}
+
+	if c.spill != nil {
+		if err := c.spill.save([]Entry{e}); err == nil {
+			return nil
+		}
+	}
+	atomic.AddInt64(&c.dropped, 1)
+	return ErrQueueFull
+}
+
+// Dropped returns the number of entries that were discarded.
+func (c *Client) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Flush sends all queued entries and waits for them to be sent (or spilled).
+func (c *Client) Flush(ctx context.Context) error {
+	result := make(chan error, 1)
+	select {
+	case c.flushes <- result:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends all queued entries and stops the background goroutine.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+	})
+	<-c.done
+	return nil
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Entry, 0, c.config.BatchSize)
+	// sending is set while a batch (or the spill) is being sent by another goroutine
+	sending := false
+	sent := make(chan error, 1)
+	// flushes are the Flush calls waiting for the queue to be sent, with the first error
+	var flushes []chan error
+	var flushErr error
+	quit := c.quit
+
+	// start delivers the batch (if any) in another goroutine so that the queue
+	// keeps draining while it's retried, and then if resend, the spilled batches.
+	start := func(resend bool) {
+		sending = true
+		go func(batch []Entry) {
+			var err error
+			if len(batch) > 0 {
+				err = c.deliver(batch)
+			}
+			if err == nil && resend && c.spill != nil {
+				c.resendSpilled()
+			}
+			sent <- err
+		}(batch)
+		batch = make([]Entry, 0, c.config.BatchSize)
+	}
+	// send delivers the batch or, while another is being delivered, spills it. If
+	// it can't be spilled the batch (and the queue behind it) waits, returning false.
+	send := func() bool {
+		if !sending {
+			start(false)
+			return true
+		}
+		if c.spill == nil {
+			return false
+		}
+		if err := c.spill.save(batch); err != nil {
+			log.Printf("quicklog: error spilling %d entries: %v\n", len(batch), err)
+			return false
+		}
+		batch = make([]Entry, 0, c.config.BatchSize)
+		return true
+	}
+
+	for {
+		queue := c.queue
+		if len(batch) >= c.config.BatchSize {
+			queue = nil // the full batch is waiting to be sent
+		}
+		select {
+		case e := <-queue:
+			batch = append(batch, e)
+			if len(batch) >= c.config.BatchSize {
+				send()
+			}
+		case err := <-sent:
+			sending = false
+			if err != nil && flushErr == nil {
+				flushErr = err
+			}
+			if len(batch) >= c.config.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			if !sending && (len(batch) > 0 || c.spill != nil) {
+				start(true)
+			}
+		case result := <-c.flushes:
+			if len(flushes) == 0 {
+				flushErr = nil
+			}
+			flushes = append(flushes, result)
+		case <-quit:
+			quit = nil
+		}
+
+		// while flushing or closing, send everything queued before responding
+		for len(flushes) > 0 || quit == nil {
+			for len(batch) < c.config.BatchSize && len(c.queue) > 0 {
+				batch = append(batch, <-c.queue)
+			}
+			if len(batch) > 0 {
+				if !send() {
+					break
+				}
+				continue
+			}
+			if sending {
+				break
+			}
+			for _, result := range flushes {
+				result <- flushErr
+			}
+			flushes = nil
+			if quit == nil {
+				return
+			}
+		}
+	}
+}
+
+// deliver sends the batch, retrying with backoff, and spills it if it can't be sent.
+func (c *Client) deliver(batch []Entry) error {
+	err := c.sendWithRetry(batch)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(permanentError); !ok && c.spill != nil {
+		if e := c.spill.save(batch); e == nil {
+			return err
+		} else {
+			log.Printf("quicklog: error spilling %d entries: %v\n", len(batch), e)
+		}
+	}
+	log.Printf("quicklog: dropping %d entries: %v\n", len(batch), err)
+	atomic.AddInt64(&c.dropped, int64(len(batch)))
+	return err
+}
+
+func (c *Client) resendSpilled() {
+	for {
+		name, batch, err := c.spill.oldest()
+		if err != nil {
+			log.Printf("quicklog: error reading spilled entries: %v\n", err)
+		}
+		if name == "" {
+			return
+		}
+		if err == nil {
+			if err = c.send(batch); err != nil {
+				if _, ok := err.(permanentError); !ok {
+					return // still down, try again later
+				}
+				log.Printf("quicklog: dropping %d spilled entries: %v\n", len(batch), err)
+				atomic.AddInt64(&c.dropped, int64(len(batch)))
+			}
+		}
+		c.spill.remove(name)
+	}
+}
+
+func (c *Client) sendWithRetry(batch []Entry) error {
+	var err error
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff(attempt)
+			if e, ok := err.(retryableError); ok && e.retryAfter > wait {
+				wait = e.retryAfter
+			}
+			select {
+			case <-time.After(wait):
+			case <-c.quit:
+				// closing: don't keep waiting on a down server
+				return err
+			}
+		}
+		if err = c.send(batch); err == nil {
+			return nil
+		} else if _, ok := err.(permanentError); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the exponential backoff with jitter before the attempt.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := float64(c.config.MinBackoff) * math.Pow(2, float64(attempt-1))
+	if d > float64(c.config.MaxBackoff) {
+		d = float64(c.config.MaxBackoff)
+	}
+	return time.Duration(d/2 + mrand.Float64()*d/2)
+}
+
+// permanentError is a rejection by the server that retrying won't fix.
+type permanentError struct {
+	status  int
+	message string
+}
+
+func (e permanentError) Error() string {
+	return fmt.Sprintf("quicklog: status %d: %s", e.status, e.message)
+}
+
+// retryableError is a response that retrying may fix, after retryAfter if the
+// server said when.
+type retryableError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e retryableError) Error() string {
+	return fmt.Sprintf("quicklog: status %d: %s", e.status, e.message)
+}
+
+func (c *Client) send(batch []Entry) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return permanentError{0, err.Error()}
+	}
+
+	resp, err := c.config.HTTPClient.Post(c.config.URL+"/entries", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	var responseBody struct {
+		Message string `json:"message"`
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(content, &responseBody)
+
+	switch {
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return retryableError{resp.StatusCode, responseBody.Message, retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return permanentError{resp.StatusCode, responseBody.Message}
+}
+
+// retryAfter returns how long a Retry-After header, in seconds or an HTTP date,
+// says to wait, or 0.
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// newId returns n random bytes hex encoded.
+func newId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,455 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karmakaze/quicklog/client"
+	"github.com/karmakaze/quicklog/storage"
+	"github.com/karmakaze/quicklog/web"
+)
+
+// Most tests run the client against the real POST /entries handler, so they need
+// a database with schema.sql loaded (those using a fakeServer don't), e.g.
+//
+//	QUICKLOG_TEST_DB_URL="user=postgres password=postgres host=127.0.0.1 dbname=quicklog_test sslmode=disable" go test ./client
+const testDbUrlEnv = "QUICKLOG_TEST_DB_URL"
+
+// testServer is an httptest server of the entries handler that records the sizes
+// of the batches POSTed to it, and can fail requests before or after handling them.
+type testServer struct {
+	*httptest.Server
+	db        *sql.DB
+	projectId int32
+
+	mutex   sync.Mutex
+	batches []int
+	// failBefore fails the next requests with 503 without handling them
+	failBefore int
+	// failAfter handles the next requests but responds 503, as if the response was lost
+	failAfter int
+	// down fails all requests with 503 while set
+	down int32
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dbUrl := os.Getenv(testDbUrlEnv)
+	if dbUrl == "" {
+		t.Skipf("%s is not set", testDbUrlEnv)
+	}
+	db, err := storage.OpenDB(dbUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{db: db, projectId: createTestProject(t, db)}
+	handler := web.NewEntriesHandler(db)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		s.mutex.Lock()
+		failBefore := s.failBefore > 0 || atomic.LoadInt32(&s.down) != 0
+		failAfter := !failBefore && s.failAfter > 0
+		if failBefore && s.failBefore > 0 {
+			s.failBefore--
+		} else if failAfter {
+			s.failAfter--
+		}
+		s.mutex.Unlock()
+
+		if failBefore {
+			http.Error(w, `{"message":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		if !failAfter {
+			handler.ServeHTTP(w, r)
+		} else {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, `{"message":"unavailable"}`, http.StatusServiceUnavailable)
+		}
+
+		var batch []json.RawMessage
+		if json.Unmarshal(body, &batch) == nil {
+			s.mutex.Lock()
+			s.batches = append(s.batches, len(batch))
+			s.mutex.Unlock()
+		}
+	}))
+	return s
+}
+
+func createTestProject(t *testing.T, db *sql.DB) int32 {
+	ctx := context.Background()
+	name := fmt.Sprintf("client-test-%d", time.Now().UnixNano())
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.CreateProject(storage.Project{Name: name}, tx, ctx); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	projects := make([]storage.Project, 0)
+	if err = storage.ListProjects("name", name, &projects, db, ctx); err != nil || len(projects) != 1 {
+		t.Fatalf("project %s not created: %v", name, err)
+	}
+	return projects[0].Id
+}
+
+func (s *testServer) Close() {
+	s.Server.Close()
+	s.db.Close()
+}
+
+func (s *testServer) client(t *testing.T, config client.Config) *client.Client {
+	config.URL = s.URL
+	config.ProjectId = s.projectId
+	config.Source = "client-test"
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (s *testServer) batchSizes() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]int{}, s.batches...)
+}
+
+// entries returns the number of entries (including repeats) in the project.
+func (s *testServer) entries(t *testing.T) int {
+	var n int
+	query := `SELECT coalesce(sum(1 + repeated), 0) FROM entry WHERE project_id = $1`
+	if err := s.db.QueryRow(query, s.projectId).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// logEntries logs n entries distinct enough not to be collapsed as repeats.
+func logEntries(t *testing.T, c *client.Client, n int) {
+	for i := 0; i < n; i++ {
+		if err := c.Log(client.Entry{Type: fmt.Sprintf("event-%d", i), Object: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// eventually fails the test if cond isn't true within 5 seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	c := s.client(t, client.Config{BatchSize: 10, FlushInterval: time.Hour})
+
+	logEntries(t, c, 25)
+	eventually(t, "2 full batches", func() bool { return len(s.batchSizes()) == 2 })
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sizes := s.batchSizes(); fmt.Sprint(sizes) != "[10 10 5]" {
+		t.Errorf("batch sizes %v, want [10 10 5]", sizes)
+	}
+	if n := s.entries(t); n != 25 {
+		t.Errorf("%d entries created, want 25", n)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: 50 * time.Millisecond})
+	defer c.Close()
+
+	logEntries(t, c, 3)
+	eventually(t, "the interval flush", func() bool { return s.entries(t) == 3 })
+}
+
+func TestCloseFlushes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: time.Hour})
+
+	logEntries(t, c, 7)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.entries(t); n != 7 {
+		t.Errorf("%d entries created, want 7", n)
+	}
+	if err := c.Log(client.Entry{Type: "late"}); err != client.ErrClosed {
+		t.Errorf("Log after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.failBefore = 2
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: time.Hour,
+		MinBackoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+	defer c.Close()
+
+	logEntries(t, c, 5)
+	start := time.Now()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// backoffs of at least half of 20ms and 40ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("retried after %v, want backoff", elapsed)
+	}
+	if sizes := s.batchSizes(); len(sizes) != 1 {
+		t.Errorf("%d batches handled, want 1 after 2 failures", len(sizes))
+	}
+	if n := s.entries(t); n != 5 {
+		t.Errorf("%d entries created, want 5", n)
+	}
+	if d := c.Dropped(); d != 0 {
+		t.Errorf("%d entries dropped", d)
+	}
+}
+
+func TestSpillAndResend(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "quicklog-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomic.StoreInt32(&s.down, 1)
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: 50 * time.Millisecond,
+		MaxRetries: 1, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, SpillDir: dir})
+	defer c.Close()
+
+	logEntries(t, c, 4)
+	// the batch may already have been spilled by the interval flush
+	c.Flush(context.Background())
+	if spilled, _ := filepath.Glob(filepath.Join(dir, "*.quicklog.json")); len(spilled) == 0 {
+		t.Fatal("nothing spilled with the server down")
+	}
+	if n := s.entries(t); n != 0 {
+		t.Fatalf("%d entries created with the server down", n)
+	}
+
+	atomic.StoreInt32(&s.down, 0)
+	eventually(t, "the spilled batch to be resent", func() bool {
+		spilled, _ := filepath.Glob(filepath.Join(dir, "*.quicklog.json"))
+		return len(spilled) == 0
+	})
+	if n := s.entries(t); n != 4 {
+		t.Errorf("%d entries created, want 4", n)
+	}
+	if d := c.Dropped(); d != 0 {
+		t.Errorf("%d entries dropped", d)
+	}
+}
+
+func TestRetryIsIdempotent(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	// the first batch is created but its response is lost, so it is sent again
+	s.failAfter = 1
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: time.Hour,
+		MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer c.Close()
+
+	logEntries(t, c, 6)
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := s.batchSizes(); fmt.Sprint(sizes) != "[6 6]" {
+		t.Errorf("batch sizes %v, want [6 6]", sizes)
+	}
+	if n := s.entries(t); n != 6 {
+		t.Errorf("%d entries created, want 6 (event_ids should make the retry a no-op)", n)
+	}
+}
+
+// fakeServer accepts POSTed batches without a database, recording the entries
+// by event id, and responds with respond's status (and Retry-After) if it's set.
+type fakeServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests int
+	accepted int
+	entries  map[string]bool
+	// respond returns the status and Retry-After header for the nth request (from 1),
+	// or 0 to accept it
+	respond func(n int) (int, string)
+}
+
+func newFakeServer(respond func(n int) (int, string)) *fakeServer {
+	s := &fakeServer{entries: make(map[string]bool), respond: respond}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []client.Entry
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, `{"message":"bad batch"}`, http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.Lock()
+		s.requests++
+		status, retryAfter := 0, ""
+		if s.respond != nil {
+			status, retryAfter = s.respond(s.requests)
+		}
+		if status == 0 {
+			s.accepted++
+			for _, e := range batch {
+				s.entries[e.EventId] = true
+			}
+		}
+		s.mutex.Unlock()
+
+		if status != 0 {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(w, `{"message":"try later"}`, status)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return s
+}
+
+func (s *fakeServer) received() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+func (s *fakeServer) client(t *testing.T, config client.Config) *client.Client {
+	config.URL = s.URL
+	config.ProjectId = 1
+	config.Source = "client-test"
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newFakeServer(func(n int) (int, string) {
+		if n == 1 {
+			return http.StatusTooManyRequests, "1"
+		}
+		return 0, ""
+	})
+	defer s.Close()
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: time.Hour,
+		MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer c.Close()
+
+	logEntries(t, c, 3)
+	start := time.Now()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want the 1s Retry-After rather than the backoff", elapsed)
+	}
+	if n := s.received(); n != 3 {
+		t.Errorf("%d entries received, want 3", n)
+	}
+}
+
+func TestDrainWhileRetrying(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quicklog-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the server is unavailable for the first 300ms
+	up := time.Now().Add(300 * time.Millisecond)
+	s := newFakeServer(func(n int) (int, string) {
+		if time.Now().Before(up) {
+			return http.StatusServiceUnavailable, ""
+		}
+		return 0, ""
+	})
+	defer s.Close()
+	c := s.client(t, client.Config{QueueSize: 10, BatchSize: 10, FlushInterval: 50 * time.Millisecond,
+		MaxRetries: 100, MinBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, SpillDir: dir})
+	defer c.Close()
+
+	// more than fit in the queue, logged while the first batch is being retried
+	for i := 0; i < 100; i++ {
+		if err := c.Log(client.Entry{Type: fmt.Sprintf("event-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if d := c.Dropped(); d != 0 {
+		t.Fatalf("%d entries dropped while retrying", d)
+	}
+	eventually(t, "all entries to be received", func() bool { return s.received() == 100 })
+	eventually(t, "the spilled batches to be resent", func() bool {
+		spilled, _ := filepath.Glob(filepath.Join(dir, "*.quicklog.json"))
+		return len(spilled) == 0
+	})
+	// batches were spilled rather than each entry that didn't fit in the queue
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.accepted > 30 {
+		t.Errorf("%d batches accepted, want about 10 of 10 entries", s.accepted)
+	}
+}
+
+func TestPermanentErrorDrops(t *testing.T) {
+	s := newFakeServer(func(n int) (int, string) {
+		return http.StatusBadRequest, ""
+	})
+	defer s.Close()
+	c := s.client(t, client.Config{BatchSize: 100, FlushInterval: time.Hour})
+	defer c.Close()
+
+	logEntries(t, c, 4)
+	if err := c.Flush(context.Background()); err == nil {
+		t.Error("Flush of a rejected batch returned no error")
+	}
+	if d := c.Dropped(); d != 4 {
+		t.Errorf("%d entries dropped, want 4", d)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.requests != 1 {
+		t.Errorf("%d requests, want 1 without retries", s.requests)
+	}
+}
@@ -0,0 +1,26 @@
+package client
+
+import "time"
+
+// Entry is an entry as POSTed to /entries. It has the fields of the server's
+// storage.Entry that a client sets, so that the client doesn't import the
+// server's storage package (and its database driver).
+type Entry struct {
+	ProjectId    int32     `json:"project_id"`
+	Published    time.Time `json:"published"`
+	Source       string    `json:"source"`
+	Type         string    `json:"type"`
+	Actor        string    `json:"actor"`
+	Object       string    `json:"object"`
+	Target       string    `json:"target"`
+	Context      Context   `json:"context"`
+	TraceId      string    `json:"trace_id"`
+	ParentSpanId string    `json:"parent_span_id"`
+	SpanId       string    `json:"span_id"`
+	EventId      string    `json:"event_id,omitempty"`
+	// Tags are 'key:value' (or 'value') tags of the entry's span, which needs a TraceId.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Context is the JSON object of an entry's context.
+type Context map[string]interface{}
@@ -0,0 +1,218 @@
+// Package middleware logs an entry to quicklog for each HTTP request served
+// (Handler) or sent (Transport), continuing traces across services with the
+// W3C Trace Context 'traceparent' header.
+//
+// The entry Type is the method and route, e.g. "POST /uploads", the Actor is
+// the authenticated user (see SetActor), and the Context has the response
+// "status", "duration_ms" and "size".
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/client"
+)
+
+// Logger is where entries are sent, e.g. a *client.Client.
+type Logger interface {
+	Log(e client.Entry) error
+}
+
+type Options struct {
+	// Source is the entry Source. Defaults to the host name.
+	Source string
+	// Route returns the route of the request for the entry Type, e.g. "/users/{id}".
+	// Defaults to the URL path.
+	Route func(r *http.Request) string
+	// Actor returns the authenticated user, e.g. "user:1234". Defaults to the basic
+	// auth user name. A handler can also call SetActor once it has authenticated.
+	Actor func(r *http.Request) string
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Source == "" {
+		opts.Source, _ = os.Hostname()
+	}
+	if opts.Route == nil {
+		opts.Route = func(r *http.Request) string { return r.URL.Path }
+	}
+	if opts.Actor == nil {
+		opts.Actor = func(r *http.Request) string {
+			if user, _, ok := r.BasicAuth(); ok && user != "" {
+				return "user:" + user
+			}
+			return ""
+		}
+	}
+	return opts
+}
+
+// Handler logs an entry for each request served by next. The request context
+// carries the request's span (see client.SpanFromContext) so that entries
+// logged while serving it, and requests sent with Transport, are in its trace.
+func Handler(logger Logger, next http.Handler, opts *Options) http.Handler {
+	o := opts.withDefaults()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		span := client.NewSpan()
+		if parent, ok := client.Extract(r.Header); ok {
+			span = parent.Child()
+		}
+		holder := &actorHolder{actor: o.Actor(r)}
+		ctx := context.WithValue(client.ContextWithSpan(r.Context(), span), actorKey{}, holder)
+		r = r.WithContext(ctx)
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			status := rw.status
+			if p := recover(); p != nil {
+				status = http.StatusInternalServerError
+				defer panic(p)
+			}
+
+			e := client.Entry{
+				Published: start.UTC(),
+				Source:    o.Source,
+				Type:      r.Method + " " + o.Route(r),
+				Actor:     holder.get(),
+				Context: client.Context{
+					"status":      status,
+					"duration_ms": durationMillis(time.Since(start)),
+					"size":        rw.size,
+				},
+			}
+			span.Apply(&e)
+			logger.Log(e)
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Transport logs an entry for each request sent with base (http.DefaultTransport
+// if nil) and sets its 'traceparent' header to continue the trace of the
+// request context.
+func Transport(logger Logger, base http.RoundTripper, opts *Options) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{logger: logger, base: base, opts: opts.withDefaults()}
+}
+
+type transport struct {
+	logger Logger
+	base   http.RoundTripper
+	opts   Options
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	parent, _ := client.SpanFromContext(r.Context())
+	span := parent.Child()
+
+	// a RoundTripper must not modify the request
+	r2 := r.Clone(r.Context())
+	client.Inject(r2.Header, span)
+
+	resp, err := t.base.RoundTrip(r2)
+
+	actor := ActorFromContext(r.Context())
+	if actor == "" {
+		actor = t.opts.Actor(r)
+	}
+	e := client.Entry{
+		Published: start.UTC(),
+		Source:    t.opts.Source,
+		Type:      r.Method + " " + t.opts.Route(r),
+		Actor:     actor,
+		Target:    "host:" + r.URL.Host,
+		Context: client.Context{
+			"duration_ms": durationMillis(time.Since(start)),
+		},
+	}
+	if err != nil {
+		e.Context["error"] = err.Error()
+	} else {
+		e.Context["status"] = resp.StatusCode
+		if resp.ContentLength >= 0 {
+			e.Context["size"] = resp.ContentLength
+		}
+	}
+	span.Apply(&e)
+	t.logger.Log(e)
+
+	return resp, err
+}
+
+type actorKey struct{}
+
+type actorHolder struct {
+	mutex sync.Mutex
+	actor string
+}
+
+func (h *actorHolder) get() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.actor
+}
+
+// SetActor sets the Actor of the entry for the request being served by Handler.
+func SetActor(ctx context.Context, actor string) {
+	if h, ok := ctx.Value(actorKey{}).(*actorHolder); ok {
+		h.mutex.Lock()
+		h.actor = actor
+		h.mutex.Unlock()
+	}
+}
+
+// ActorFromContext returns the Actor of the request being served by Handler.
+func ActorFromContext(ctx context.Context) string {
+	if h, ok := ctx.Value(actorKey{}).(*actorHolder); ok {
+		return h.get()
+	}
+	return ""
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,210 @@
+// Package slog_handler is a log/slog Handler that sends records to quicklog.
+//
+// The record message becomes the entry Type and the configured Source its
+// Source. The well-known attrs actor, object, target, trace_id, parent_span_id
+// and span_id (outside of any group) are lifted into the entry fields, and all
+// other attrs and groups go into its Context. Records are queued on a
+// client.Client, so Handle never waits on the network.
+package slog_handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/karmakaze/quicklog/client"
+)
+
+type Options struct {
+	// Source is the entry Source, e.g. the logger name. Defaults to the host name.
+	Source string
+	// Level is the minimum level logged. Defaults to slog.LevelInfo.
+	Level slog.Leveler
+}
+
+type Handler struct {
+	client *client.Client
+	source string
+	level  slog.Leveler
+	attrs  []groupedAttr
+	groups []string
+}
+
+// groupedAttr is an attr added by WithAttrs within the groups open at the time.
+type groupedAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+func New(c *client.Client, opts *Options) *Handler {
+	h := &Handler{client: c, level: slog.LevelInfo}
+	if opts != nil {
+		h.source = opts.Source
+		if opts.Level != nil {
+			h.level = opts.Level
+		}
+	}
+	if h.source == "" {
+		h.source, _ = os.Hostname()
+	}
+	return h
+}
+
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	e := client.Entry{
+		Published: record.Time.UTC(),
+		Source:    h.source,
+		Type:      record.Message,
+		Context:   client.Context{"level": record.Level.String()},
+	}
+	if e.Published.IsZero() {
+		e.Published = time.Now().UTC()
+	}
+	if span, ok := client.SpanFromContext(ctx); ok {
+		span.Apply(&e)
+	}
+
+	for _, a := range h.attrs {
+		addAttr(&e, a.groups, a.attr)
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		addAttr(&e, h.groups, a)
+		return true
+	})
+
+	return h.client.Log(e)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.attrs = make([]groupedAttr, len(h.attrs), len(h.attrs)+len(attrs))
+	copy(h2.attrs, h.attrs)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, groupedAttr{groups: h.groups, attr: a})
+	}
+	return &h2
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = make([]string, len(h.groups), len(h.groups)+1)
+	copy(h2.groups, h.groups)
+	h2.groups = append(h2.groups, name)
+	return &h2
+}
+
+// addAttr lifts a well-known top-level attr into the entry, or else adds it to
+// the entry Context within the groups.
+func addAttr(e *client.Entry, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if len(groups) == 0 && a.Value.Kind() == slog.KindString {
+		switch a.Key {
+		case "actor":
+			e.Actor = a.Value.String()
+			return
+		case "object":
+			e.Object = a.Value.String()
+			return
+		case "target":
+			e.Target = a.Value.String()
+			return
+		case "trace_id":
+			e.TraceId = a.Value.String()
+			return
+		case "parent_span_id":
+			e.ParentSpanId = a.Value.String()
+			return
+		case "span_id":
+			e.SpanId = a.Value.String()
+			return
+		}
+	}
+
+	m := map[string]interface{}(e.Context)
+	for _, g := range groups {
+		sub, ok := m[g].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[g] = sub
+		}
+		m = sub
+	}
+	setAttr(m, a)
+}
+
+func setAttr(m map[string]interface{}, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		if a.Key != "" {
+			sub, ok := m[a.Key].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{}, len(attrs))
+				m[a.Key] = sub
+			}
+			m = sub
+		}
+		for _, ga := range attrs {
+			setAttr(m, ga)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+	m[a.Key] = value(a.Value)
+}
+
+// value converts to a JSON friendly value.
+func value(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindString:
+		return v.String()
+	case slog.KindInt64:
+		return v.Int64()
+	case slog.KindUint64:
+		return v.Uint64()
+	case slog.KindFloat64:
+		return v.Float64()
+	case slog.KindBool:
+		return v.Bool()
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	}
+
+	switch x := v.Any().(type) {
+	case error:
+		return x.Error()
+	case json.Marshaler:
+		return x
+	case fmt.Stringer:
+		return x.String()
+	default:
+		if _, err := json.Marshal(x); err != nil {
+			return fmt.Sprint(x)
+		}
+		return x
+	}
+}
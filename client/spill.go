@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spill saves batches that couldn't be sent as JSON files in a directory,
+// named so that they sort oldest first.
+type spill struct {
+	dir   string
+	mutex sync.Mutex
+	seq   int
+}
+
+const spillSuffix = ".quicklog.json"
+
+func newSpill(dir string) (*spill, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spill{dir: dir}, nil
+}
+
+func (s *spill) save(batch []Entry) error {
+	content, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spillSuffix)
+	s.mutex.Unlock()
+
+	// write then rename so that a partial file is never read back
+	path := filepath.Join(s.dir, name)
+	if err = ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// oldest returns the name and entries of the oldest spilled batch, or "" if there are none.
+func (s *spill) oldest() (string, []Entry, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return "", nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spillSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", nil, nil
+	}
+	sort.Strings(names)
+
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, names[0]))
+	if err != nil {
+		return names[0], nil, err
+	}
+	var batch []Entry
+	if err = json.Unmarshal(content, &batch); err != nil {
+		return names[0], nil, err
+	}
+	return names[0], batch, nil
+}
+
+func (s *spill) remove(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
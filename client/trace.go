@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Span identifies where an entry is in a trace. TraceId is 32 and span ids 16
+// lowercase hex digits, as in the W3C Trace Context 'traceparent' header.
+type Span struct {
+	TraceId      string
+	ParentSpanId string
+	SpanId       string
+}
+
+func NewTraceId() string {
+	return newId(16)
+}
+
+func NewSpanId() string {
+	return newId(8)
+}
+
+// NewSpan starts a new trace.
+func NewSpan() Span {
+	return Span{TraceId: NewTraceId(), SpanId: NewSpanId()}
+}
+
+// Child returns a new span in the same trace with this span as its parent.
+func (s Span) Child() Span {
+	if s.TraceId == "" {
+		return NewSpan()
+	}
+	return Span{TraceId: s.TraceId, ParentSpanId: s.SpanId, SpanId: NewSpanId()}
+}
+
+// Apply sets the entry's trace, parent span and span ids.
+func (s Span) Apply(e *Entry) {
+	e.TraceId = s.TraceId
+	e.ParentSpanId = s.ParentSpanId
+	e.SpanId = s.SpanId
+}
+
+type spanKey struct{}
+
+func ContextWithSpan(ctx context.Context, s Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func SpanFromContext(ctx context.Context) (Span, bool) {
+	s, ok := ctx.Value(spanKey{}).(Span)
+	return s, ok
+}
+
+// StartSpan returns a child of the span in ctx (or a new trace if there is
+// none) along with a context carrying it.
+func StartSpan(ctx context.Context) (context.Context, Span) {
+	parent, _ := SpanFromContext(ctx)
+	s := parent.Child()
+	return ContextWithSpan(ctx, s), s
+}
+
+const TraceparentHeader = "traceparent"
+
+// Inject sets the 'traceparent' header so that the receiver continues the trace
+// with this span as its parent.
+func Inject(h http.Header, s Span) {
+	if s.TraceId == "" || s.SpanId == "" {
+		return
+	}
+	h.Set(TraceparentHeader, "00-"+s.TraceId+"-"+s.SpanId+"-01")
+}
+
+// Extract parses the 'traceparent' header. The returned span is the sender's
+// span; use Child() for the receiver's own span.
+func Extract(h http.Header) (Span, bool) {
+	parts := strings.Split(strings.TrimSpace(h.Get(TraceparentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return Span{}, false
+	}
+	traceId, spanId := strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if len(traceId) != 32 || !isHex(traceId) || strings.Trim(traceId, "0") == "" ||
+		len(spanId) != 16 || !isHex(spanId) || strings.Trim(spanId, "0") == "" {
+		return Span{}, false
+	}
+	return Span{TraceId: traceId, SpanId: spanId}, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,295 @@
+// Package enrich adds derived data to entries before they are stored, by a
+// chain of enrichers configured per project as the "enrichers" project config:
+//
+//	{"enrichers": [{"type": "user_agent"}, {"type": "url", "options": {"field": "context.request.url"}}]}
+//
+// Enrichers run in order after an entry is decoded and validated, and before
+// the project's redaction rules are applied. An enricher that fails leaves the
+// entry as it is and the chain goes on. The entries, errors (by class) and time
+// taken by each type of enricher are published with expvar at /debug/vars under
+// "enrich".
+package enrich
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const ConfigName = "enrichers"
+
+// An Enricher adds derived data to an entry, typically to its context.
+type Enricher interface {
+	Enrich(e *storage.Entry) error
+}
+
+// A Factory makes an enricher from its JSON options, which may be empty.
+type Factory func(options json.RawMessage) (Enricher, error)
+
+var (
+	factoriesMutex sync.Mutex
+	factories      = make(map[string]Factory)
+)
+
+// Register makes a type of enricher available to project configs.
+func Register(typ string, f Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if _, ok := factories[typ]; ok {
+		panic("enrich: enricher type registered twice: " + typ)
+	}
+	factories[typ] = f
+}
+
+// Types returns the registered enricher types.
+func Types() []string {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Config configures an enricher of a project's chain.
+type Config struct {
+	Type    string          `json:"type"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// Configs is a project's "enrichers" config.
+type Configs struct {
+	Enrichers []Config `json:"enrichers"`
+}
+
+// Validate checks that the enrichers can be made from their options.
+func (c *Configs) Validate() error {
+	_, err := NewChain(c.Enrichers)
+	return err
+}
+
+// Chain is a project's enrichers, in order.
+type Chain struct {
+	types     []string
+	enrichers []Enricher
+}
+
+func NewChain(configs []Config) (*Chain, error) {
+	c := &Chain{}
+	for i, config := range configs {
+		factoriesMutex.Lock()
+		f, ok := factories[config.Type]
+		factoriesMutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("enricher %d: 'type' must be one of '%s'", i, strings.Join(Types(), "', '"))
+		}
+		enricher, err := f(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("enricher %d (%s): %v", i, config.Type, err)
+		}
+		c.types = append(c.types, config.Type)
+		c.enrichers = append(c.enrichers, enricher)
+	}
+	return c, nil
+}
+
+// Enrich runs the enrichers on the entry, recording their metrics.
+func (c *Chain) Enrich(e *storage.Entry) {
+	for i, enricher := range c.enrichers {
+		start := time.Now()
+		err := enricher.Enrich(e)
+		record(c.types[i], time.Since(start), err)
+	}
+}
+
+type cachedChain struct {
+	config []byte
+	chain  *Chain
+}
+
+var (
+	chainsMutex sync.Mutex
+	chains      = make(map[int32]cachedChain)
+)
+
+// GetChain returns the project's enricher chain, or nil if it has none. Chains
+// are made again only when the project's config changes.
+func GetChain(projectId int32, db *sql.DB, ctx context.Context) (*Chain, error) {
+	var config json.RawMessage
+	if ok, err := storage.GetProjectConfig(projectId, ConfigName, &config, db, ctx); err != nil {
+		return nil, err
+	} else if !ok {
+		chainsMutex.Lock()
+		delete(chains, projectId)
+		chainsMutex.Unlock()
+		return nil, nil
+	}
+
+	chainsMutex.Lock()
+	cached, ok := chains[projectId]
+	chainsMutex.Unlock()
+	if ok && bytes.Equal(cached.config, config) {
+		return cached.chain, nil
+	}
+
+	var configs Configs
+	if err := json.Unmarshal(config, &configs); err != nil {
+		return nil, err
+	}
+	chain, err := NewChain(configs.Enrichers)
+	if err != nil {
+		return nil, err
+	}
+	chainsMutex.Lock()
+	chains[projectId] = cachedChain{config: config, chain: chain}
+	chainsMutex.Unlock()
+	return chain, nil
+}
+
+// Entries runs the chains of the entries' projects on them in place.
+func Entries(entries []storage.Entry, db *sql.DB, ctx context.Context) error {
+	projectChains := make(map[int32]*Chain)
+	for i := range entries {
+		chain, ok := projectChains[entries[i].ProjectId]
+		if !ok {
+			var err error
+			if chain, err = GetChain(entries[i].ProjectId, db, ctx); err != nil {
+				return err
+			}
+			projectChains[entries[i].ProjectId] = chain
+		}
+		if chain != nil {
+			chain.Enrich(&entries[i])
+		}
+	}
+	return nil
+}
+
+// The classes of enricher errors, which are published instead of the errors as
+// those can quote entry data.
+const (
+	ErrorInvalidField = "invalid_field"
+	ErrorParse        = "parse"
+	ErrorLookup       = "lookup"
+	ErrorOther        = "other"
+)
+
+// Error is an enricher error of a class.
+type Error struct {
+	Class string
+	Err   error
+}
+
+func (e Error) Error() string {
+	return e.Err.Error()
+}
+
+// invalidField is the error of a context value that isn't what an enricher expects.
+func invalidField(path []string, what string) error {
+	return Error{ErrorInvalidField, fmt.Errorf("context.%s is not %s", strings.Join(path, "."), what)}
+}
+
+func errorClass(err error) string {
+	if e, ok := err.(Error); ok {
+		return e.Class
+	}
+	return ErrorOther
+}
+
+// metrics are published per enricher type as
+// {"user_agent": {"entries": 10, "errors": 1, "nanoseconds": 52000, "error_classes": {"invalid_field": 1}}}.
+var (
+	metrics      = expvar.NewMap("enrich")
+	metricsMutex sync.Mutex
+)
+
+func record(typ string, elapsed time.Duration, err error) {
+	metricsMutex.Lock()
+	m, ok := metrics.Get(typ).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		m.Set("error_classes", new(expvar.Map).Init())
+		metrics.Set(typ, m)
+	}
+	metricsMutex.Unlock()
+
+	m.Add("entries", 1)
+	m.Add("nanoseconds", elapsed.Nanoseconds())
+	if err != nil {
+		m.Add("errors", 1)
+		m.Get("error_classes").(*expvar.Map).Add(errorClass(err), 1)
+	}
+}
+
+// DecodeOptions decodes the options of an enricher, if any, into v, which holds the defaults.
+func DecodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 || string(options) == "null" {
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(options))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("'options': %v", err)
+	}
+	return nil
+}
+
+// ContextPath parses a "context.<path>" option.
+func ContextPath(option, field string) ([]string, error) {
+	if !strings.HasPrefix(field, "context.") {
+		return nil, fmt.Errorf("'%s' must be context.<path>", option)
+	}
+	path, err := storage.ParseContextPath(strings.TrimPrefix(field, "context."))
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %v", option, err)
+	}
+	return path, nil
+}
+
+// Lookup returns the value at the path in the entry's context.
+func Lookup(e *storage.Entry, path []string) (interface{}, bool) {
+	var v interface{} = map[string]interface{}(e.Context)
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Set sets the value at the path in the entry's context, adding objects as needed.
+func Set(e *storage.Entry, path []string, value interface{}) error {
+	if e.Context == nil {
+		e.Context = make(storage.ContextMap)
+	}
+	m := map[string]interface{}(e.Context)
+	for i, key := range path[:len(path)-1] {
+		switch v := m[key].(type) {
+		case map[string]interface{}:
+			m = v
+		case nil:
+			child := make(map[string]interface{})
+			m[key] = child
+			m = child
+		default:
+			return invalidField(path[:i+1], "an object")
+		}
+	}
+	m[path[len(path)-1]] = value
+	return nil
+}
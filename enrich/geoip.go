@@ -0,0 +1,248 @@
+package enrich
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func init() {
+	Register("geoip", newGeoIP)
+}
+
+const (
+	GeoIPPrefix         = "ip:"
+	geoIPReloadInterval = 30 * time.Second
+)
+
+// geoIP looks up the IP address of an "ip:" Source or Actor, or at Field, in
+// the GeoIP database and sets Target to its location:
+//
+//	{"country": "CA", "country_name": "Canada", "region": "ON", "city": "Toronto",
+//	 "latitude": 43.6547, "longitude": -79.3623, "time_zone": "America/Toronto"}
+//
+// With DropIP the address at Field is removed, and the address of an "ip:"
+// Source or Actor is replaced by the country, e.g. "ip:CA".
+type geoIP struct {
+	field, target []string
+	dropIP        bool
+}
+
+var geoIPDatabase = &geoDatabase{}
+
+// geoDatabase is a MaxMind format database file that is reloaded when it changes.
+type geoDatabase struct {
+	mu      sync.RWMutex
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+		TimeZone  string   `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+// OpenGeoIP opens the GeoIP (.mmdb) database used by "geoip" enrichers, e.g. GeoLite2-City,
+// and reloads it whenever the file changes. The file is read into memory so it can be
+// replaced in place, though renaming a new file over it is safer.
+func OpenGeoIP(path string) error {
+	if err := geoIPDatabase.open(path); err != nil {
+		return err
+	}
+	go geoIPDatabase.run()
+	return nil
+}
+
+func (d *geoDatabase) open(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return fmt.Errorf("GeoIP database %s: %v", path, err)
+	}
+
+	d.mu.Lock()
+	d.path, d.reader, d.modTime, d.size = path, reader, info.ModTime(), info.Size()
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *geoDatabase) run() {
+	for range time.Tick(geoIPReloadInterval) {
+		d.mu.RLock()
+		path, modTime, size := d.path, d.modTime, d.size
+		d.mu.RUnlock()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Error checking GeoIP database: %v\n", err)
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		// a file being written fails to open and is retried
+		if err = d.open(path); err != nil {
+			log.Printf("Error reloading GeoIP database: %v\n", err)
+			continue
+		}
+		log.Printf("Reloaded GeoIP database %s\n", path)
+	}
+}
+
+func (d *geoDatabase) isOpen() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.reader != nil
+}
+
+// lookup returns the location of the IP address, or nil if it isn't in the database.
+func (d *geoDatabase) lookup(ip net.IP) (map[string]interface{}, error) {
+	d.mu.RLock()
+	reader := d.reader
+	d.mu.RUnlock()
+	if reader == nil {
+		return nil, errors.New("no GeoIP database is open")
+	}
+
+	var r geoRecord
+	if _, ok, err := reader.LookupNetwork(ip, &r); !ok || err != nil {
+		return nil, err
+	}
+	geo := make(map[string]interface{})
+	if r.Country.ISOCode != "" {
+		geo["country"] = r.Country.ISOCode
+	}
+	if name := r.Country.Names["en"]; name != "" {
+		geo["country_name"] = name
+	}
+	if len(r.Subdivisions) > 0 && r.Subdivisions[0].ISOCode != "" {
+		geo["region"] = r.Subdivisions[0].ISOCode
+	}
+	if name := r.City.Names["en"]; name != "" {
+		geo["city"] = name
+	}
+	if r.Location.Latitude != nil && r.Location.Longitude != nil {
+		geo["latitude"], geo["longitude"] = *r.Location.Latitude, *r.Location.Longitude
+	}
+	if r.Location.TimeZone != "" {
+		geo["time_zone"] = r.Location.TimeZone
+	}
+	return geo, nil
+}
+
+func newGeoIP(options json.RawMessage) (Enricher, error) {
+	o := struct {
+		Field  string `json:"field"`
+		Target string `json:"target"`
+		DropIP bool   `json:"drop_ip"`
+	}{Target: "context.geo"}
+	if err := DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	if !geoIPDatabase.isOpen() {
+		return nil, errors.New("no GeoIP database is configured")
+	}
+	g := geoIP{dropIP: o.DropIP}
+	var err error
+	if o.Field != "" {
+		if g.field, err = ContextPath("field", o.Field); err != nil {
+			return nil, err
+		}
+	}
+	if g.target, err = ContextPath("target", o.Target); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g geoIP) Enrich(e *storage.Entry) error {
+	var ip net.IP
+	if g.field != nil {
+		if v, ok := Lookup(e, g.field); ok {
+			s, _ := v.(string)
+			if ip = net.ParseIP(s); ip == nil {
+				return invalidField(g.field, "an IP address")
+			}
+		}
+	}
+	for _, s := range []string{e.Source, e.Actor} {
+		if ip == nil && strings.HasPrefix(s, GeoIPPrefix) {
+			ip = net.ParseIP(strings.TrimPrefix(s, GeoIPPrefix))
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+
+	var geo map[string]interface{}
+	if v, ok := Lookup(e, g.target); ok {
+		geo, _ = v.(map[string]interface{})
+	} else {
+		var err error
+		if geo, err = geoIPDatabase.lookup(ip); err != nil {
+			return Error{ErrorLookup, err}
+		}
+		if geo != nil {
+			if err = Set(e, g.target, geo); err != nil {
+				return err
+			}
+		}
+	}
+
+	if g.dropIP {
+		g.drop(e, geo)
+	}
+	return nil
+}
+
+// drop removes the IP addresses from the entry, leaving the country of "ip:" sources and actors.
+func (g geoIP) drop(e *storage.Entry, geo map[string]interface{}) {
+	if g.field != nil {
+		if v, ok := Lookup(e, g.field[:len(g.field)-1]); ok {
+			if m, ok := v.(map[string]interface{}); ok {
+				delete(m, g.field[len(g.field)-1])
+			}
+		}
+	}
+	country, _ := geo["country"].(string)
+	if country == "" {
+		country = "unknown"
+	}
+	for _, s := range []*string{&e.Source, &e.Actor} {
+		if strings.HasPrefix(*s, GeoIPPrefix) && net.ParseIP(strings.TrimPrefix(*s, GeoIPPrefix)) != nil {
+			*s = GeoIPPrefix + country
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package enrich
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+func init() {
+	Register("source", newSource)
+}
+
+// source adds static metadata by the entry's source to Target, e.g. the
+// deployed version of each service:
+//
+//	{"target": "context.deploy", "sources": {"api": {"version": "1.4.2"}, "*": {"region": "us-east-1"}}}
+//
+// The "*" source applies to entries of any other source. Keys already in
+// Target are kept.
+type source struct {
+	target  []string
+	sources map[string]map[string]interface{}
+}
+
+func newSource(options json.RawMessage) (Enricher, error) {
+	o := struct {
+		Target  string                            `json:"target"`
+		Sources map[string]map[string]interface{} `json:"sources"`
+	}{Target: "context.deploy"}
+	if err := DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	if len(o.Sources) == 0 {
+		return nil, fmt.Errorf("'sources' is required")
+	}
+	target, err := ContextPath("target", o.Target)
+	if err != nil {
+		return nil, err
+	}
+	return source{target: target, sources: o.Sources}, nil
+}
+
+func (s source) Enrich(e *storage.Entry) error {
+	metadata, ok := s.sources[e.Source]
+	if !ok {
+		if metadata, ok = s.sources["*"]; !ok {
+			return nil
+		}
+	}
+
+	v, ok := Lookup(e, s.target)
+	if !ok {
+		return Set(e, s.target, copyJson(metadata))
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return invalidField(s.target, "an object")
+	}
+	for key, value := range metadata {
+		if _, ok := m[key]; !ok {
+			m[key] = copyJson(value)
+		}
+	}
+	return nil
+}
+
+// copyJson copies a decoded JSON value so that entries don't share objects or arrays.
+func copyJson(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = copyJson(value)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, value := range v {
+			a[i] = copyJson(value)
+		}
+		return a
+	}
+	return v
+}
@@ -0,0 +1,91 @@
+package enrich
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+func init() {
+	Register("url", newURL)
+}
+
+// urlRoute sets Target to the route of the URL at Field, its path with
+// segments that look like ids replaced by "{id}", e.g. "/users/{id}/orders".
+// With Method, the request method at that context path prefixes the route
+// as in "GET /users/{id}".
+type urlRoute struct {
+	field, target, method []string
+}
+
+var idSegment = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+func newURL(options json.RawMessage) (Enricher, error) {
+	o := struct {
+		Field  string `json:"field"`
+		Target string `json:"target"`
+		Method string `json:"method"`
+	}{Field: "context.url", Target: "context.route"}
+	if err := DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	var u urlRoute
+	var err error
+	if u.field, err = ContextPath("field", o.Field); err != nil {
+		return nil, err
+	}
+	if u.target, err = ContextPath("target", o.Target); err != nil {
+		return nil, err
+	}
+	if o.Method != "" {
+		if u.method, err = ContextPath("method", o.Method); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (u urlRoute) Enrich(e *storage.Entry) error {
+	v, ok := Lookup(e, u.field)
+	if !ok {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return invalidField(u.field, "a string")
+	}
+	if _, ok = Lookup(e, u.target); ok || s == "" {
+		return nil
+	}
+	parsed, err := url.Parse(s)
+	if err != nil {
+		return Error{ErrorParse, err}
+	}
+
+	route := Route(parsed.Path)
+	if u.method != nil {
+		if method, ok := Lookup(e, u.method); ok {
+			route = fmt.Sprintf("%v %s", method, route)
+		}
+	}
+	return Set(e, u.target, route)
+}
+
+// Route replaces the segments of the path that look like ids (numbers, UUIDs
+// or long hex strings) with "{id}".
+func Route(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,144 @@
+package enrich
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+func init() {
+	Register("user_agent", newUserAgent)
+}
+
+// userAgent parses the User-Agent string at Field into an object at Target:
+//
+//	{"browser": "Chrome", "browser_version": "120.0.0.0", "os": "Windows", "os_version": "10", "device": "desktop"}
+//
+// where the device is "desktop", "mobile", "tablet" or "bot".
+type userAgent struct {
+	field, target []string
+}
+
+func newUserAgent(options json.RawMessage) (Enricher, error) {
+	o := struct {
+		Field  string `json:"field"`
+		Target string `json:"target"`
+	}{Field: "context.user_agent", Target: "context.client"}
+	if err := DecodeOptions(options, &o); err != nil {
+		return nil, err
+	}
+	field, err := ContextPath("field", o.Field)
+	if err != nil {
+		return nil, err
+	}
+	target, err := ContextPath("target", o.Target)
+	if err != nil {
+		return nil, err
+	}
+	return userAgent{field: field, target: target}, nil
+}
+
+func (u userAgent) Enrich(e *storage.Entry) error {
+	v, ok := Lookup(e, u.field)
+	if !ok {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return invalidField(u.field, "a string")
+	}
+	if _, ok = Lookup(e, u.target); ok || s == "" {
+		return nil
+	}
+	return Set(e, u.target, parseUserAgent(s))
+}
+
+var (
+	uaProduct = regexp.MustCompile(`([A-Za-z][\w.-]*)/([\w.]+)`)
+	uaMSIE    = regexp.MustCompile(`MSIE ([\d.]+)|Trident/.*rv:([\d.]+)`)
+	uaBot     = regexp.MustCompile(`(?i)bot\b|crawler|spider|slurp|curl/|wget/|python-requests|go-http-client|okhttp`)
+	uaTablet  = regexp.MustCompile(`iPad|Tablet|Kindle|Silk/`)
+	uaMobile  = regexp.MustCompile(`Mobi|iPhone|iPod|Android|Windows Phone`)
+
+	// browsers are checked in order since most User-Agents include the tokens of others
+	uaBrowsers = []struct{ token, name string }{
+		{"Edg", "Edge"}, {"EdgA", "Edge"}, {"EdgiOS", "Edge"}, {"Edge", "Edge"},
+		{"OPR", "Opera"}, {"SamsungBrowser", "Samsung Internet"}, {"YaBrowser", "Yandex"},
+		{"FxiOS", "Firefox"}, {"Firefox", "Firefox"}, {"CriOS", "Chrome"}, {"Chrome", "Chrome"},
+	}
+	uaOperatingSystems = []struct {
+		pattern *regexp.Regexp
+		name    string
+	}{
+		{regexp.MustCompile(`Windows Phone(?: OS)? ([\d.]+)`), "Windows Phone"},
+		{regexp.MustCompile(`Windows NT ([\d.]+)`), "Windows"},
+		{regexp.MustCompile(`(?:iPhone |CPU )OS ([\d_]+)`), "iOS"},
+		{regexp.MustCompile(`Android ([\d.]+)`), "Android"},
+		{regexp.MustCompile(`Mac OS X ([\d_.]+)`), "macOS"},
+		{regexp.MustCompile(`CrOS \S+ ([\d.]+)`), "Chrome OS"},
+		{regexp.MustCompile(`Linux()`), "Linux"},
+	}
+	uaWindowsVersions = map[string]string{
+		"10.0": "10", "6.3": "8.1", "6.2": "8", "6.1": "7", "6.0": "Vista", "5.1": "XP",
+	}
+)
+
+func parseUserAgent(s string) map[string]interface{} {
+	products := make(map[string]string)
+	first := ""
+	for _, m := range uaProduct.FindAllStringSubmatch(s, -1) {
+		if _, ok := products[m[1]]; !ok {
+			products[m[1]] = m[2]
+		}
+		if first == "" && m[1] != "Mozilla" {
+			first = m[1]
+		}
+	}
+
+	c := make(map[string]interface{})
+	for _, b := range uaBrowsers {
+		if version, ok := products[b.token]; ok {
+			c["browser"], c["browser_version"] = b.name, version
+			break
+		}
+	}
+	if _, ok := c["browser"]; !ok {
+		if m := uaMSIE.FindStringSubmatch(s); m != nil {
+			c["browser"], c["browser_version"] = "Internet Explorer", m[1]+m[2]
+		} else if version, ok := products["Version"]; ok && products["Safari"] != "" {
+			c["browser"], c["browser_version"] = "Safari", version
+		} else if first != "" {
+			c["browser"], c["browser_version"] = first, products[first]
+		}
+	}
+
+	for _, os := range uaOperatingSystems {
+		if m := os.pattern.FindStringSubmatch(s); m != nil {
+			c["os"] = os.name
+			version := strings.Replace(m[1], "_", ".", -1)
+			if os.name == "Windows" {
+				if v, ok := uaWindowsVersions[version]; ok {
+					version = v
+				}
+			}
+			if version != "" {
+				c["os_version"] = version
+			}
+			break
+		}
+	}
+
+	switch {
+	case uaBot.MatchString(s):
+		c["device"] = "bot"
+	case uaTablet.MatchString(s) || strings.Contains(s, "Android") && !strings.Contains(s, "Mobile"):
+		c["device"] = "tablet"
+	case uaMobile.MatchString(s):
+		c["device"] = "mobile"
+	default:
+		c["device"] = "desktop"
+	}
+	return c
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+
 	"github.com/karmakaze/quicklog/web"
 )
 
 func main() {
     dbUrl := "user=postgres password=postgres host=127.0.0.1 dbname=quicklog sslmode=disable"
-	if err := web.Serve(8080, dbUrl); err != nil {
+	config := web.Config{Port: 8080, DbUrl: dbUrl}
+	if id, err := strconv.Atoi(os.Getenv("QUICKLOG_TRACE_PROJECT_ID")); err == nil {
+		config.TraceProjectId = int32(id)
+	}
+	config.IngestLogDir = os.Getenv("QUICKLOG_INGEST_LOG_DIR")
+	config.GeoIPDatabase = os.Getenv("QUICKLOG_GEOIP_DATABASE")
+	if err := web.Serve(config); err != nil {
 		fmt.Println(err.Error())
 	}
 }
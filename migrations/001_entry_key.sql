@@ -0,0 +1,11 @@
+-- idempotency keys for POST /entries (Idempotency-Key header or event_id)
+CREATE TABLE entry_key (
+  project_id integer     NOT NULL,
+  key        varchar     NOT NULL,
+  seq        bigint      NOT NULL,
+  created    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, key)
+);
+
+CREATE INDEX entry_key_created_idx ON entry_key (created);
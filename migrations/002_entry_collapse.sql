@@ -0,0 +1,15 @@
+-- per-project config documents (e.g. the 'dedup' repeat-collapsing policy)
+CREATE TABLE project_config (
+  project_id integer     NOT NULL,
+  name       varchar     NOT NULL,
+  config     jsonb       NOT NULL,
+  updated    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, name)
+);
+
+-- first-seen time and last seq of entries collapsed as repeats
+ALTER TABLE entry ADD COLUMN first_published timestamptz;
+ALTER TABLE entry ADD COLUMN last_seq bigint;
+
+CREATE INDEX entry_source_idx ON entry (project_id, source, seq);
@@ -0,0 +1,3 @@
+-- context key existence (?) and containment (@>) filters
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY entry_context_idx ON entry USING gin (context);
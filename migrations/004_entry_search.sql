@@ -0,0 +1,8 @@
+-- full-text search (GET /entries?q=...), needs PostgreSQL 12 or later
+-- note: adding a stored generated column rewrites the entry table
+ALTER TABLE entry ADD COLUMN search tsvector GENERATED ALWAYS AS (
+  to_tsvector('simple', source || ' ' || type || ' ' || actor || ' ' || object || ' ' || target) ||
+  jsonb_to_tsvector('simple', coalesce(context, '{}'), '["string"]')
+) STORED;
+
+CREATE INDEX entry_search_idx ON entry USING gin (search);
@@ -0,0 +1,3 @@
+-- entity timelines (GET /entities/{kind:id}/timeline) by actor
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY entry_actor_idx ON entry (project_id, actor, seq);
@@ -0,0 +1,20 @@
+-- service map (GET /service-map) aggregated per minute
+CREATE TABLE service_edge (
+  project_id     integer     NOT NULL,
+  minute         timestamptz NOT NULL,
+  from_source    varchar     NOT NULL,
+  to_source      varchar     NOT NULL,
+  calls          bigint      NOT NULL,
+  status_calls   bigint      NOT NULL,
+  errors         bigint      NOT NULL,
+  duration_calls bigint      NOT NULL,
+  histogram      bigint[]    NOT NULL,
+
+  PRIMARY KEY (project_id, minute, from_source, to_source)
+);
+
+CREATE TABLE service_map_state (
+  project_id  integer NOT NULL PRIMARY KEY,
+  seq         bigint  NOT NULL,
+  pending_seq bigint  NOT NULL
+);
@@ -0,0 +1,19 @@
+-- alert rule state (rules are the 'alert_rules' project config)
+CREATE TABLE alert_state (
+  project_id integer     NOT NULL,
+  rule       varchar     NOT NULL,
+  created    timestamptz NOT NULL,
+  seq        bigint      NOT NULL,
+  fired      timestamptz,
+
+  PRIMARY KEY (project_id, rule)
+);
+
+-- values seen by new_value rules
+CREATE TABLE alert_value (
+  project_id integer NOT NULL,
+  rule       varchar NOT NULL,
+  value      varchar NOT NULL,
+
+  PRIMARY KEY (project_id, rule, value)
+);
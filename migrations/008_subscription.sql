@@ -0,0 +1,29 @@
+-- outbound subscriptions (POST /projects/{id}/subscriptions) and their deliveries
+CREATE TABLE subscription (
+  id          bigserial   PRIMARY KEY,
+  project_id  integer     NOT NULL,
+  filter      varchar     NOT NULL,
+  url         varchar     NOT NULL,
+  secret      varchar     NOT NULL,
+  created     timestamptz NOT NULL,
+  seq         bigint      NOT NULL,
+  pending_seq bigint      NOT NULL
+);
+
+CREATE INDEX subscription_project_idx ON subscription (project_id);
+
+CREATE TABLE delivery (
+  id              bigserial   PRIMARY KEY,
+  subscription_id bigint      NOT NULL,
+  seq             bigint      NOT NULL,
+  status          varchar     NOT NULL,
+  attempts        integer     NOT NULL,
+  next_attempt    timestamptz,
+  last_attempt    timestamptz,
+  response_status integer,
+  error           varchar,
+  created         timestamptz NOT NULL
+);
+
+CREATE INDEX delivery_subscription_idx ON delivery (subscription_id, id);
+CREATE INDEX delivery_pending_idx ON delivery (next_attempt, id) WHERE status = 'pending';
@@ -0,0 +1,6 @@
+-- asynchronous ingest (QUICKLOG_INGEST_LOG_DIR): the log position written up to, per log
+CREATE TABLE ingest_checkpoint (
+  log_id   varchar NOT NULL PRIMARY KEY,
+  segment  bigint  NOT NULL,
+  "offset" bigint  NOT NULL
+);
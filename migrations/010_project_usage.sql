@@ -0,0 +1,10 @@
+-- per-project ingest usage (GET /projects/{id}/usage) per UTC day
+CREATE TABLE project_usage (
+  project_id integer NOT NULL,
+  day        date    NOT NULL,
+  events     bigint  NOT NULL,
+  bytes      bigint  NOT NULL,
+  rejected   bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, day)
+);
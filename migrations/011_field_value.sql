@@ -0,0 +1,17 @@
+-- distinct entry field values per UTC day (GET /fields/{field}/values)
+CREATE TABLE field_value (
+  project_id integer     NOT NULL,
+  field      varchar     NOT NULL,
+  value      varchar     NOT NULL,
+  day        date        NOT NULL,
+  count      bigint      NOT NULL,
+  last_seen  timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, field, value, day)
+);
+
+CREATE TABLE field_value_state (
+  project_id  integer NOT NULL PRIMARY KEY,
+  seq         bigint  NOT NULL,
+  pending_seq bigint  NOT NULL
+);
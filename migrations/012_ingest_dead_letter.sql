@@ -0,0 +1,9 @@
+-- asynchronous ingest: entries that couldn't be written due to their data
+CREATE TABLE ingest_dead_letter (
+  id         bigserial   NOT NULL PRIMARY KEY,
+  log_id     varchar     NOT NULL,
+  project_id integer     NOT NULL,
+  created    timestamptz NOT NULL,
+  error      varchar     NOT NULL,
+  entry      text        NOT NULL
+);
@@ -0,0 +1,3 @@
+-- alert rule windows (count_above, absent) by published time
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY entry_published_idx ON entry (project_id, published);
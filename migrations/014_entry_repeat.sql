@@ -0,0 +1,26 @@
+-- repeats collapsed into existing entries, so that the service map counts repeats of
+-- entries it already aggregated, and children deferred until their parent arrives
+CREATE TABLE entry_repeat (
+  id             bigserial   NOT NULL PRIMARY KEY,
+  project_id     integer     NOT NULL,
+  seq            bigint      NOT NULL,
+  published      timestamptz NOT NULL,
+  repeats        integer     NOT NULL,
+  parent_span_id varchar
+);
+
+CREATE INDEX entry_repeat_seq_idx ON entry_repeat (project_id, seq);
+CREATE INDEX entry_repeat_published_idx ON entry_repeat (project_id, published);
+
+ALTER TABLE service_map_state
+  ADD COLUMN repeat_id         bigint NOT NULL DEFAULT 0,
+  ADD COLUMN pending_repeat_id bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE service_edge_deferred (
+  project_id integer     NOT NULL,
+  seq        bigint      NOT NULL,
+  repeat_id  bigint      NOT NULL,
+  created    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, seq, repeat_id)
+);
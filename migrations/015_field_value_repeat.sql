@@ -0,0 +1,6 @@
+-- field values count the repeats collapsed into entries they already counted
+ALTER TABLE field_value_state
+  ADD COLUMN repeat_id         bigint NOT NULL DEFAULT 0,
+  ADD COLUMN pending_repeat_id bigint NOT NULL DEFAULT 0;
+
+CREATE INDEX entry_repeat_id_idx ON entry_repeat (project_id, id);
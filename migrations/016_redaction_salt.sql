@@ -0,0 +1,7 @@
+-- redaction salts are kept apart from the rules so that they aren't served with them
+INSERT INTO project_config (project_id, name, config, updated)
+  SELECT project_id, 'redaction_salt', config -> 'salt', updated FROM project_config
+  WHERE name = 'redaction' AND config ? 'salt'
+  ON CONFLICT (project_id, name) DO NOTHING;
+
+UPDATE project_config SET config = config - 'salt' WHERE name = 'redaction';
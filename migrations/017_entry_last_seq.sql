@@ -0,0 +1,3 @@
+-- last_seq of a collapsed entry is now the project's max seq when it was last repeated,
+-- rather than a seq taken for the repeat (which no entry has)
+ALTER TABLE entry ADD COLUMN IF NOT EXISTS last_seq bigint;
@@ -0,0 +1,37 @@
+-- tag key and value stats (GET /tags/keys and GET /tags/keys/{key}/values) counted from the new tags in the
+-- background rather than scanned: tags get an id to count them from, and the existing ones are counted here
+ALTER TABLE span_tag ADD COLUMN id bigint;
+CREATE SEQUENCE span_tag_id_seq OWNED BY span_tag.id;
+ALTER TABLE span_tag ALTER COLUMN id SET DEFAULT nextval('span_tag_id_seq');
+
+CREATE TABLE span_tag_key (
+  project_id  integer NOT NULL,
+  key         varchar NOT NULL,
+  tags        bigint  NOT NULL,
+  cardinality bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, key)
+);
+
+CREATE TABLE span_tag_value (
+  project_id integer NOT NULL,
+  key        varchar NOT NULL,
+  value      varchar NOT NULL,
+  spans      bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, key, value)
+);
+
+CREATE INDEX span_tag_value_spans_idx ON span_tag_value (project_id, key, spans DESC, value);
+CREATE INDEX span_tag_value_prefix_idx ON span_tag_value (project_id, key, value varchar_pattern_ops);
+
+CREATE TABLE span_tag_state (
+  project_id integer NOT NULL PRIMARY KEY,
+  id         bigint  NOT NULL,
+  pending_id bigint  NOT NULL
+);
+
+INSERT INTO span_tag_value (project_id, key, value, spans)
+  SELECT project_id, key, value, count(*) FROM span_tag WHERE id IS NULL GROUP BY project_id, key, value;
+INSERT INTO span_tag_key (project_id, key, tags, cardinality)
+  SELECT project_id, key, sum(spans), count(*) FROM span_tag_value GROUP BY project_id, key;
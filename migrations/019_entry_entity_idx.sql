@@ -0,0 +1,9 @@
+-- entities (GET /entities) and their timelines by object and target, like entry_actor_idx
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY entry_object_seq_idx ON entry (project_id, object, seq);
+CREATE INDEX CONCURRENTLY entry_target_seq_idx ON entry (project_id, target, seq);
+
+DROP INDEX CONCURRENTLY entry_object_idx;
+DROP INDEX CONCURRENTLY entry_target_idx;
+ALTER INDEX entry_object_seq_idx RENAME TO entry_object_idx;
+ALTER INDEX entry_target_seq_idx RENAME TO entry_target_idx;
@@ -0,0 +1,3 @@
+-- new tags by id, counted into span_tag_key and span_tag_value
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY span_tag_id_idx ON span_tag (project_id, id);
@@ -0,0 +1,13 @@
+-- entities of a kind (GET /entities) by the 'kind:' prefix of actor, object and target: varchar_pattern_ops
+-- indexes serve LIKE prefixes whatever the collation, as well as the lookups by value ordered by seq
+-- CREATE INDEX CONCURRENTLY can't run in a transaction: run this file outside of one (e.g. psql without -1)
+CREATE INDEX CONCURRENTLY entry_actor_prefix_idx ON entry (project_id, actor varchar_pattern_ops, seq);
+CREATE INDEX CONCURRENTLY entry_object_prefix_idx ON entry (project_id, object varchar_pattern_ops, seq);
+CREATE INDEX CONCURRENTLY entry_target_prefix_idx ON entry (project_id, target varchar_pattern_ops, seq);
+
+DROP INDEX CONCURRENTLY entry_actor_idx;
+DROP INDEX CONCURRENTLY entry_object_idx;
+DROP INDEX CONCURRENTLY entry_target_idx;
+ALTER INDEX entry_actor_prefix_idx RENAME TO entry_actor_idx;
+ALTER INDEX entry_object_prefix_idx RENAME TO entry_object_idx;
+ALTER INDEX entry_target_prefix_idx RENAME TO entry_target_idx;
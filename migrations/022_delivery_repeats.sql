@@ -0,0 +1,10 @@
+-- subscriptions get deliveries of the repeats collapsed into matching entries, from the latest repeat on
+ALTER TABLE subscription
+  ADD COLUMN repeat_id         bigint NOT NULL DEFAULT 0,
+  ADD COLUMN pending_repeat_id bigint NOT NULL DEFAULT 0;
+
+UPDATE subscription s SET repeat_id = r.max_id, pending_repeat_id = r.max_id
+  FROM (SELECT project_id, max(id) AS max_id FROM entry_repeat GROUP BY project_id) r
+  WHERE r.project_id = s.project_id;
+
+ALTER TABLE delivery ADD COLUMN repeats integer;
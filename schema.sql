@@ -5,6 +5,15 @@ CREATE TABLE project (
 
 CREATE UNIQUE INDEX project_name_idx ON project (name);
 
+CREATE TABLE project_config (
+  project_id integer     NOT NULL,
+  name       varchar     NOT NULL,
+  config     jsonb       NOT NULL,
+  updated    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, name)
+);
+
 CREATE TABLE entry (
   project_id     integer     NOT NULL,
   seq            bigserial   NOT NULL,
@@ -15,18 +24,30 @@ CREATE TABLE entry (
   object         varchar     NOT NULL,
   target         varchar     NOT NULL,
   context        jsonb,
+  repeated       integer     NOT NULL DEFAULT 0,
+  first_published timestamptz,
+  last_seq       bigint,
   trace_id       varchar,
   parent_span_id varchar,
   span_id        varchar,
+  search         tsvector GENERATED ALWAYS AS (
+    to_tsvector('simple', source || ' ' || type || ' ' || actor || ' ' || object || ' ' || target) ||
+    jsonb_to_tsvector('simple', coalesce(context, '{}'), '["string"]')
+  ) STORED,
 
   PRIMARY KEY (project_id, seq)
 );
 
-CREATE INDEX entry_object_idx ON entry (object);
-CREATE INDEX entry_target_idx ON entry (target);
+CREATE INDEX entry_source_idx ON entry (project_id, source, seq);
+CREATE INDEX entry_actor_idx ON entry (project_id, actor varchar_pattern_ops, seq);
+CREATE INDEX entry_object_idx ON entry (project_id, object varchar_pattern_ops, seq);
+CREATE INDEX entry_target_idx ON entry (project_id, target varchar_pattern_ops, seq);
+CREATE INDEX entry_context_idx ON entry USING gin (context);
+CREATE INDEX entry_search_idx ON entry USING gin (search);
 CREATE INDEX entry_trace_id_idx ON entry (trace_id) WHERE trace_id IS NOT NULL;
 CREATE INDEX entry_parent_span_id_idx ON entry (parent_span_id) WHERE parent_span_id IS NOT NULL;
 CREATE INDEX entry_span_id_idx ON entry (span_id) WHERE span_id IS NOT NULL;
+CREATE INDEX entry_published_idx ON entry (project_id, published);
 
 CREATE TABLE span_tag (
   project_id integer NOT NULL,
@@ -34,6 +55,185 @@ CREATE TABLE span_tag (
   span_id    varchar NOT NULL,
   key        varchar NOT NULL,
   value      varchar NOT NULL,
+  id         bigserial,
 
   PRIMARY KEY (project_id, value, key, span_id)
 );
+
+CREATE INDEX span_tag_id_idx ON span_tag (project_id, id);
+
+CREATE TABLE span_tag_key (
+  project_id  integer NOT NULL,
+  key         varchar NOT NULL,
+  tags        bigint  NOT NULL,
+  cardinality bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, key)
+);
+
+CREATE TABLE span_tag_value (
+  project_id integer NOT NULL,
+  key        varchar NOT NULL,
+  value      varchar NOT NULL,
+  spans      bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, key, value)
+);
+
+CREATE INDEX span_tag_value_spans_idx ON span_tag_value (project_id, key, spans DESC, value);
+CREATE INDEX span_tag_value_prefix_idx ON span_tag_value (project_id, key, value varchar_pattern_ops);
+
+CREATE TABLE span_tag_state (
+  project_id integer NOT NULL PRIMARY KEY,
+  id         bigint  NOT NULL,
+  pending_id bigint  NOT NULL
+);
+
+CREATE TABLE entry_key (
+  project_id integer     NOT NULL,
+  key        varchar     NOT NULL,
+  seq        bigint      NOT NULL,
+  created    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, key)
+);
+
+CREATE INDEX entry_key_created_idx ON entry_key (created);
+
+CREATE TABLE service_edge (
+  project_id     integer     NOT NULL,
+  minute         timestamptz NOT NULL,
+  from_source    varchar     NOT NULL,
+  to_source      varchar     NOT NULL,
+  calls          bigint      NOT NULL,
+  status_calls   bigint      NOT NULL,
+  errors         bigint      NOT NULL,
+  duration_calls bigint      NOT NULL,
+  histogram      bigint[]    NOT NULL,
+
+  PRIMARY KEY (project_id, minute, from_source, to_source)
+);
+
+CREATE TABLE service_map_state (
+  project_id        integer NOT NULL PRIMARY KEY,
+  seq               bigint  NOT NULL,
+  pending_seq       bigint  NOT NULL,
+  repeat_id         bigint  NOT NULL DEFAULT 0,
+  pending_repeat_id bigint  NOT NULL DEFAULT 0
+);
+
+CREATE TABLE service_edge_deferred (
+  project_id integer     NOT NULL,
+  seq        bigint      NOT NULL,
+  repeat_id  bigint      NOT NULL,
+  created    timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, seq, repeat_id)
+);
+
+CREATE TABLE entry_repeat (
+  id             bigserial   NOT NULL PRIMARY KEY,
+  project_id     integer     NOT NULL,
+  seq            bigint      NOT NULL,
+  published      timestamptz NOT NULL,
+  repeats        integer     NOT NULL,
+  parent_span_id varchar
+);
+
+CREATE INDEX entry_repeat_seq_idx ON entry_repeat (project_id, seq);
+CREATE INDEX entry_repeat_published_idx ON entry_repeat (project_id, published);
+CREATE INDEX entry_repeat_id_idx ON entry_repeat (project_id, id);
+
+CREATE TABLE alert_state (
+  project_id integer     NOT NULL,
+  rule       varchar     NOT NULL,
+  created    timestamptz NOT NULL,
+  seq        bigint      NOT NULL,
+  fired      timestamptz,
+
+  PRIMARY KEY (project_id, rule)
+);
+
+CREATE TABLE alert_value (
+  project_id integer NOT NULL,
+  rule       varchar NOT NULL,
+  value      varchar NOT NULL,
+
+  PRIMARY KEY (project_id, rule, value)
+);
+
+CREATE TABLE subscription (
+  id                bigserial   PRIMARY KEY,
+  project_id        integer     NOT NULL,
+  filter            varchar     NOT NULL,
+  url               varchar     NOT NULL,
+  secret            varchar     NOT NULL,
+  created           timestamptz NOT NULL,
+  seq               bigint      NOT NULL,
+  pending_seq       bigint      NOT NULL,
+  repeat_id         bigint      NOT NULL DEFAULT 0,
+  pending_repeat_id bigint      NOT NULL DEFAULT 0
+);
+
+CREATE INDEX subscription_project_idx ON subscription (project_id);
+
+CREATE TABLE delivery (
+  id              bigserial   PRIMARY KEY,
+  subscription_id bigint      NOT NULL,
+  seq             bigint      NOT NULL,
+  repeats         integer,
+  status          varchar     NOT NULL,
+  attempts        integer     NOT NULL,
+  next_attempt    timestamptz,
+  last_attempt    timestamptz,
+  response_status integer,
+  error           varchar,
+  created         timestamptz NOT NULL
+);
+
+CREATE INDEX delivery_subscription_idx ON delivery (subscription_id, id);
+CREATE INDEX delivery_pending_idx ON delivery (next_attempt, id) WHERE status = 'pending';
+
+CREATE TABLE ingest_checkpoint (
+  log_id   varchar NOT NULL PRIMARY KEY,
+  segment  bigint  NOT NULL,
+  "offset" bigint  NOT NULL
+);
+
+CREATE TABLE project_usage (
+  project_id integer NOT NULL,
+  day        date    NOT NULL,
+  events     bigint  NOT NULL,
+  bytes      bigint  NOT NULL,
+  rejected   bigint  NOT NULL,
+
+  PRIMARY KEY (project_id, day)
+);
+
+CREATE TABLE field_value (
+  project_id integer     NOT NULL,
+  field      varchar     NOT NULL,
+  value      varchar     NOT NULL,
+  day        date        NOT NULL,
+  count      bigint      NOT NULL,
+  last_seen  timestamptz NOT NULL,
+
+  PRIMARY KEY (project_id, field, value, day)
+);
+
+CREATE TABLE field_value_state (
+  project_id        integer NOT NULL PRIMARY KEY,
+  seq               bigint  NOT NULL,
+  pending_seq       bigint  NOT NULL,
+  repeat_id         bigint  NOT NULL DEFAULT 0,
+  pending_repeat_id bigint  NOT NULL DEFAULT 0
+);
+
+CREATE TABLE ingest_dead_letter (
+  id         bigserial   NOT NULL PRIMARY KEY,
+  log_id     varchar     NOT NULL,
+  project_id integer     NOT NULL,
+  created    timestamptz NOT NULL,
+  error      varchar     NOT NULL,
+  entry      text        NOT NULL
+);
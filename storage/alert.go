@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage/query"
+	"github.com/lib/pq"
+)
+
+const AlertRulesConfig = "alert_rules"
+
+const (
+	AlertCountAbove = "count_above"
+	AlertAbsent     = "absent"
+	AlertNewValue   = "new_value"
+)
+
+const (
+	AlertFormatJSON  = "json"
+	AlertFormatSlack = "slack"
+)
+
+// Fired alerts are recorded as entries with this source and type, which rules
+// never match so that alerts can't trigger each other.
+const (
+	AlertSource = "quicklog"
+	AlertType   = "alert"
+)
+
+// maxAlertValues is the most new values listed in one alert.
+const maxAlertValues = 20
+
+// AlertRule fires when the entries selected by Filter (in the query language of
+// the storage/query package, all entries if empty) meet the Condition:
+//   - count_above: more than Threshold entries (including repeats) in the last WindowSeconds
+//   - absent: no entries in the last WindowSeconds
+//   - new_value: an entry has a Field value (source, type, actor, object, target or
+//     context.<path>) not seen before by the rule
+//
+// count_above and absent rules don't fire again for CooldownSeconds (by default
+// WindowSeconds). A new_value rule fires once for each new value.
+type AlertRule struct {
+	Name            string       `json:"name"`
+	Filter          string       `json:"filter"`
+	Condition       string       `json:"condition"`
+	Threshold       int64        `json:"threshold"`
+	WindowSeconds   int32        `json:"window_seconds"`
+	Field           string       `json:"field"`
+	CooldownSeconds int32        `json:"cooldown_seconds"`
+	Webhook         AlertWebhook `json:"webhook"`
+}
+
+// AlertWebhook is where fired alerts are POSTed, as an Alert or (Format "slack")
+// a Slack incoming webhook message. An empty URL only records the alert entry.
+type AlertWebhook struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+}
+
+type AlertRules struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+var alertFields = []string{"source", "type", "actor", "object", "target"}
+
+func (r *AlertRules) Validate() error {
+	names := make(map[string]bool)
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("'name' is required")
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule '%s' is defined more than once", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if _, err := query.Parse(rule.Filter); err != nil {
+			return fmt.Errorf("rule '%s' 'filter': %v", rule.Name, err)
+		}
+
+		switch rule.Condition {
+		case AlertCountAbove, AlertAbsent:
+			if rule.WindowSeconds <= 0 {
+				return fmt.Errorf("rule '%s' 'window_seconds' must be positive", rule.Name)
+			}
+			if rule.Threshold < 0 {
+				return fmt.Errorf("rule '%s' 'threshold' must not be negative", rule.Name)
+			}
+		case AlertNewValue:
+			if _, ok := alertFieldExpression(rule.Field); !ok {
+				return fmt.Errorf("rule '%s' 'field' must be one of %s or context.<path>",
+					rule.Name, strings.Join(alertFields, ", "))
+			}
+		default:
+			return fmt.Errorf("rule '%s' 'condition' must be one of '%s', '%s', or '%s'",
+				rule.Name, AlertCountAbove, AlertAbsent, AlertNewValue)
+		}
+		if rule.CooldownSeconds < 0 {
+			return fmt.Errorf("rule '%s' 'cooldown_seconds' must not be negative", rule.Name)
+		}
+
+		if rule.Webhook.URL != "" {
+			u, err := url.Parse(rule.Webhook.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("rule '%s' webhook 'url' must be an http or https URL", rule.Name)
+			}
+		}
+		switch rule.Webhook.Format {
+		case "":
+			rule.Webhook.Format = AlertFormatJSON
+		case AlertFormatJSON, AlertFormatSlack:
+		default:
+			return fmt.Errorf("rule '%s' webhook 'format' must be '%s' or '%s'",
+				rule.Name, AlertFormatJSON, AlertFormatSlack)
+		}
+	}
+	return nil
+}
+
+// alertFieldExpression returns the SQL expression of the field on entry alias 'e'.
+func alertFieldExpression(field string) (string, bool) {
+	for _, f := range alertFields {
+		if field == f {
+			return "e." + f, true
+		}
+	}
+	if path := strings.TrimPrefix(field, "context."); path != field && indexedKeyPattern.MatchString(path) {
+		return IndexedKey{Key: path, Type: IndexText}.expression("e.context"), true
+	}
+	return "", false
+}
+
+// Alert is a fired alert. Seq is that of the entry recording it.
+type Alert struct {
+	ProjectId     int32        `json:"project_id"`
+	Seq           int64        `json:"seq"`
+	Fired         time.Time    `json:"fired"`
+	Rule          string       `json:"rule"`
+	Condition     string       `json:"condition"`
+	Filter        string       `json:"filter"`
+	Message       string       `json:"message"`
+	Count         int64        `json:"count"`
+	Threshold     int64        `json:"threshold,omitempty"`
+	WindowSeconds int32        `json:"window_seconds,omitempty"`
+	Field         string       `json:"field,omitempty"`
+	Values        []string     `json:"values,omitempty"`
+	Webhook       AlertWebhook `json:"-"`
+}
+
+func GetAlertRules(projectId int32, db queryRower, ctx context.Context) (AlertRules, error) {
+	var rules AlertRules
+	_, err := GetProjectConfig(projectId, AlertRulesConfig, &rules, db, ctx)
+	return rules, err
+}
+
+// EvaluateAlertRules evaluates the alert rules of each project, records the
+// alerts that fire as entries and returns them to be sent. A project or rule that
+// fails is logged and skipped so that it doesn't hold up the others.
+func EvaluateAlertRules(db *sql.DB, ctx context.Context) ([]Alert, error) {
+	projects := make([]Project, 0)
+	if err := ListProjects("", "", &projects, db, ctx); err != nil {
+		return nil, err
+	}
+
+	alerts := make([]Alert, 0)
+	for _, p := range projects {
+		rules, err := GetAlertRules(p.Id, db, ctx)
+		if err == nil {
+			err = deleteAlertStates(p.Id, rules, db, ctx)
+		}
+		if err != nil {
+			log.Printf("Error evaluating alert rules of project %d: %v\n", p.Id, err)
+			continue
+		}
+		for _, rule := range rules.Rules {
+			alert, err := evaluateAlertRule(p.Id, rule, time.Now(), db, ctx)
+			if err != nil {
+				log.Printf("Error evaluating alert rule '%s' of project %d: %v\n", rule.Name, p.Id, err)
+				continue
+			}
+			if alert != nil {
+				alerts = append(alerts, *alert)
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// deleteAlertStates deletes the state of rules that the project no longer has.
+func deleteAlertStates(projectId int32, rules AlertRules, db *sql.DB, ctx context.Context) error {
+	names := make([]string, 0, len(rules.Rules))
+	for _, rule := range rules.Rules {
+		names = append(names, rule.Name)
+	}
+	for _, table := range []string{"alert_state", "alert_value"} {
+		query := "DELETE FROM " + table + " WHERE project_id = ? AND NOT rule = ANY(?)"
+		if _, err := execContext(db, ctx, query, projectId, pq.Array(names)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type alertState struct {
+	created time.Time
+	seq     int64
+	fired   pq.NullTime
+}
+
+func evaluateAlertRule(projectId int32, rule AlertRule, now time.Time, db *sql.DB, ctx context.Context) (*Alert, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var state alertState
+	isNew := false
+	query := `SELECT created, seq, fired FROM alert_state WHERE project_id = ? AND rule = ? FOR UPDATE`
+	err = queryRowTxContext(tx, ctx, query, projectId, rule.Name).Scan(&state.created, &state.seq, &state.fired)
+	if err == sql.ErrNoRows {
+		isNew = true
+		state.created = now
+		query = `INSERT INTO alert_state (project_id, rule, created, seq) VALUES (?, ?, ?, 0)`
+		_, err = execTxContext(tx, ctx, query, projectId, rule.Name, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := EntryFilter{ProjectId: int(projectId), SeqMin: MinInt, SeqMax: MaxInt, Search: rule.Filter}
+	if rule.Condition != AlertNewValue {
+		f.PublishedMin = now.Add(-time.Duration(rule.WindowSeconds) * time.Second)
+	}
+	where, args, err := f.where(IndexedKeys{})
+	if err != nil {
+		return nil, err
+	}
+	where += " AND NOT (e.source = ? AND e.type = ?)"
+	args = append(args, AlertSource, AlertType)
+
+	alert := Alert{ProjectId: projectId, Fired: now.UTC(), Rule: rule.Name, Condition: rule.Condition,
+		Filter: rule.Filter, Webhook: rule.Webhook}
+	window := time.Duration(rule.WindowSeconds) * time.Second
+	cooldown := time.Duration(rule.CooldownSeconds) * time.Second
+	if cooldown == 0 {
+		cooldown = window
+	}
+	coolingDown := state.fired.Valid && now.Sub(state.fired.Time) < cooldown
+
+	switch rule.Condition {
+	case AlertCountAbove, AlertAbsent:
+		query = "SELECT coalesce(sum(1 + e.repeated), 0) FROM entry e WHERE " + where
+		if err = queryRowTxContext(tx, ctx, query, args...).Scan(&alert.Count); err != nil {
+			return nil, err
+		}
+		alert.WindowSeconds = rule.WindowSeconds
+		if rule.Condition == AlertCountAbove {
+			if alert.Count <= rule.Threshold || coolingDown {
+				return nil, tx.Commit()
+			}
+			alert.Threshold = rule.Threshold
+			alert.Message = fmt.Sprintf("%s: %d entries matching '%s' in the last %s (above %d)",
+				rule.Name, alert.Count, rule.Filter, window, rule.Threshold)
+		} else {
+			// a new rule waits a whole window before the absence counts
+			if alert.Count > 0 || coolingDown || now.Sub(state.created) < window {
+				return nil, tx.Commit()
+			}
+			alert.Message = fmt.Sprintf("%s: no entries matching '%s' in the last %s", rule.Name, rule.Filter, window)
+		}
+	case AlertNewValue:
+		values, seq, err := newAlertValues(projectId, rule, state.seq, isNew, where, args, tx, ctx)
+		if err != nil {
+			return nil, err
+		}
+		query = `UPDATE alert_state SET seq = ? WHERE project_id = ? AND rule = ?`
+		if _, err = execTxContext(tx, ctx, query, seq, projectId, rule.Name); err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, tx.Commit()
+		}
+		alert.Count = int64(len(values))
+		alert.Field = rule.Field
+		if len(values) > maxAlertValues {
+			values = values[:maxAlertValues]
+		}
+		alert.Values = values
+		alert.Message = fmt.Sprintf("%s: %d new %s value(s): %s", rule.Name, alert.Count, rule.Field,
+			strings.Join(values, ", "))
+	}
+
+	c := ContextMap{"rule": rule.Name, "condition": rule.Condition, "filter": rule.Filter,
+		"message": alert.Message, "count": alert.Count}
+	if alert.WindowSeconds != 0 {
+		c["window_seconds"] = alert.WindowSeconds
+	}
+	if rule.Condition == AlertCountAbove {
+		c["threshold"] = alert.Threshold
+	}
+	if alert.Values != nil {
+		c["field"] = alert.Field
+		c["values"] = alert.Values
+	}
+	e := Entry{ProjectId: projectId, Published: now, Source: AlertSource, Type: AlertType,
+		Object: "rule:" + rule.Name, Context: c}
+	if alert.Seq, err = CreateEntry(e, tx, ctx); err != nil {
+		return nil, err
+	}
+
+	query = `UPDATE alert_state SET fired = ? WHERE project_id = ? AND rule = ?`
+	if _, err = execTxContext(tx, ctx, query, now, projectId, rule.Name); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+// newAlertValues records the field values of the entries after seq (matching where)
+// and returns those not seen before, along with the seq it got up to. The first
+// time, the values of all existing entries are recorded as seen.
+func newAlertValues(projectId int32, rule AlertRule, seq int64, isNew bool, where string, args []interface{},
+	tx *sql.Tx, ctx context.Context) ([]string, int64, error) {
+	var maxSeq sql.NullInt64
+	query := `SELECT max(seq) FROM entry WHERE project_id = ?`
+	if err := queryRowTxContext(tx, ctx, query, projectId).Scan(&maxSeq); err != nil {
+		return nil, seq, err
+	}
+	if !maxSeq.Valid || maxSeq.Int64 <= seq {
+		return nil, seq, nil
+	}
+
+	expr, _ := alertFieldExpression(rule.Field)
+	where += " AND e.seq > ? AND e.seq <= ? AND " + expr + " <> ''"
+	args = append(args, seq, maxSeq.Int64)
+
+	if isNew {
+		query = "INSERT INTO alert_value (project_id, rule, value)" +
+			" SELECT DISTINCT ?::integer, ?::varchar, " + expr + " FROM entry e WHERE " + where +
+			" ON CONFLICT DO NOTHING"
+		_, err := execTxContext(tx, ctx, query, append([]interface{}{projectId, rule.Name}, args...)...)
+		return nil, maxSeq.Int64, err
+	}
+
+	query = "SELECT " + expr + ", min(e.seq) FROM entry e WHERE " + where + " GROUP BY 1 ORDER BY 2"
+	rows, err := queryTxContext(tx, ctx, query, args...)
+	if err != nil {
+		return nil, seq, err
+	}
+	seen := make([]string, 0)
+	for rows.Next() {
+		var value string
+		var first int64
+		if err = rows.Scan(&value, &first); err != nil {
+			rows.Close()
+			return nil, seq, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		seen = append(seen, value)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, seq, err
+	}
+
+	values := make([]string, 0)
+	for _, value := range seen {
+		query = `INSERT INTO alert_value (project_id, rule, value) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`
+		result, err := execTxContext(tx, ctx, query, projectId, rule.Name, value)
+		if err != nil {
+			return nil, seq, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			values = append(values, value)
+		}
+	}
+	return values, maxSeq.Int64, nil
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	ContextExists   = "exists"
+	ContextEquals   = "equals"
+	ContextContains = "contains"
+	ContextRange    = "range"
+)
+
+// ContextFilter selects entries by their Context. Path is a nested key path.
+// Value is the string (or number) to equal, or the JSON document to contain.
+// Min and Max bound a numeric range, and are nil when unbounded.
+type ContextFilter struct {
+	Op    string
+	Path  []string
+	Value string
+	Min   *float64
+	Max   *float64
+}
+
+// ParseContextPath splits "a.b" into ["a", "b"].
+func ParseContextPath(path string) ([]string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("context path '%s' has an empty key", path)
+		}
+	}
+	return keys, nil
+}
+
+// where returns the condition on entry alias 'e'. Equality and ranges on an
+// indexed key are written to match the expression of its index.
+func (f ContextFilter) where(indexed IndexedKeys) (string, []interface{}) {
+	switch f.Op {
+	case ContextExists:
+		// the top-level key check can use the GIN index
+		return "e.context ?? ? AND e.context #> ?::text[] IS NOT NULL", []interface{}{f.Path[0], pq.Array(f.Path)}
+	case ContextContains:
+		return "e.context @> ?::jsonb", []interface{}{f.Value}
+	case ContextEquals:
+		if k, ok := indexed.find(f.Path); ok && k.Type == IndexText {
+			return k.expression("e.context") + " = ?", []interface{}{f.Value}
+		}
+		docs := []interface{}{nestedJson(f.Path, f.Value)}
+		var scalar interface{}
+		if err := json.Unmarshal([]byte(f.Value), &scalar); err == nil {
+			switch scalar.(type) {
+			case float64, bool:
+				docs = append(docs, nestedJson(f.Path, scalar))
+			}
+		}
+		if len(docs) == 1 {
+			return "e.context @> ?::jsonb", docs
+		}
+		return "(e.context @> ?::jsonb OR e.context @> ?::jsonb)", docs
+	case ContextRange:
+		expression := "(CASE WHEN jsonb_typeof(e.context #> ?::text[]) = 'number'" +
+			" THEN (e.context #>> ?::text[])::numeric END)"
+		expressionArgs := []interface{}{pq.Array(f.Path), pq.Array(f.Path)}
+		if k, ok := indexed.find(f.Path); ok && k.Type == IndexNumber {
+			expression = k.expression("e.context")
+			expressionArgs = nil
+		}
+		conds := make([]string, 0, 2)
+		args := make([]interface{}, 0, 6)
+		if f.Min != nil {
+			conds = append(conds, expression+" >= ?")
+			args = append(append(args, expressionArgs...), *f.Min)
+		}
+		if f.Max != nil {
+			conds = append(conds, expression+" <= ?")
+			args = append(append(args, expressionArgs...), *f.Max)
+		}
+		return strings.Join(conds, " AND "), args
+	}
+	return "true", nil
+}
+
+// nestedJson returns the JSON document {"a": {"b": value}} for path ["a", "b"].
+func nestedJson(path []string, value interface{}) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+	doc, _ := json.Marshal(value)
+	return string(doc)
+}
+
+const IndexedKeysConfig = "indexed_keys"
+
+const (
+	IndexText   = "text"
+	IndexNumber = "number"
+)
+
+// IndexedKey is a context key path (e.g. "file.name") that the server keeps
+// an index on for the project, for text equality or numeric ranges.
+type IndexedKey struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+type IndexedKeys struct {
+	Keys []IndexedKey `json:"keys"`
+}
+
+var indexedKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+const maxIndexedKeys = 20
+
+func (k *IndexedKeys) Validate() error {
+	if len(k.Keys) > maxIndexedKeys {
+		return fmt.Errorf("at most %d context keys can be indexed", maxIndexedKeys)
+	}
+	for i, key := range k.Keys {
+		if !indexedKeyPattern.MatchString(key.Key) {
+			return fmt.Errorf("'%s' must be a context key path of letters, digits, '_' or '-' separated by '.'", key.Key)
+		}
+		switch key.Type {
+		case "":
+			k.Keys[i].Type = IndexText
+		case IndexText, IndexNumber:
+		default:
+			return fmt.Errorf("'type' must be '%s' or '%s'", IndexText, IndexNumber)
+		}
+	}
+	return nil
+}
+
+func (k IndexedKeys) find(path []string) (IndexedKey, bool) {
+	key := strings.Join(path, ".")
+	for _, indexed := range k.Keys {
+		if indexed.Key == key {
+			return indexed, true
+		}
+	}
+	return IndexedKey{}, false
+}
+
+// expression is the indexed expression on the context column. Keys are validated
+// to be safe in the literal path.
+func (k IndexedKey) expression(column string) string {
+	path := "'{" + strings.Replace(k.Key, ".", ",", -1) + "}'"
+	if k.Type == IndexNumber {
+		return "(CASE WHEN jsonb_typeof(" + column + " #> " + path + ") = 'number'" +
+			" THEN (" + column + " #>> " + path + ")::numeric END)"
+	}
+	return "(" + column + " #>> " + path + ")"
+}
+
+func (k IndexedKey) indexName(projectId int32) string {
+	h := fnv.New32a()
+	h.Write([]byte(k.Type + ":" + k.Key))
+	return fmt.Sprintf("entry_ctx_%d_%08x", projectId, h.Sum32())
+}
+
+func GetIndexedKeys(projectId int32, db queryRower, ctx context.Context) (IndexedKeys, error) {
+	var keys IndexedKeys
+	_, err := GetProjectConfig(projectId, IndexedKeysConfig, &keys, db, ctx)
+	return keys, err
+}
+
+// SyncContextIndexes creates the missing partial indexes for the project's
+// indexed keys and drops those no longer configured. Indexes are built
+// concurrently so this can take a while on a large entry table.
+func SyncContextIndexes(projectId int32, keys IndexedKeys, db *sql.DB, ctx context.Context) error {
+	rows, err := queryContext(db, ctx, `SELECT indexname FROM pg_indexes WHERE tablename = 'entry' AND indexname LIKE ?`,
+		fmt.Sprintf("entry\\_ctx\\_%d\\_%%", projectId))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+
+	for _, k := range keys.Keys {
+		name := k.indexName(projectId)
+		if existing[name] {
+			delete(existing, name)
+			continue
+		}
+		log.Printf("Creating index %s on context key '%s' for project %d\n", name, k.Key, projectId)
+		query := "CREATE INDEX CONCURRENTLY IF NOT EXISTS " + name + " ON entry (" + k.expression("context") + ", seq)" +
+			" WHERE project_id = " + strconv.Itoa(int(projectId))
+		if _, err = db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	for name := range existing {
+		log.Printf("Dropping index %s for project %d\n", name, projectId)
+		if _, err = db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
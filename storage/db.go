@@ -6,7 +6,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	_ "github.com/lib/pq"
+
+	"github.com/lib/pq"
 )
 
 const (
@@ -21,9 +22,25 @@ func OpenDB(dbUrl string) (*sql.DB, error) {
 }
 
 func IsUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" // unique_violation
+}
+
+// IsDataError returns whether the error is due to the data written, such as a NUL
+// character in a text value or a value too large to index, so retrying won't help.
+// A unique violation isn't, as it can be from a concurrent write.
+func IsDataError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code == "23505" {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	case "22", // data_exception
+		"23", // integrity_constraint_violation
+		"54": // program_limit_exceeded
+		return true
+	}
 	return false
-	// pqErr, ok := err.(*pq.Error)
-	// return ok && pqErr.Code == "23505" // unique_violation
 }
 
 func Ternary(cond bool, a, b string) string {
@@ -67,14 +84,25 @@ func queryTxContext(tx *sql.Tx, ctx context.Context, query string, args ...inter
     return tx.QueryContext(ctx, numberArgs(query), args...)
 }
 
+func queryRowTxContext(tx *sql.Tx, ctx context.Context, query string, args ...interface{}) *sql.Row {
+    return tx.QueryRowContext(ctx, numberArgs(query), args...)
+}
+
+// numberArgs replaces '?' placeholders with '$1', '$2', ... for lib/pq.
+// A jsonb '?' operator is written as '??'.
 func numberArgs(query string) string {
+    var b strings.Builder
     num := 1
-    for {
-        if i := strings.Index(query, "?"); i == -1 {
-            return query
+    for i := 0; i < len(query); i++ {
+        if query[i] != '?' {
+            b.WriteByte(query[i])
+        } else if i+1 < len(query) && query[i+1] == '?' {
+            b.WriteByte('?')
+            i++
         } else {
-            query = query[0:i] + "$" + strconv.Itoa(num) + query[i+1:]
+            b.WriteString("$" + strconv.Itoa(num))
             num += 1
         }
     }
+    return b.String()
 }
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const DedupConfig = "dedup"
+
+const (
+	DedupScopeProject = "project"
+	DedupScopeSource  = "source"
+	DedupScopeActor   = "actor"
+)
+
+var dedupFields = []string{"source", "type", "actor", "object", "target", "context"}
+
+// DedupPolicy controls how a new entry is collapsed into a repeat of a previous one.
+// The candidate is the latest entry within the scope (same source, same actor, or
+// anywhere in the project) which must match on Fields (all by default), ignoring
+// IgnoreContextKeys, be last seen within WindowSeconds and not yet repeated MaxRepeat times.
+// Zero WindowSeconds or MaxRepeat mean unlimited.
+type DedupPolicy struct {
+	Scope             string   `json:"scope"`
+	Fields            []string `json:"fields"`
+	IgnoreContextKeys []string `json:"ignore_context_keys"`
+	WindowSeconds     int32    `json:"window_seconds"`
+	MaxRepeat         int32    `json:"max_repeat"`
+}
+
+func (p DedupPolicy) Validate() error {
+	switch p.Scope {
+	case DedupScopeProject, DedupScopeSource, DedupScopeActor:
+	default:
+		return fmt.Errorf("'scope' must be one of '%s', '%s', or '%s'",
+			DedupScopeProject, DedupScopeSource, DedupScopeActor)
+	}
+	for _, field := range p.Fields {
+		found := false
+		for _, f := range dedupFields {
+			found = found || f == field
+		}
+		if !found {
+			return fmt.Errorf("'fields' has unknown field '%s'", field)
+		}
+	}
+	if p.WindowSeconds < 0 {
+		return fmt.Errorf("'window_seconds' must not be negative")
+	}
+	if p.MaxRepeat < 0 {
+		return fmt.Errorf("'max_repeat' must not be negative")
+	}
+	return nil
+}
+
+func (p DedupPolicy) matches(e, last Entry) bool {
+	if p.WindowSeconds > 0 && e.Published.Sub(last.Published) > time.Duration(p.WindowSeconds)*time.Second {
+		return false
+	}
+	if p.MaxRepeat > 0 && last.Repeated >= p.MaxRepeat {
+		return false
+	}
+
+	fields := p.Fields
+	if len(fields) == 0 {
+		fields = dedupFields
+	}
+	for _, field := range fields {
+		switch field {
+		case "source":
+			if e.Source != last.Source {
+				return false
+			}
+		case "type":
+			if e.Type != last.Type {
+				return false
+			}
+		case "actor":
+			if e.Actor != last.Actor {
+				return false
+			}
+		case "object":
+			if e.Object != last.Object {
+				return false
+			}
+		case "target":
+			if e.Target != last.Target {
+				return false
+			}
+		case "context":
+			if !reflect.DeepEqual(withoutKeys(e.Context, p.IgnoreContextKeys),
+				withoutKeys(last.Context, p.IgnoreContextKeys)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func withoutKeys(c ContextMap, keys []string) ContextMap {
+	if len(keys) == 0 || c == nil {
+		return c
+	}
+	m := make(ContextMap, len(c))
+	for k, v := range c {
+		m[k] = v
+	}
+	for _, k := range keys {
+		delete(m, k)
+	}
+	return m
+}
+
+func GetDedupPolicy(projectId int32, db queryRower, ctx context.Context) (*DedupPolicy, error) {
+	var p DedupPolicy
+	if ok, err := GetProjectConfig(projectId, DedupConfig, &p, db, ctx); !ok || err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// selectLastEntryInScope returns the latest entry in the policy scope, or nil if there is none.
+func selectLastEntryInScope(e Entry, p DedupPolicy, tx *sql.Tx, ctx context.Context) (*Entry, error) {
+	query := "SELECT " + entryCols + " FROM entry WHERE project_id = ?"
+	args := []interface{}{e.ProjectId}
+	switch p.Scope {
+	case DedupScopeSource:
+		query += " AND source = ?"
+		args = append(args, e.Source)
+	case DedupScopeActor:
+		query += " AND actor = ?"
+		args = append(args, e.Actor)
+	}
+	query += " ORDER BY seq DESC LIMIT 1"
+
+	rows, err := queryTxContext(tx, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := resultEntries(rows)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// collapseEntry records e as a repeat of last, extending its last-seen time and
+// seq range.
+func collapseEntry(e, last Entry, tx *sql.Tx, ctx context.Context) error {
+	query := "UPDATE entry SET published = ?, repeated = repeated + 1," +
+		" first_published = COALESCE(first_published, published), last_seq = " + collapsedLastSeq + "," +
+		" trace_id = ?, parent_span_id = ?, span_id = ?" +
+		" WHERE project_id = ? AND seq = ?"
+	_, err := execTxContext(tx, ctx, query, e.Published, StringToNullable(e.TraceId),
+		StringToNullable(e.ParentSpanId), StringToNullable(e.SpanId), last.ProjectId, last.Seq)
+	if err != nil {
+		return err
+	}
+	return logRepeats(last.ProjectId, last.Seq, e.Published, 1, e.ParentSpanId, tx, ctx)
+}
+
+// collapsedLastSeq is the last_seq of an entry when it's repeated: the project's
+// latest seq, so that the entry's range covers the entries it was repeated among,
+// without taking a seq of its own for the repeat.
+const collapsedLastSeq = "(SELECT max(p.seq) FROM entry p WHERE p.project_id = entry.project_id)"
+
+// logRepeats records repeats collapsed into the entry with seq, so that aggregates
+// count repeats of an entry they already aggregated. An entry's repeated count less
+// its logged repeats are the ones it was created with (or collapsed before logging).
+func logRepeats(projectId int32, seq int64, published time.Time, repeats int32, parentSpanId string,
+	tx *sql.Tx, ctx context.Context) error {
+	query := `INSERT INTO entry_repeat (project_id, seq, published, repeats, parent_span_id) VALUES (?, ?, ?, ?, ?)`
+	_, err := execTxContext(tx, ctx, query, projectId, seq, published, repeats, StringToNullable(parentSpanId))
+	return err
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Entities are the 'kind:id' values (e.g. user:1234, img:45512) of entry actors,
+// objects and targets.
+
+var EntityRoles = []string{"actor", "object", "target"}
+
+// EntityEntry is an entry with the roles that the entity has in it.
+type EntityEntry struct {
+	Entry
+	Roles []string `json:"roles"`
+}
+
+// Entity is a recently active entity with the number of its entries and when it was last seen.
+type Entity struct {
+	Entity   string    `json:"entity"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+	Roles    []string  `json:"roles"`
+}
+
+// ListEntityTimeline returns up to limit of the last entries (in seq order) in
+// which the entity is the actor, object or target.
+func ListEntityTimeline(projectId int, entity string, seqMin, seqMax int, publishedMin, publishedMax time.Time,
+	limit int, db *sql.DB, ctx context.Context) ([]EntityEntry, error) {
+	parts := make([]string, 0, len(EntityRoles))
+	args := make([]interface{}, 0, 6*len(EntityRoles)+1)
+	for _, role := range EntityRoles {
+		query := "(SELECT " + entryColsE + ", '" + role + "' AS role FROM entry e" +
+			" WHERE e.project_id = ? AND e." + role + " = ?"
+		args = append(args, projectId, entity)
+		if seqMin != MinInt {
+			query += " AND e.seq >= ?"
+			args = append(args, seqMin)
+		}
+		if seqMax != MaxInt {
+			query += " AND e.seq <= ?"
+			args = append(args, seqMax)
+		}
+		if !publishedMin.IsZero() {
+			query += " AND e.published >= ?"
+			args = append(args, publishedMin)
+		}
+		if !publishedMax.IsZero() {
+			query += " AND e.published <= ?"
+			args = append(args, publishedMax)
+		}
+		query += " ORDER BY e.seq DESC LIMIT ?)"
+		args = append(args, limit)
+		parts = append(parts, query)
+	}
+	query := strings.Join(parts, " UNION ALL ") + " ORDER BY seq DESC"
+
+	rows, err := queryContext(db, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// an entry appears once per role of the entity
+	entries := make([]EntityEntry, 0)
+	for rows.Next() {
+		var role string
+		e, err := scanEntry(rows, &role)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(entries); n != 0 && entries[n-1].Seq == e.Seq {
+			entries[n-1].Roles = append(entries[n-1].Roles, role)
+			continue
+		}
+		if len(entries) == limit {
+			break
+		}
+		entries = append(entries, EntityEntry{Entry: e, Roles: []string{role}})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	for i := range entries {
+		entries[i].Roles = sortedRoles(entries[i].Roles)
+	}
+	return entries, nil
+}
+
+// ListEntities returns up to limit entities of the kind (e.g. "user") most
+// recently seen since publishedMin. The 'kind:' prefix is matched with LIKE, which
+// uses the varchar_pattern_ops indexes on actor, object and target.
+func ListEntities(projectId int, kind string, publishedMin time.Time, limit int,
+	db *sql.DB, ctx context.Context) ([]Entity, error) {
+	pattern := likePrefix(kind + ":")
+
+	parts := make([]string, 0, len(EntityRoles))
+	args := make([]interface{}, 0, 3*len(EntityRoles)+1)
+	for _, role := range EntityRoles {
+		parts = append(parts, "SELECT "+role+" AS entity, '"+role+"' AS role, published FROM entry"+
+			" WHERE project_id = ? AND "+role+" LIKE ? AND published >= ?")
+		args = append(args, projectId, pattern, publishedMin)
+	}
+	query := "SELECT entity, count(*), max(published), array_agg(DISTINCT role)" +
+		" FROM (" + strings.Join(parts, " UNION ALL ") + ") entities" +
+		" GROUP BY entity ORDER BY max(published) DESC, entity LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := queryContext(db, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entities := make([]Entity, 0)
+	for rows.Next() {
+		var e Entity
+		var roles pq.StringArray
+		if err = rows.Scan(&e.Entity, &e.Count, &e.LastSeen, &roles); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		e.LastSeen = e.LastSeen.UTC()
+		e.Roles = sortedRoles(roles)
+		entities = append(entities, e)
+	}
+	return entities, rows.Err()
+}
+
+// sortedRoles returns the roles in EntityRoles order.
+func sortedRoles(roles []string) []string {
+	sorted := make([]string, 0, len(roles))
+	for _, role := range EntityRoles {
+		for _, r := range roles {
+			if r == role {
+				sorted = append(sorted, role)
+				break
+			}
+		}
+	}
+	return sorted
+}
+
+// likePrefix returns a LIKE pattern for values starting with prefix.
+func likePrefix(prefix string) string {
+	prefix = strings.Replace(prefix, `\`, `\\`, -1)
+	prefix = strings.Replace(prefix, `%`, `\%`, -1)
+	prefix = strings.Replace(prefix, `_`, `\_`, -1)
+	return prefix + "%"
+}
@@ -10,23 +10,32 @@ import (
 	"strings"
 	"time"
 
-	"github.com/karmakaze/quicklog/storage/span_tag"
+	"github.com/karmakaze/quicklog/storage/query"
+	"github.com/lib/pq"
 )
 
 type Entry struct {
-	ProjectId    int32      `json:"project_id"`
-	Seq          int64      `json:"seq"`
-	Published    time.Time  `json:"published"`
-	Source       string     `json:"source"`
-	Type         string     `json:"type"`
-	Actor        string     `json:"actor"`
-	Object       string     `json:"object"`
-	Target       string     `json:"target"`
-	Context      ContextMap `json:"context"`
-	Repeated     int32      `json:"repeated"`
-	TraceId      string     `json:"trace_id"`
-	ParentSpanId string     `json:"parent_span_id"`
-	SpanId       string     `json:"span_id"`
+	ProjectId      int32      `json:"project_id"`
+	Seq            int64      `json:"seq"`
+	Published      time.Time  `json:"published"`
+	Source         string     `json:"source"`
+	Type           string     `json:"type"`
+	Actor          string     `json:"actor"`
+	Object         string     `json:"object"`
+	Target         string     `json:"target"`
+	Context        ContextMap `json:"context"`
+	Repeated       int32      `json:"repeated"`
+	FirstPublished time.Time  `json:"first_published"`
+	LastSeq        int64      `json:"last_seq"`
+	TraceId        string     `json:"trace_id"`
+	ParentSpanId   string     `json:"parent_span_id"`
+	SpanId         string     `json:"span_id"`
+	EventId        string     `json:"event_id,omitempty"`
+	// Tags are 'key:value' (or 'value') tags of the entry's span, created with it.
+	Tags []string `json:"tags,omitempty"`
+	// Rank and Highlight are set for full-text search results.
+	Rank      float32 `json:"rank,omitempty"`
+	Highlight string  `json:"highlight,omitempty"`
 }
 
 // true if ProjectId, Source, Type, Actor, Object, Target, Context all match
@@ -37,7 +46,10 @@ func (e Entry) matches(entry Entry) bool {
 }
 
 var (
-	entryCols = "project_id, seq, published, source, type, actor, object, target, context, repeated, trace_id, parent_span_id, span_id"
+	entryCols = "project_id, seq, published, source, type, actor, object, target, context, repeated," +
+		" first_published, last_seq, trace_id, parent_span_id, span_id"
+	entryColsE = "e.project_id, e.seq, e.published, e.source, e.type, e.actor, e.object, e.target, e.context, e.repeated," +
+		" e.first_published, e.last_seq, e.trace_id, e.parent_span_id, e.span_id"
 )
 
 type ContextMap map[string]interface{}
@@ -74,244 +86,352 @@ func (c *ContextMap) Scan(src interface{}) error {
 	return nil
 }
 
-func CreateEntry(e Entry, tx *sql.Tx, ctx context.Context) error {
-	if lasts, err := selectLastEntries(e.ProjectId, 2, tx, ctx); err == nil && len(lasts) == 2 {
+// CreateEntry inserts the entry (or collapses it into a repeat of the last one)
+// and returns its seq. If the entry has an EventId that was already used within
+// the IdempotencyWindow, nothing is written and the original entry's seq is returned.
+func CreateEntry(e Entry, tx *sql.Tx, ctx context.Context) (int64, error) {
+	if e.EventId != "" {
+		if seq, err := LookupIdempotencyKey(e.ProjectId, e.EventId, tx, ctx); err != nil {
+			return 0, err
+		} else if seq != 0 {
+			return seq, nil
+		}
+	}
+
+	seq, err := createEntry(e, tx, ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err = createSpanTags([]Entry{e}, tx, ctx); err != nil {
+		return 0, err
+	}
+
+	if e.EventId != "" {
+		if err = createIdempotencyKey(e.ProjectId, e.EventId, seq, tx, ctx); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+func createEntry(e Entry, tx *sql.Tx, ctx context.Context) (int64, error) {
+	policy, err := GetDedupPolicy(e.ProjectId, tx, ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if policy != nil {
+		if last, err := selectLastEntryInScope(e, *policy, tx, ctx); err != nil {
+			return 0, err
+		} else if last != nil && policy.matches(e, *last) {
+			return last.Seq, collapseEntry(e, *last, tx, ctx)
+		}
+	} else if lasts, err := selectLastEntries(e.ProjectId, 2, tx, ctx); err == nil && len(lasts) == 2 {
 		last1 := lasts[0]
 		last2 := lasts[1]
 		if e.matches(last2) && e.matches(last1) {
-			query := "UPDATE entry SET published = ?, repeated = repeated + 1," +
-				" trace_id = ?, parent_span_id = ?, span_id = ?" +
-				" WHERE project_id = ? AND seq = ?"
-			if _, err := execTxContext(tx, ctx, query, e.Published, StringToNullable(e.TraceId),
-				StringToNullable(e.ParentSpanId), StringToNullable(e.SpanId),
-				last1.ProjectId, last1.Seq); err != nil {
-				return err
-			}
-			return nil
+			return last1.Seq, collapseEntry(e, last1, tx, ctx)
 		}
 	}
 
+	var seq int64
 	query := `INSERT INTO entry` +
 		` (project_id, published, source, type, actor, object, target, context, repeated, trace_id, parent_span_id, span_id)` +
-		` VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
-	if _, err := execTxContext(tx, ctx, query, e.ProjectId, e.Published, e.Source,
+		` VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING seq;`
+	if err := queryRowTxContext(tx, ctx, query, e.ProjectId, e.Published, e.Source,
 		e.Type, e.Actor, e.Object, e.Target, e.Context, e.Repeated, StringToNullable(e.TraceId),
-		StringToNullable(e.ParentSpanId), StringToNullable(e.SpanId)); err != nil {
-		return err
+		StringToNullable(e.ParentSpanId), StringToNullable(e.SpanId)).Scan(&seq); err != nil {
+		return 0, err
 	}
-	return nil
+	return seq, nil
 }
 
-func ListEntries(projectId int, seqMin, seqMax int, publishedMin, publishedMax time.Time,
-	traceId, spanId, search string, limit int, tx *sql.DB, ctx context.Context) ([]Entry, error) {
-	var rows *sql.Rows
+// EntryFilter selects the entries to list. SeqMin and SeqMax are MinInt and MaxInt
+// when unbounded, and zero values of the other fields don't filter.
+type EntryFilter struct {
+	ProjectId    int
+	SeqMin       int
+	SeqMax       int
+	PublishedMin time.Time
+	PublishedMax time.Time
+	TraceId      string
+	SpanId       string
+	// Search is in the query language of the storage/query package.
+	Search  string
+	Context []ContextFilter
+	// Text is a full-text search, see searchEntries.
+	Text string
+}
+
+// ListEntries returns up to limit entries in seq order. These are the first
+// entries when only a lower bound on seq or published is given, otherwise the last ones.
+// A full-text search returns the best matches first.
+func ListEntries(f EntryFilter, limit int, db *sql.DB, ctx context.Context) ([]Entry, error) {
+	where, args, err := f.whereIndexed(db, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Text != "" {
+		return searchEntries(f.Text, where, args, limit, db, ctx)
+	}
+
 	desc := true
+	if f.SeqMin != MinInt && f.SeqMax == MaxInt ||
+		f.SeqMin == MinInt && f.SeqMax == MaxInt && !f.PublishedMin.IsZero() && f.PublishedMax.IsZero() {
+		desc = false
+	}
 
-	var err error
-	fields := entryCols
+	query := "SELECT " + entryColsE + " FROM entry e WHERE " + where
+	if desc {
+		query += " ORDER BY e.seq DESC LIMIT ?"
+	} else {
+		query += " ORDER BY e.seq LIMIT ?"
+	}
+	args = append(args, limit)
 
-	traceOrSpanId := ""
-	traceOrSpanCols := ""
-	if traceId != "" {
-		traceOrSpanId = traceId
-		if spanId == traceId {
-			traceOrSpanCols = "(trace_id, parent_span_id, span_id)"
-		} else {
-			traceOrSpanCols = "(trace_id)"
-		}
-	} else if spanId != "" {
-		traceOrSpanId = spanId
-		traceOrSpanCols = "(parent_span_id, span_id)"
-	}
-
-	objectOrTarget := ""
-	objectOrTargetCol := ""
-	tag := ""
-	if strings.HasPrefix(search, "object:") {
-		objectOrTargetCol = "object"
-		objectOrTarget = search[7:]
-	} else if strings.HasPrefix(search, "target:") {
-		objectOrTargetCol = "target"
-		objectOrTarget = search[7:]
-	} else if strings.HasPrefix(search, "tag:") {
-		tag = search[4:]
-	} else if search != "" {
-		tag = search
-	}
-
-	if objectOrTarget != "" {
-		args := make([]interface{}, 0, 6)
-		args = append(args, projectId)
-		query := "SELECT " + fields + " FROM entry WHERE project_id = ?"
-		query += " AND " + objectOrTargetCol + " = ?"
-		args = append(args, objectOrTarget)
-
-		if seqMin != MinInt || seqMax != MaxInt {
-			query += " AND seq BETWEEN ? AND ?"
-			args = append(args, seqMin, seqMax)
+	rows, err := queryContext(db, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := resultEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc {
+		reverseEntries(entries)
+	}
+
+	return entries, nil
+}
+
+// whereIndexed is where using the project's indexed context keys.
+func (f EntryFilter) whereIndexed(db *sql.DB, ctx context.Context) (string, []interface{}, error) {
+	var indexed IndexedKeys
+	if len(f.Context) != 0 {
+		var err error
+		if indexed, err = GetIndexedKeys(int32(f.ProjectId), db, ctx); err != nil {
+			return "", nil, err
 		}
-		if seqMin != MinInt {
-			desc = false
-			query += " ORDER BY seq LIMIT ?"
+	}
+	return f.where(indexed)
+}
+
+// where returns the SQL condition on entry alias 'e' with '?' placeholders for args.
+func (f EntryFilter) where(indexed IndexedKeys) (string, []interface{}, error) {
+	conds := []string{"e.project_id = ?"}
+	args := []interface{}{f.ProjectId}
+
+	if f.SeqMin != MinInt {
+		conds = append(conds, "e.seq >= ?")
+		args = append(args, f.SeqMin)
+	}
+	if f.SeqMax != MaxInt {
+		conds = append(conds, "e.seq <= ?")
+		args = append(args, f.SeqMax)
+	}
+	if !f.PublishedMin.IsZero() {
+		conds = append(conds, "e.published >= ?")
+		args = append(args, f.PublishedMin)
+	}
+	if !f.PublishedMax.IsZero() {
+		conds = append(conds, "e.published <= ?")
+		args = append(args, f.PublishedMax)
+	}
+
+	if f.TraceId != "" {
+		if f.SpanId == f.TraceId {
+			conds = append(conds, "? IN (e.trace_id, e.parent_span_id, e.span_id)")
 		} else {
-			query += " ORDER BY seq DESC LIMIT ?"
+			conds = append(conds, "e.trace_id = ?")
 		}
-		args = append(args, limit)
-		rows, err = queryContext(tx, ctx, query, args...)
-	} else if tag != "" {
-		spanTags, err := span_tag.ListSpanTags(projectId, "", "", tag, tx, ctx)
+		args = append(args, f.TraceId)
+	} else if f.SpanId != "" {
+		conds = append(conds, "? IN (e.parent_span_id, e.span_id)")
+		args = append(args, f.SpanId)
+	}
+
+	if f.Search != "" {
+		node, err := query.Parse(f.Search)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-		if len(spanTags) == 0 {
-			return make([]Entry, 0), nil
+		if node != nil {
+			cond, searchArgs, err := query.SQL(node)
+			if err != nil {
+				return "", nil, err
+			}
+			conds = append(conds, cond)
+			args = append(args, searchArgs...)
 		}
+	}
 
-		traceIds := span_tag.TraceIds(spanTags)
-		spanIds := span_tag.SpanIds(spanTags)
+	for _, c := range f.Context {
+		cond, contextArgs := c.where(indexed)
+		conds = append(conds, cond)
+		args = append(args, contextArgs...)
+	}
 
-		query := "SELECT " + fields + " FROM entry e WHERE e.project_id = ?"
-		args := make([]interface{}, 0, 6)
-		args = append(args, projectId)
+	return strings.Join(conds, " AND "), args, nil
+}
 
-		if seqMin != MinInt || seqMax != MaxInt {
-			query += " AND e.seq BETWEEN ? AND ?"
-			args = append(args, seqMin, seqMax)
+// DeleteEntries deletes the project's entries published within the range (either
+// end may be zero for unbounded), with their logged repeats. What was aggregated
+// from them is deleted too, for the service map minutes and field value days wholly
+// within the range.
+func DeleteEntries(projectId int, publishedMin, publishedMax time.Time, tx *sql.Tx, ctx context.Context) error {
+	for _, table := range []string{"entry", "entry_repeat"} {
+		cond, args := publishedRange("published", publishedMin, publishedMax)
+		query := `DELETE FROM ` + table + ` WHERE project_id = ?` + cond
+		if _, err := execTxContext(tx, ctx, query, append([]interface{}{projectId}, args...)...); err != nil {
+			return err
 		}
+	}
 
-		quotedTraceIds := "'" + strings.Join(traceIds, "','") + "'"
-		quotedSpanIds := "'" + strings.Join(spanIds, "','") + "'"
-		if len(traceIds) != 0 {
-			if len(spanIds) != 0 {
-				query += " AND (trace_id IN (" + quotedTraceIds + ")"
-				query += "      OR parent_span_id IS NOT NULL AND parent_span_id IN (" + quotedSpanIds + ")"
-				query += "      OR span_id IN (" + quotedSpanIds + "))"
-			} else {
-				query += " AND trace_id IN (" + quotedTraceIds + ")"
-			}
-		} else if len(spanIds) != 0 {
-			query += " AND (parent_span_id IS NOT NULL AND parent_span_id IN (" + quotedSpanIds + ") OR span_id IN (" + quotedSpanIds + "))"
+	var minuteMin, minuteMax interface{}
+	if !publishedMin.IsZero() {
+		minute := publishedMin.Truncate(time.Minute)
+		if minute.Before(publishedMin) {
+			minute = minute.Add(time.Minute)
 		}
+		minuteMin = minute
+	}
+	if !publishedMax.IsZero() {
+		minuteMax = publishedMax.Truncate(time.Minute)
+	}
+	cond, args := aggregateRange("minute", minuteMin, minuteMax)
+	query := `DELETE FROM service_edge WHERE project_id = ?` + cond
+	if _, err := execTxContext(tx, ctx, query, append([]interface{}{projectId}, args...)...); err != nil {
+		return err
+	}
 
-		if seqMin != MinInt {
-			desc = false
-			query += " ORDER BY e.seq LIMIT ?"
-		} else {
-			query += " ORDER BY e.seq DESC LIMIT ?"
-		}
-		args = append(args, limit)
-		rows, err = queryContext(tx, ctx, query, args...)
-	} else if seqMin != MinInt && seqMax != MaxInt {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq BETWEEN ? AND ? ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMin, seqMax, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq BETWEEN ? AND ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMin, seqMax, traceOrSpanId, limit)
-		}
-	} else if seqMin != MinInt {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq >= ? ORDER BY seq LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMin, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq >= ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMin, traceOrSpanId, limit)
-		}
-		desc = false
-	} else if seqMax != MaxInt {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq <= ? ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMax, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND seq <= ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, seqMax, traceOrSpanId, limit)
-		}
-	} else if !publishedMin.IsZero() && !publishedMax.IsZero() {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published BETWEEN ? AND ? ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMin, publishedMax, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published BETWEEN ? AND ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMin, publishedMax, traceOrSpanId, limit)
-		}
-	} else if !publishedMin.IsZero() {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published >= ? ORDER BY seq LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMin, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published >= ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMin, traceOrSpanId, limit)
-		}
-		desc = false
-	} else if !publishedMax.IsZero() {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published <= ? ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMax, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND published <= ? AND ? IN ` + traceOrSpanCols + ` ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, publishedMax, traceOrSpanId, limit)
-		}
-	} else {
-		if traceOrSpanId == "" {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ? ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, limit)
-		} else {
-			query := `SELECT ` + fields + ` FROM entry WHERE project_id = ?` +
-				` AND ? IN ` + traceOrSpanCols + ` ORDER BY seq DESC LIMIT ?`
-			rows, err = queryContext(tx, ctx, query, projectId, traceOrSpanId, limit)
+	var dayMin, dayMax interface{}
+	if !publishedMin.IsZero() {
+		day := publishedMin.UTC().Truncate(24 * time.Hour)
+		if day.Before(publishedMin) {
+			day = day.Add(24 * time.Hour)
 		}
+		dayMin = UsageDay(day)
+	}
+	if !publishedMax.IsZero() {
+		dayMax = UsageDay(publishedMax)
+	}
+	cond, args = aggregateRange("day", dayMin, dayMax)
+	query = `DELETE FROM field_value WHERE project_id = ?` + cond
+	_, err := execTxContext(tx, ctx, query, append([]interface{}{projectId}, args...)...)
+	return err
+}
+
+// publishedRange is the condition (with args) of the column within min to max
+// inclusive, either being zero for unbounded.
+func publishedRange(column string, min, max time.Time) (string, []interface{}) {
+	cond, args := "", make([]interface{}, 0, 2)
+	if !min.IsZero() {
+		cond += " AND " + column + " >= ?"
+		args = append(args, min)
 	}
+	if !max.IsZero() {
+		cond += " AND " + column + " <= ?"
+		args = append(args, max)
+	}
+	return cond, args
+}
 
+// aggregateRange is the condition (with args) of the column from min inclusive to max
+// exclusive, either being nil for unbounded, for the aggregate periods (e.g. minutes)
+// that start and end in a range.
+func aggregateRange(column string, min, max interface{}) (string, []interface{}) {
+	cond, args := "", make([]interface{}, 0, 2)
+	if min != nil {
+		cond += " AND " + column + " >= ?"
+		args = append(args, min)
+	}
+	if max != nil {
+		cond += " AND " + column + " < ?"
+		args = append(args, max)
+	}
+	return cond, args
+}
+
+// GetEntry returns the project's entry with the seq, or nil if there isn't one.
+func GetEntry(projectId int, seq int64, db *sql.DB, ctx context.Context) (*Entry, error) {
+	query := "SELECT " + entryCols + " FROM entry WHERE project_id = ? AND seq = ?"
+	rows, err := queryContext(db, ctx, query, projectId, seq)
 	if rows != nil {
 		defer rows.Close()
 	}
-
-	switch {
-	case err == sql.ErrNoRows:
-		return make([]Entry, 0), nil
-	case err != nil:
+	if err != nil {
 		return nil, err
-	case rows == nil:
-		return make([]Entry, 0), nil
 	}
-
 	entries, err := resultEntries(rows)
-	if err != nil {
+	if err != nil || len(entries) == 0 {
 		return nil, err
 	}
+	return &entries[0], nil
+}
 
-	if desc {
-		reverseEntries(entries)
+// The scopes of the entries around an entry.
+const (
+	AroundProject = "project"
+	AroundSource  = "source"
+	AroundActor   = "actor"
+	AroundTrace   = "trace"
+)
+
+// ListEntriesAround returns up to before entries preceding e and after entries
+// following it, in seq order, in its project or with the same source, actor or trace.
+func ListEntriesAround(e Entry, scope string, before, after int, db *sql.DB, ctx context.Context) ([]Entry, []Entry, error) {
+	where := "project_id = ?"
+	args := []interface{}{e.ProjectId}
+	switch scope {
+	case AroundProject:
+	case AroundSource:
+		where += " AND source = ?"
+		args = append(args, e.Source)
+	case AroundActor:
+		where += " AND actor = ?"
+		args = append(args, e.Actor)
+	case AroundTrace:
+		if e.TraceId == "" {
+			return nil, nil, fmt.Errorf("entry %d has no trace", e.Seq)
+		}
+		where += " AND trace_id = ?"
+		args = append(args, e.TraceId)
+	default:
+		return nil, nil, fmt.Errorf("unknown scope '%s'", scope)
 	}
 
-	return entries, nil
-}
+	list := func(cond, order string, limit int) ([]Entry, error) {
+		if limit == 0 {
+			return make([]Entry, 0), nil
+		}
+		query := "SELECT " + entryCols + " FROM entry WHERE " + where + " AND seq " + cond + " ?" +
+			" ORDER BY seq " + order + " LIMIT ?"
+		rows, err := queryContext(db, ctx, query, append(args, e.Seq, limit)...)
+		if rows != nil {
+			defer rows.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resultEntries(rows)
+	}
 
-func DeleteEntries(projectId int, publishedMin, publishedMax time.Time, tx *sql.Tx, ctx context.Context) error {
-	var err error
-	if !publishedMin.IsZero() && !publishedMax.IsZero() {
-		query := `DELETE FROM entry WHERE project_id = ? AND published BETWEEN ? AND ?;`
-		_, err = execTxContext(tx, ctx, query, projectId, publishedMin, publishedMax)
-	} else if !publishedMin.IsZero() {
-		query := `DELETE FROM entry WHERE project_id = ? AND ? <= published;`
-		_, err = execTxContext(tx, ctx, query, projectId, publishedMin)
-	} else if !publishedMax.IsZero() {
-		query := `DELETE FROM entry WHERE project_id = ? AND published <= ?;`
-		_, err = execTxContext(tx, ctx, query, projectId, publishedMax)
+	preceding, err := list("<", "DESC", before)
+	if err != nil {
+		return nil, nil, err
 	}
-	return err
+	reverseEntries(preceding)
+	following, err := list(">", "ASC", after)
+	if err != nil {
+		return nil, nil, err
+	}
+	return preceding, following, nil
 }
 
 func selectLastEntries(projectId int32, limit int, tx *sql.Tx, ctx context.Context) ([]Entry, error) {
@@ -339,22 +459,41 @@ func resultEntries(rows *sql.Rows) ([]Entry, error) {
 		if err := rows.Err(); err != nil {
 			return nil, err
 		}
-		var e Entry
-		var traceId, parentSpanId, spanId sql.NullString
-		if err := rows.Scan(&e.ProjectId, &e.Seq, &e.Published, &e.Source, &e.Type, &e.Actor, &e.Object, &e.Target,
-			&e.Context, &e.Repeated, &traceId, &parentSpanId, &spanId); err != nil {
-			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
 		}
-		e.Published = e.Published.UTC()
-		e.TraceId = traceId.String
-		e.ParentSpanId = parentSpanId.String
-		e.SpanId = spanId.String
-
 		entries = append(entries, e)
 	}
 	return entries, nil
 }
 
+// scanEntry scans the entryCols of the current row followed by any extra columns.
+func scanEntry(rows *sql.Rows, extra ...interface{}) (Entry, error) {
+	var e Entry
+	var firstPublished pq.NullTime
+	var lastSeq sql.NullInt64
+	var traceId, parentSpanId, spanId sql.NullString
+	dest := []interface{}{&e.ProjectId, &e.Seq, &e.Published, &e.Source, &e.Type, &e.Actor, &e.Object, &e.Target,
+		&e.Context, &e.Repeated, &firstPublished, &lastSeq, &traceId, &parentSpanId, &spanId}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return e, fmt.Errorf("failed to scan result set: %s", err)
+	}
+	e.Published = e.Published.UTC()
+	e.FirstPublished = e.Published
+	if firstPublished.Valid {
+		e.FirstPublished = firstPublished.Time.UTC()
+	}
+	e.LastSeq = e.Seq
+	if lastSeq.Valid {
+		e.LastSeq = lastSeq.Int64
+	}
+	e.TraceId = traceId.String
+	e.ParentSpanId = parentSpanId.String
+	e.SpanId = spanId.String
+	return e, nil
+}
+
 func reverseEntries(entries []Entry) {
 	lst := len(entries) - 1
 	mid := len(entries) / 2
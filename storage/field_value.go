@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The distinct values of the entry fields are counted per UTC day in field_value,
+// so that looking up the values of a field (e.g. for autocomplete) doesn't scan
+// the entries. UpdateFieldValues adds the entries created since the last update,
+// and the repeats collapsed into entries since, like UpdateServiceMap.
+
+const fieldValueBatch = 10000
+
+// FieldValueFields are the entry fields whose values are counted.
+var FieldValueFields = []string{"source", "type", "actor", "object", "target"}
+
+// FieldValue is a value of a field with the number of entries (including repeats)
+// that had it and when one was last published.
+type FieldValue struct {
+	Value    string    `json:"value"`
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// UpdateFieldValues counts the field values of each project's entries created since
+// the last update, with the same lag as UpdateServiceMap. A project that fails is
+// logged and retried on the next update.
+func UpdateFieldValues(db *sql.DB, ctx context.Context) error {
+	projects := make([]Project, 0)
+	if err := ListProjects("", "", &projects, db, ctx); err != nil {
+		return err
+	}
+	for _, p := range projects {
+		if err := updateProjectFieldValues(p.Id, db, ctx); err != nil {
+			log.Printf("Error updating field values of project %d: %v\n", p.Id, err)
+		}
+	}
+	return nil
+}
+
+func updateProjectFieldValues(projectId int32, db *sql.DB, ctx context.Context) error {
+	var seq, pendingSeq, repeatId, pendingRepeatId int64
+	query := `SELECT seq, pending_seq, repeat_id, pending_repeat_id FROM field_value_state WHERE project_id = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId).Scan(&seq, &pendingSeq, &repeatId, &pendingRepeatId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upTo, upToRepeat := pendingSeq, pendingRepeatId
+	if upTo > seq {
+		if seq, err = addFieldValues(projectId, seq, upTo, tx, ctx); err != nil {
+			return err
+		}
+	}
+	if upToRepeat > repeatId {
+		if repeatId, err = addRepeatFieldValues(projectId, repeatId, upToRepeat, tx, ctx); err != nil {
+			return err
+		}
+	}
+
+	var maxSeq, maxRepeatId sql.NullInt64
+	query = `SELECT max(seq) FROM entry WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxSeq); err != nil {
+		return err
+	}
+	if seq == upTo {
+		pendingSeq = maxSeq.Int64
+	}
+	query = `SELECT max(id) FROM entry_repeat WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxRepeatId); err != nil {
+		return err
+	}
+	if repeatId == upToRepeat {
+		pendingRepeatId = maxRepeatId.Int64
+	}
+
+	query = `INSERT INTO field_value_state (project_id, seq, pending_seq, repeat_id, pending_repeat_id)` +
+		` VALUES (?, ?, ?, ?, ?) ON CONFLICT (project_id) DO UPDATE SET seq = EXCLUDED.seq,` +
+		` pending_seq = EXCLUDED.pending_seq, repeat_id = EXCLUDED.repeat_id, pending_repeat_id = EXCLUDED.pending_repeat_id`
+	if _, err = execTxContext(tx, ctx, query, projectId, seq, pendingSeq, repeatId, pendingRepeatId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fieldValueUpsert adds the counts of the (project_id, field, value, day) rows selected.
+const fieldValueUpsert = " ON CONFLICT (project_id, field, value, day) DO UPDATE SET count = field_value.count + EXCLUDED.count," +
+	" last_seen = greatest(field_value.last_seen, EXCLUDED.last_seen)"
+
+// fieldValueFields are the (field, value) rows of the entry e.
+const fieldValueFields = " CROSS JOIN LATERAL (VALUES ('source', e.source), ('type', e.type), ('actor', e.actor)," +
+	"   ('object', e.object), ('target', e.target)) f (field, value)"
+
+// addFieldValues counts the field values of the entries with seq in (fromSeq, toSeq],
+// each as 1 plus the repeats it has that aren't in entry_repeat, and returns the seq
+// it got up to (toSeq unless there were more than a batch).
+func addFieldValues(projectId int32, fromSeq, toSeq int64, tx *sql.Tx, ctx context.Context) (int64, error) {
+	var lastSeq sql.NullInt64
+	var n int
+	query := `SELECT max(seq), count(*) FROM (SELECT seq FROM entry WHERE project_id = ? AND seq > ? AND seq <= ?` +
+		` ORDER BY seq LIMIT ?) batch`
+	if err := queryRowTxContext(tx, ctx, query, projectId, fromSeq, toSeq, fieldValueBatch).Scan(&lastSeq, &n); err != nil {
+		return fromSeq, err
+	}
+	if n < fieldValueBatch {
+		lastSeq.Int64 = toSeq
+	}
+	if n == 0 {
+		return toSeq, nil
+	}
+
+	query = "INSERT INTO field_value (project_id, field, value, day, count, last_seen)" +
+		" SELECT e.project_id, f.field, f.value, (e.published AT TIME ZONE 'UTC')::date," +
+		"   sum(1 + e.repeated - coalesce((SELECT sum(repeats) FROM entry_repeat" +
+		"     WHERE project_id = e.project_id AND seq = e.seq), 0)), max(e.published)" +
+		" FROM entry e" + fieldValueFields +
+		" WHERE e.project_id = ? AND e.seq > ? AND e.seq <= ? AND f.value <> ''" +
+		" GROUP BY 1, 2, 3, 4" + fieldValueUpsert
+	if _, err := execTxContext(tx, ctx, query, projectId, fromSeq, lastSeq.Int64); err != nil {
+		return fromSeq, err
+	}
+	return lastSeq.Int64, nil
+}
+
+// addRepeatFieldValues counts the field values of the repeats with id in (fromId, toId]
+// on the days they were published, and returns the id it got up to (toId unless there
+// were more than a batch).
+func addRepeatFieldValues(projectId int32, fromId, toId int64, tx *sql.Tx, ctx context.Context) (int64, error) {
+	var lastId sql.NullInt64
+	var n int
+	query := `SELECT max(id), count(*) FROM (SELECT id FROM entry_repeat WHERE project_id = ? AND id > ? AND id <= ?` +
+		` ORDER BY id LIMIT ?) batch`
+	if err := queryRowTxContext(tx, ctx, query, projectId, fromId, toId, fieldValueBatch).Scan(&lastId, &n); err != nil {
+		return fromId, err
+	}
+	if n < fieldValueBatch {
+		lastId.Int64 = toId
+	}
+	if n == 0 {
+		return toId, nil
+	}
+
+	query = "INSERT INTO field_value (project_id, field, value, day, count, last_seen)" +
+		" SELECT e.project_id, f.field, f.value, (r.published AT TIME ZONE 'UTC')::date, sum(r.repeats), max(r.published)" +
+		" FROM entry_repeat r JOIN entry e ON e.project_id = r.project_id AND e.seq = r.seq" + fieldValueFields +
+		" WHERE r.project_id = ? AND r.id > ? AND r.id <= ? AND f.value <> ''" +
+		" GROUP BY 1, 2, 3, 4" + fieldValueUpsert
+	if _, err := execTxContext(tx, ctx, query, projectId, fromId, lastId.Int64); err != nil {
+		return fromId, err
+	}
+	return lastId.Int64, nil
+}
+
+// ListFieldValues returns up to limit values of the project's entry field starting
+// with the prefix, published on the UTC days since the given day, most frequent first.
+func ListFieldValues(projectId int, field, prefix, since string, limit int, db *sql.DB, ctx context.Context) ([]FieldValue, error) {
+	query := `SELECT value, sum(count), max(last_seen) FROM field_value` +
+		` WHERE project_id = ? AND field = ? AND day >= ? AND value LIKE ?` +
+		` GROUP BY value ORDER BY sum(count) DESC, value LIMIT ?`
+	rows, err := queryContext(db, ctx, query, projectId, field, since, likePrefix(prefix), limit)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]FieldValue, 0)
+	for rows.Next() {
+		var v FieldValue
+		if err = rows.Scan(&v.Value, &v.Count, &v.LastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
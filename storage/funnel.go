@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage/query"
+	"github.com/lib/pq"
+)
+
+// A funnel counts the actors (or values of a context key) that went through a
+// sequence of steps, each a search, with each step after the one before and all
+// within a window of the first. Sessions split the entries of an actor where
+// there was a gap in activity.
+
+// funnelLimit is the most entries of a step that are counted.
+const funnelLimit = 100000
+
+// FunnelStep is the number of groups that reached the step, their conversion
+// from the previous and first steps and samples of those that went no further.
+type FunnelStep struct {
+	Search     string   `json:"search"`
+	Count      int      `json:"count"`
+	Conversion float64  `json:"conversion"`
+	Overall    float64  `json:"overall"`
+	DroppedOff int      `json:"dropped_off"`
+	Samples    []string `json:"samples"`
+	// Truncated is whether more than funnelLimit entries matched the step.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type Funnel struct {
+	By            string       `json:"by"`
+	WindowSeconds int32        `json:"window_seconds"`
+	Steps         []FunnelStep `json:"steps"`
+}
+
+// funnelGroup returns the expression grouping entries by "actor" or a
+// "context.<path>" value, with its args.
+func funnelGroup(by string) (string, []interface{}, error) {
+	if by == "actor" {
+		return "e.actor", nil, nil
+	}
+	if strings.HasPrefix(by, "context.") {
+		path, err := ParseContextPath(strings.TrimPrefix(by, "context."))
+		if err != nil {
+			return "", nil, err
+		}
+		return "(e.context #>> ?::text[])", []interface{}{pq.Array(path)}, nil
+	}
+	return "", nil, fmt.Errorf("'by' must be actor or context.<path>")
+}
+
+// BuildFunnel counts the groups of the filtered entries that matched the steps
+// (searches) in order within the window, with up to samples of those dropping off
+// after each step.
+func BuildFunnel(f EntryFilter, steps []string, window time.Duration, by string, samples int,
+	db *sql.DB, ctx context.Context) (Funnel, error) {
+	funnel := Funnel{By: by, WindowSeconds: int32(window / time.Second), Steps: make([]FunnelStep, len(steps))}
+	group, groupArgs, err := funnelGroup(by)
+	if err != nil {
+		return funnel, err
+	}
+	where, args, err := f.whereIndexed(db, ctx)
+	if err != nil {
+		return funnel, err
+	}
+
+	// the published times of each step's entries by group
+	times := make([]map[string][]time.Time, len(steps))
+	for i, search := range steps {
+		funnel.Steps[i] = FunnelStep{Search: search, Samples: make([]string, 0)}
+		node, err := query.Parse(search)
+		if err != nil {
+			return funnel, fmt.Errorf("step %d: %v", i+1, err)
+		}
+		stepWhere, stepArgs := where, append([]interface{}{}, args...)
+		if node != nil {
+			cond, searchArgs, err := query.SQL(node)
+			if err != nil {
+				return funnel, fmt.Errorf("step %d: %v", i+1, err)
+			}
+			stepWhere += " AND (" + cond + ")"
+			stepArgs = append(stepArgs, searchArgs...)
+		}
+
+		q := "SELECT " + group + ", e.published FROM entry e WHERE " + stepWhere + " AND " + group + " <> ''" +
+			" ORDER BY e.published, e.seq LIMIT ?"
+		queryArgs := append(append(append(append([]interface{}{}, groupArgs...), stepArgs...), groupArgs...), funnelLimit+1)
+		if times[i], funnel.Steps[i].Truncated, err = funnelTimes(q, queryArgs, db, ctx); err != nil {
+			return funnel, err
+		}
+	}
+
+	// how far each group got, from its best start
+	reached := make(map[string]int)
+	for g, starts := range times[0] {
+		for _, start := range starts {
+			n := funnelReach(times, g, start, window)
+			if n > reached[g] {
+				reached[g] = n
+			}
+			if n == len(steps) {
+				break
+			}
+		}
+	}
+
+	groups := make([]string, 0, len(reached))
+	for g := range reached {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		n := reached[g]
+		for i := 0; i < n; i++ {
+			funnel.Steps[i].Count++
+		}
+		if n < len(steps) {
+			s := &funnel.Steps[n-1]
+			s.DroppedOff++
+			if len(s.Samples) < samples {
+				s.Samples = append(s.Samples, g)
+			}
+		}
+	}
+	for i := range funnel.Steps {
+		s := &funnel.Steps[i]
+		if i == 0 {
+			if s.Count > 0 {
+				s.Conversion, s.Overall = 1, 1
+			}
+			continue
+		}
+		if prev := funnel.Steps[i-1].Count; prev > 0 {
+			s.Conversion = float64(s.Count) / float64(prev)
+		}
+		if first := funnel.Steps[0].Count; first > 0 {
+			s.Overall = float64(s.Count) / float64(first)
+		}
+	}
+	return funnel, nil
+}
+
+func funnelTimes(q string, args []interface{}, db *sql.DB, ctx context.Context) (map[string][]time.Time, bool, error) {
+	rows, err := queryContext(db, ctx, q, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	times := make(map[string][]time.Time)
+	n := 0
+	for rows.Next() {
+		var g string
+		var published time.Time
+		if err = rows.Scan(&g, &published); err != nil {
+			return nil, false, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		if n++; n > funnelLimit {
+			return times, true, rows.Err()
+		}
+		times[g] = append(times[g], published)
+	}
+	return times, false, rows.Err()
+}
+
+// funnelReach returns how many steps the group went through starting at the
+// time, taking the earliest entry of each step after the previous one.
+func funnelReach(times []map[string][]time.Time, group string, start time.Time, window time.Duration) int {
+	end := start.Add(window)
+	at := start
+	for i := 1; i < len(times); i++ {
+		ts := times[i][group]
+		k := sort.Search(len(ts), func(k int) bool { return ts[k].After(at) })
+		if k == len(ts) || ts[k].After(end) {
+			return i
+		}
+		at = ts[k]
+	}
+	return len(times)
+}
+
+// Session is a run of an actor's entries without a gap in activity.
+type Session struct {
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMs float64   `json:"duration_ms"`
+	// Entries counts repeats, while SeqMin and SeqMax are of the entries in it.
+	Entries int64    `json:"entries"`
+	SeqMin  int64    `json:"seq_min"`
+	SeqMax  int64    `json:"seq_max"`
+	Sources []string `json:"sources"`
+}
+
+// ListSessions returns up to limit of the actor's most recent sessions of the
+// filtered entries, split where more than gap passed between entries, latest first.
+func ListSessions(f EntryFilter, actor string, gap time.Duration, limit int, db *sql.DB, ctx context.Context) ([]Session, error) {
+	where, args, err := f.whereIndexed(db, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := "SELECT min(published), max(published), sum(1 + repeated), min(seq), max(seq)," +
+		" array_agg(DISTINCT source ORDER BY source)" +
+		" FROM (SELECT *, sum(new_session) OVER (ORDER BY published, seq) AS session" +
+		"   FROM (SELECT e.seq, e.published, e.repeated, e.source," +
+		"     CASE WHEN e.published - lag(e.published) OVER (ORDER BY e.published, e.seq) <= ?::float8 * interval '1 second'" +
+		"     THEN 0 ELSE 1 END AS new_session" +
+		"     FROM entry e WHERE " + where + " AND e.actor = ?) marked) sessions" +
+		" GROUP BY session ORDER BY session DESC LIMIT ?"
+	args = append(append([]interface{}{gap.Seconds()}, args...), actor, limit)
+	rows, err := queryContext(db, ctx, q, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		var sources pq.StringArray
+		if err = rows.Scan(&s.Start, &s.End, &s.Entries, &s.SeqMin, &s.SeqMax, &sources); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		s.DurationMs = milliseconds(s.End.Sub(s.Start))
+		s.Sources = sources
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Graph has entity and source nodes, with an edge for each hop of an entry:
+// actor -> source -> object -> target (skipping those that are empty), labeled
+// by the entry type. So a user drives a service which acts on an object aimed at a target.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"` // "source" or the entity kind, e.g. "user"
+	Count int64  `json:"count"`
+}
+
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+}
+
+// BuildGraph builds the graph of the entries selected by the filter, from at
+// most limit distinct (source, type, actor, object, target) combinations.
+// Counts include repeats.
+func BuildGraph(f EntryFilter, limit int, db *sql.DB, ctx context.Context) (Graph, error) {
+	where, args, err := f.whereIndexed(db, ctx)
+	if err != nil {
+		return Graph{}, err
+	}
+	query := "SELECT e.source, e.type, e.actor, e.object, e.target, sum(1 + e.repeated) AS n" +
+		" FROM entry e WHERE " + where +
+		" GROUP BY e.source, e.type, e.actor, e.object, e.target ORDER BY n DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := queryContext(db, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return Graph{}, err
+	}
+
+	b := newGraphBuilder()
+	for rows.Next() {
+		var source, typ, actor, object, target string
+		var count int64
+		if err = rows.Scan(&source, &typ, &actor, &object, &target, &count); err != nil {
+			return Graph{}, fmt.Errorf("failed to scan result set: %s", err)
+		}
+
+		path := make([]string, 0, 4)
+		for _, id := range []string{b.entity(actor), b.source(source), b.entity(object), b.entity(target)} {
+			if id != "" {
+				b.count(id, count)
+				path = append(path, id)
+			}
+		}
+		for i := 1; i < len(path); i++ {
+			b.edge(path[i-1], path[i], typ, count)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return Graph{}, err
+	}
+	return b.graph(), nil
+}
+
+type graphBuilder struct {
+	nodes map[string]*GraphNode // by kind/name
+	ids   map[string]*GraphNode // by id
+	edges map[GraphEdge]int64   // by edge without count
+}
+
+func newGraphBuilder() *graphBuilder {
+	return &graphBuilder{
+		nodes: make(map[string]*GraphNode),
+		ids:   make(map[string]*GraphNode),
+		edges: make(map[GraphEdge]int64),
+	}
+}
+
+func (b *graphBuilder) source(name string) string {
+	return b.node("source", name)
+}
+
+func (b *graphBuilder) entity(name string) string {
+	if name == "" {
+		return ""
+	}
+	kind := ""
+	if i := strings.Index(name, ":"); i > 0 {
+		kind = name[:i]
+	}
+	return b.node(kind, name)
+}
+
+func (b *graphBuilder) node(kind, name string) string {
+	key := kind + "/" + name
+	if kind == "source" {
+		key = "source//" + name
+	}
+	n, ok := b.nodes[key]
+	if !ok {
+		n = &GraphNode{Id: fmt.Sprintf("n%d", len(b.nodes)), Name: name, Kind: kind}
+		b.nodes[key] = n
+		b.ids[n.Id] = n
+	}
+	return n.Id
+}
+
+func (b *graphBuilder) count(id string, count int64) {
+	b.ids[id].Count += count
+}
+
+func (b *graphBuilder) edge(from, to, typ string, count int64) {
+	b.edges[GraphEdge{From: from, To: to, Type: typ}] += count
+}
+
+func (b *graphBuilder) graph() Graph {
+	g := Graph{
+		Nodes: make([]GraphNode, 0, len(b.nodes)),
+		Edges: make([]GraphEdge, 0, len(b.edges)),
+	}
+	for _, n := range b.nodes {
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		return len(g.Nodes[i].Id) < len(g.Nodes[j].Id) ||
+			len(g.Nodes[i].Id) == len(g.Nodes[j].Id) && g.Nodes[i].Id < g.Nodes[j].Id
+	})
+	for e, count := range b.edges {
+		e.Count = count
+		g.Edges = append(g.Edges, e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Type < b.Type
+	})
+	return g
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// IdempotencyWindow is how long an idempotency key is remembered. A replay of
+// the same key within the window resolves to the originally created entry.
+const IdempotencyWindow = 24 * time.Hour
+
+// LookupIdempotencyKey returns the seq of the entry created with the given key
+// within the IdempotencyWindow, or 0 if the key hasn't been seen (or expired).
+func LookupIdempotencyKey(projectId int32, key string, tx *sql.Tx, ctx context.Context) (int64, error) {
+	var seq int64
+	query := `SELECT seq FROM entry_key WHERE project_id = ? AND key = ? AND created > ?`
+	err := queryRowTxContext(tx, ctx, query, projectId, key, time.Now().Add(-IdempotencyWindow)).Scan(&seq)
+	switch {
+	case err == sql.ErrNoRows:
+		// forget an expired key so that it can be reused
+		query = `DELETE FROM entry_key WHERE project_id = ? AND key = ?`
+		_, err = execTxContext(tx, ctx, query, projectId, key)
+		return 0, err
+	case err != nil:
+		return 0, err
+	}
+	return seq, nil
+}
+
+// LookupIdempotencyKeyDB is LookupIdempotencyKey outside of a transaction, used
+// to resolve the winner after losing a race on the same key.
+func LookupIdempotencyKeyDB(projectId int32, key string, db *sql.DB, ctx context.Context) (int64, error) {
+	var seq int64
+	query := `SELECT seq FROM entry_key WHERE project_id = ? AND key = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId, key).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// createIdempotencyKey records the key for the entry seq. A concurrent request
+// with the same key fails with a unique violation (see IsUniqueViolation).
+func createIdempotencyKey(projectId int32, key string, seq int64, tx *sql.Tx, ctx context.Context) error {
+	query := `INSERT INTO entry_key (project_id, key, seq, created) VALUES (?, ?, ?, ?)`
+	_, err := execTxContext(tx, ctx, query, projectId, key, seq, time.Now())
+	return err
+}
+
+// PurgeIdempotencyKeys deletes keys older than the IdempotencyWindow.
+func PurgeIdempotencyKeys(db *sql.DB, ctx context.Context) error {
+	query := `DELETE FROM entry_key WHERE created <= ?`
+	_, err := execContext(db, ctx, query, time.Now().Add(-IdempotencyWindow))
+	return err
+}
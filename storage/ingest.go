@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// In the asynchronous ingest mode entries are appended to a write-ahead log and
+// written in batches by CreateEntryBatch, with the log position they were read
+// up to checkpointed in the same transaction so that none are lost or written twice.
+
+// batchEntry is an entry of a batch, either new or one already in the table
+// that entries of the batch are collapsed into.
+type batchEntry struct {
+	Entry
+	isNew   bool
+	repeats int32 // collapsed into an existing entry
+}
+
+// batch collapses the entries of a batch in memory as createEntry would one at a time.
+type batch struct {
+	tx  *sql.Tx
+	ctx context.Context
+
+	entries  []*batchEntry
+	policies map[int32]*DedupPolicy
+	// the latest entries per project (default policy) or dedup scope
+	lasts  map[int32][]*batchEntry
+	scoped map[string]*batchEntry
+	loaded map[string]bool
+}
+
+// CreateEntryBatch creates the entries, in order, with repeats collapsed in memory
+// and the new entries inserted with a multi-row INSERT. As with CreateEntry, an
+// entry with an EventId that was already used isn't created.
+func CreateEntryBatch(entries []Entry, tx *sql.Tx, ctx context.Context) error {
+	b := &batch{tx: tx, ctx: ctx,
+		policies: make(map[int32]*DedupPolicy),
+		lasts:    make(map[int32][]*batchEntry),
+		scoped:   make(map[string]*batchEntry),
+		loaded:   make(map[string]bool),
+	}
+
+	type eventKey struct {
+		projectId int32
+		eventId   string
+	}
+	events := make(map[eventKey]*batchEntry)
+	created := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		k := eventKey{e.ProjectId, e.EventId}
+		if e.EventId != "" {
+			if _, ok := events[k]; ok {
+				continue
+			}
+			if seq, err := LookupIdempotencyKey(e.ProjectId, e.EventId, tx, ctx); err != nil {
+				return err
+			} else if seq != 0 {
+				continue
+			}
+		}
+		be, err := b.add(e)
+		if err != nil {
+			return err
+		}
+		if e.EventId != "" {
+			events[k] = be
+		}
+		created = append(created, e)
+	}
+
+	if err := b.write(); err != nil {
+		return err
+	}
+	if err := createSpanTags(created, tx, ctx); err != nil {
+		return err
+	}
+	for k, be := range events {
+		if err := createIdempotencyKey(k.projectId, k.eventId, be.Seq, tx, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds the entry to the batch, returning the entry it is or is collapsed into.
+func (b *batch) add(e Entry) (*batchEntry, error) {
+	policy, ok := b.policies[e.ProjectId]
+	if !ok {
+		var err error
+		if policy, err = GetDedupPolicy(e.ProjectId, b.tx, b.ctx); err != nil {
+			return nil, err
+		}
+		b.policies[e.ProjectId] = policy
+	}
+
+	if policy != nil {
+		key := scopeKey(e, *policy)
+		if !b.loaded[key] {
+			last, err := selectLastEntryInScope(e, *policy, b.tx, b.ctx)
+			if err != nil {
+				return nil, err
+			}
+			if last != nil {
+				b.scoped[key] = &batchEntry{Entry: *last}
+			}
+			b.loaded[key] = true
+		}
+		if last := b.scoped[key]; last != nil && policy.matches(e, last.Entry) {
+			b.collapse(e, last)
+			return last, nil
+		}
+		be := b.insert(e)
+		b.scoped[key] = be
+		return be, nil
+	}
+
+	lasts, ok := b.lasts[e.ProjectId]
+	if !ok {
+		entries, err := selectLastEntries(e.ProjectId, 2, b.tx, b.ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			lasts = append(lasts, &batchEntry{Entry: entries[i]})
+		}
+	}
+	if len(lasts) == 2 && e.matches(lasts[1].Entry) && e.matches(lasts[0].Entry) {
+		b.collapse(e, lasts[0])
+		b.lasts[e.ProjectId] = lasts
+		return lasts[0], nil
+	}
+	be := b.insert(e)
+	lasts = append([]*batchEntry{be}, lasts...)
+	if len(lasts) > 2 {
+		lasts = lasts[:2]
+	}
+	b.lasts[e.ProjectId] = lasts
+	return be, nil
+}
+
+// scopeKey identifies the dedup scope of the entry.
+func scopeKey(e Entry, p DedupPolicy) string {
+	switch p.Scope {
+	case DedupScopeSource:
+		return fmt.Sprintf("%d/source/%s", e.ProjectId, e.Source)
+	case DedupScopeActor:
+		return fmt.Sprintf("%d/actor/%s", e.ProjectId, e.Actor)
+	}
+	return fmt.Sprintf("%d", e.ProjectId)
+}
+
+func (b *batch) insert(e Entry) *batchEntry {
+	be := &batchEntry{Entry: e, isNew: true}
+	be.FirstPublished = e.Published
+	b.entries = append(b.entries, be)
+	return be
+}
+
+// collapse records e as a repeat of last, as collapseEntry does.
+func (b *batch) collapse(e Entry, last *batchEntry) {
+	if !last.isNew && last.repeats == 0 {
+		b.entries = append(b.entries, last)
+	}
+	if !last.isNew {
+		last.repeats++
+	}
+	last.Published = e.Published
+	last.Repeated++
+	last.TraceId = e.TraceId
+	last.ParentSpanId = e.ParentSpanId
+	last.SpanId = e.SpanId
+}
+
+// write inserts the new entries, with seqs allocated in batch order, and updates
+// the existing entries that were repeated.
+func (b *batch) write() error {
+	inserts := make([]*batchEntry, 0, len(b.entries))
+	for _, be := range b.entries {
+		if be.isNew {
+			inserts = append(inserts, be)
+		} else {
+			query := "UPDATE entry SET published = ?, repeated = repeated + ?," +
+				" first_published = COALESCE(first_published, published), last_seq = " + collapsedLastSeq + "," +
+				" trace_id = ?, parent_span_id = ?, span_id = ?" +
+				" WHERE project_id = ? AND seq = ?"
+			if _, err := execTxContext(b.tx, b.ctx, query, be.Published, be.repeats, StringToNullable(be.TraceId),
+				StringToNullable(be.ParentSpanId), StringToNullable(be.SpanId), be.ProjectId, be.Seq); err != nil {
+				return err
+			}
+			if err := logRepeats(be.ProjectId, be.Seq, be.Published, be.repeats, be.ParentSpanId, b.tx, b.ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if len(inserts) == 0 {
+		return nil
+	}
+
+	query := `SELECT nextval(pg_get_serial_sequence('entry', 'seq')) FROM generate_series(1, ?)`
+	rows, err := queryTxContext(b.tx, b.ctx, query, len(inserts))
+	if err != nil {
+		return err
+	}
+	for i := 0; rows.Next(); i++ {
+		if err = rows.Scan(&inserts[i].Seq); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for len(inserts) > 0 {
+		n := len(inserts)
+		if n > maxInsertRows {
+			n = maxInsertRows
+		}
+		if err = b.insertRows(inserts[:n]); err != nil {
+			return err
+		}
+		inserts = inserts[n:]
+	}
+	return nil
+}
+
+// maxInsertRows keeps the parameters of a multi-row INSERT within the Postgres limit.
+const maxInsertRows = 1000
+
+func (b *batch) insertRows(inserts []*batchEntry) error {
+	values := make([]string, 0, len(inserts))
+	args := make([]interface{}, 0, 14*len(inserts))
+	for _, be := range inserts {
+		var firstPublished interface{}
+		if be.Repeated > 0 {
+			firstPublished = be.FirstPublished
+		}
+		values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, be.ProjectId, be.Seq, be.Published, be.Source, be.Type, be.Actor, be.Object,
+			be.Target, be.Context, be.Repeated, firstPublished, StringToNullable(be.TraceId),
+			StringToNullable(be.ParentSpanId), StringToNullable(be.SpanId))
+	}
+	query := "INSERT INTO entry (project_id, seq, published, source, type, actor, object, target, context," +
+		" repeated, first_published, trace_id, parent_span_id, span_id) VALUES " + strings.Join(values, ", ")
+	_, err := execTxContext(b.tx, b.ctx, query, args...)
+	return err
+}
+
+// DeadLetter is an entry that couldn't be written, with the error.
+type DeadLetter struct {
+	Entry Entry
+	Error error
+}
+
+// CreateEntriesEach creates the entries one at a time, for when CreateEntryBatch
+// fails with a data error (see IsDataError) that would otherwise fail every retry.
+// Entries that fail with a data error are saved in ingest_dead_letter instead and
+// returned, while any other error fails them all.
+func CreateEntriesEach(logId string, entries []Entry, tx *sql.Tx, ctx context.Context) ([]DeadLetter, error) {
+	deadLetters := make([]DeadLetter, 0)
+	for _, e := range entries {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT ingest_entry"); err != nil {
+			return nil, err
+		}
+		cause := CreateEntryBatch([]Entry{e}, tx, ctx)
+		if cause != nil && !IsDataError(cause) {
+			return nil, cause
+		}
+
+		var err error
+		if cause == nil {
+			_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT ingest_entry")
+		} else if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT ingest_entry"); err == nil {
+			err = createDeadLetter(logId, e, cause, tx, ctx)
+			deadLetters = append(deadLetters, DeadLetter{Entry: e, Error: cause})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deadLetters, nil
+}
+
+func createDeadLetter(logId string, e Entry, cause error, tx *sql.Tx, ctx context.Context) error {
+	entry, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return insertDeadLetter(logId, e.ProjectId, string(entry), cause, tx, ctx)
+}
+
+// CreateRecordDeadLetter saves an ingest log record that couldn't be parsed into
+// entries in ingest_dead_letter as is, with project id 0 as its project is unknown.
+func CreateRecordDeadLetter(logId string, record []byte, cause error, tx *sql.Tx, ctx context.Context) error {
+	return insertDeadLetter(logId, 0, string(record), cause, tx, ctx)
+}
+
+func insertDeadLetter(logId string, projectId int32, entry string, cause error, tx *sql.Tx, ctx context.Context) error {
+	query := `INSERT INTO ingest_dead_letter (log_id, project_id, created, error, entry) VALUES (?, ?, ?, ?, ?)`
+	_, err := execTxContext(tx, ctx, query, logId, projectId, time.Now(), cause.Error(), entry)
+	return err
+}
+
+// GetIngestCheckpoint returns the log position that the log with the id was written up to.
+func GetIngestCheckpoint(logId string, db *sql.DB, ctx context.Context) (segment, offset int64, err error) {
+	query := `SELECT segment, "offset" FROM ingest_checkpoint WHERE log_id = ?`
+	err = db.QueryRowContext(ctx, numberArgs(query), logId).Scan(&segment, &offset)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return segment, offset, err
+}
+
+func PutIngestCheckpoint(logId string, segment, offset int64, tx *sql.Tx, ctx context.Context) error {
+	query := `INSERT INTO ingest_checkpoint (log_id, segment, "offset") VALUES (?, ?, ?)` +
+		` ON CONFLICT (log_id) DO UPDATE SET segment = EXCLUDED.segment, "offset" = EXCLUDED."offset"`
+	_, err := execTxContext(tx, ctx, query, logId, segment, offset)
+	return err
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JSONSchema is the subset of JSON Schema used to validate entry contexts: type,
+// properties, required, additionalProperties (true or false), items, enum,
+// pattern, minLength, maxLength, minimum, maximum, minItems and maxItems.
+type JSONSchema struct {
+	Type                 JSONSchemaTypes        `json:"type,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+// JSONSchemaTypes is a "type" keyword, either a type name or an array of them.
+type JSONSchemaTypes []string
+
+var jsonSchemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+func (t *JSONSchemaTypes) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = JSONSchemaTypes{name}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+func (t JSONSchemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// FieldError is a schema violation by the value at a field, e.g. "context.items[2].sku".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	return e.Field + ": " + e.Message
+}
+
+// check checks the schema itself, at the path.
+func (s *JSONSchema) check(path string) error {
+	for _, t := range s.Type {
+		if !containsString(jsonSchemaTypes, t) {
+			return fmt.Errorf("%s: 'type' must be one of '%s'", path, strings.Join(jsonSchemaTypes, "', '"))
+		}
+	}
+	if s.Pattern != "" {
+		if _, err := compilePattern(s.Pattern); err != nil {
+			return fmt.Errorf("%s: 'pattern': %v", path, err)
+		}
+	}
+	for _, name := range sortedSchemaKeys(s.Properties) {
+		if s.Properties[name] == nil {
+			return fmt.Errorf("%s.%s: schema is null", path, name)
+		}
+		if err := s.Properties[name].check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "[]")
+	}
+	return nil
+}
+
+// validate appends the violations by the decoded JSON value at the path to errs.
+func (s *JSONSchema) validate(v interface{}, path string, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(v) {
+		fail("must be %s, not %s", strings.Join(s.Type, " or "), jsonTypeOf(v))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			j, _ := json.Marshal(s.Enum)
+			fail("must be one of %s", j)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			if re, err := compilePattern(s.Pattern); err == nil && !re.MatchString(v) {
+				fail("must match '%s'", s.Pattern)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %g", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %g", *s.Maximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, FieldError{Field: path + "." + name, Message: "is required"})
+			}
+		}
+		for _, name := range sortedKeys(v) {
+			if p, ok := s.Properties[name]; ok {
+				p.validate(v[name], path+"."+name, errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, FieldError{Field: path + "." + name, Message: "is not allowed"})
+			}
+		}
+	}
+}
+
+func (t JSONSchemaTypes) matches(v interface{}) bool {
+	actual := jsonTypeOf(v)
+	for _, name := range t {
+		if name == actual || name == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf returns the JSON Schema type of a decoded JSON value, "integer" for whole numbers.
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// fields appends the fields described by the schema at the path.
+func (s *JSONSchema) fields(path string, required bool, fields *[]SchemaField) {
+	if path != "context" {
+		*fields = append(*fields, SchemaField{Field: path, Type: s.Type, Required: required,
+			Description: s.Description})
+	}
+	for _, name := range sortedSchemaKeys(s.Properties) {
+		s.Properties[name].fields(path+"."+name, containsString(s.Required, name), fields)
+	}
+	if s.Items != nil {
+		s.Items.fields(path+"[]", false, fields)
+	}
+}
+
+var (
+	patternsMutex sync.Mutex
+	patterns      = make(map[string]*regexp.Regexp)
+)
+
+// compilePattern returns the compiled regexp, compiling each pattern once.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patternsMutex.Lock()
+	defer patternsMutex.Unlock()
+	if re, ok := patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns[pattern] = re
+	return re, nil
+}
+
+func sortedSchemaKeys(m map[string]*JSONSchema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
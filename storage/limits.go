@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const LimitsConfig = "limits"
+
+// Limits are a project's ingest limits, zero for unlimited. Burst is the most
+// events accepted at once at EventsPerSecond (by default a second's worth).
+// MaxContextBytes is the size of the JSON context, and MaxContextDepth its nesting.
+type Limits struct {
+	EventsPerSecond float64 `json:"events_per_second"`
+	Burst           int64   `json:"burst"`
+	MaxPayloadBytes int64   `json:"max_payload_bytes"`
+	DailyQuota      int64   `json:"daily_quota"`
+	MaxContextBytes int64   `json:"max_context_bytes"`
+	MaxContextDepth int     `json:"max_context_depth"`
+}
+
+func (l Limits) Validate() error {
+	if l.EventsPerSecond < 0 || l.Burst < 0 || l.MaxPayloadBytes < 0 || l.DailyQuota < 0 ||
+		l.MaxContextBytes < 0 || l.MaxContextDepth < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+func GetLimits(projectId int32, db queryRower, ctx context.Context) (Limits, error) {
+	var limits Limits
+	_, err := GetProjectConfig(projectId, LimitsConfig, &limits, db, ctx)
+	return limits, err
+}
+
+// Usage is a project's ingest usage on a (UTC) day. Rejected counts the events of rejected requests.
+type Usage struct {
+	Day      string `json:"day"`
+	Events   int64  `json:"events"`
+	Bytes    int64  `json:"bytes"`
+	Rejected int64  `json:"rejected"`
+}
+
+const usageDayFormat = "2006-01-02"
+
+func UsageDay(t time.Time) string {
+	return t.UTC().Format(usageDayFormat)
+}
+
+// AddUsage adds to the project's usage on the day.
+func AddUsage(projectId int32, u Usage, db *sql.DB, ctx context.Context) error {
+	query := `INSERT INTO project_usage (project_id, day, events, bytes, rejected) VALUES (?, ?, ?, ?, ?)` +
+		` ON CONFLICT (project_id, day) DO UPDATE SET events = project_usage.events + EXCLUDED.events,` +
+		` bytes = project_usage.bytes + EXCLUDED.bytes, rejected = project_usage.rejected + EXCLUDED.rejected`
+	_, err := execContext(db, ctx, query, projectId, u.Day, u.Events, u.Bytes, u.Rejected)
+	return err
+}
+
+// ListUsage returns the project's usage on the days since the given day, latest first.
+func ListUsage(projectId int32, since string, db *sql.DB, ctx context.Context) ([]Usage, error) {
+	query := `SELECT to_char(day, 'YYYY-MM-DD'), events, bytes, rejected FROM project_usage` +
+		` WHERE project_id = ? AND day >= ? ORDER BY day DESC`
+	rows, err := queryContext(db, ctx, query, projectId, since)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]Usage, 0)
+	for rows.Next() {
+		var u Usage
+		if err = rows.Scan(&u.Day, &u.Events, &u.Bytes, &u.Rejected); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// GetUsage returns the project's usage on the day.
+func GetUsage(projectId int32, day string, db *sql.DB, ctx context.Context) (Usage, error) {
+	u := Usage{Day: day}
+	query := `SELECT events, bytes, rejected FROM project_usage WHERE project_id = ? AND day = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId, day).Scan(&u.Events, &u.Bytes, &u.Rejected)
+	if err == sql.ErrNoRows {
+		return u, nil
+	}
+	return u, err
+}
@@ -14,7 +14,7 @@ type Project struct {
 
 func CreateProject(p Project, tx *sql.Tx, ctx context.Context) error {
 	query := `INSERT INTO project (name, domain) VALUES (?, ?)`
-	if _, err := tx.ExecContext(ctx, query, p.Name, StringToNullable(p.Domain)); err != nil {
+	if _, err := execTxContext(tx, ctx, query, p.Name, StringToNullable(p.Domain)); err != nil {
 		return err
 	}
 	return nil
@@ -27,10 +27,10 @@ func ListProjects(filterName, filterValue string, projects *[]Project, db *sql.D
 
 	if filterName != "" {
 		query := `SELECT ` + fields + ` FROM project WHERE ` + filterName + ` = ? ORDER BY name, id`
-		rows, err = db.QueryContext(ctx, query, filterValue)
+		rows, err = queryContext(db, ctx, query, filterValue)
 	} else {
 		query := `SELECT ` + fields + ` FROM project ORDER BY name, id`
-		rows, err = db.QueryContext(ctx, query)
+		rows, err = queryContext(db, ctx, query)
 	}
 	if rows != nil {
 		defer rows.Close()
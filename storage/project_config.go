@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Per-project configuration is stored as a JSON document per name, e.g. "dedup".
+// Reads are cached briefly since they happen on every ingested entry, and changes
+// are followed by ForgetProjectConfig.
+
+const projectConfigTTL = 10 * time.Second
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type projectConfigKey struct {
+	projectId int32
+	name      string
+}
+
+type projectConfigValue struct {
+	config []byte
+	loaded time.Time
+}
+
+var (
+	projectConfigMutex sync.Mutex
+	projectConfigCache = make(map[projectConfigKey]projectConfigValue)
+)
+
+// GetProjectConfig unmarshals the named project config into v and returns true,
+// or returns false if the project has no such config.
+func GetProjectConfig(projectId int32, name string, v interface{}, db queryRower, ctx context.Context) (bool, error) {
+	k := projectConfigKey{projectId, name}
+
+	projectConfigMutex.Lock()
+	cached, ok := projectConfigCache[k]
+	projectConfigMutex.Unlock()
+
+	if !ok || time.Since(cached.loaded) > projectConfigTTL {
+		var config []byte
+		query := `SELECT config FROM project_config WHERE project_id = ? AND name = ?`
+		err := db.QueryRowContext(ctx, numberArgs(query), projectId, name).Scan(&config)
+		if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+		cached = projectConfigValue{config: config, loaded: time.Now()}
+
+		projectConfigMutex.Lock()
+		projectConfigCache[k] = cached
+		projectConfigMutex.Unlock()
+	}
+
+	if cached.config == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(cached.config, v)
+}
+
+func PutProjectConfig(projectId int32, name string, v interface{}, tx *sql.Tx, ctx context.Context) error {
+	config, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO project_config (project_id, name, config, updated) VALUES (?, ?, ?, ?)` +
+		` ON CONFLICT (project_id, name) DO UPDATE SET config = EXCLUDED.config, updated = EXCLUDED.updated`
+	_, err = execTxContext(tx, ctx, query, projectId, name, config, time.Now())
+	return err
+}
+
+func DeleteProjectConfig(projectId int32, name string, tx *sql.Tx, ctx context.Context) error {
+	query := `DELETE FROM project_config WHERE project_id = ? AND name = ?`
+	_, err := execTxContext(tx, ctx, query, projectId, name)
+	return err
+}
+
+// ForgetProjectConfig drops the cached project config, to be called once a change
+// to it is committed so that a concurrent Get can't cache the old one meanwhile.
+func ForgetProjectConfig(projectId int32, name string) {
+	projectConfigMutex.Lock()
+	delete(projectConfigCache, projectConfigKey{projectId, name})
+	projectConfigMutex.Unlock()
+}
@@ -0,0 +1,58 @@
+package query
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLParen
+	tokenRParen
+	tokenWord
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) isKeyword(keyword string) bool {
+	return t.kind == tokenWord && t.text == keyword
+}
+
+// lex splits the query into parentheses and words. A word runs up to a space or
+// parenthesis, except within a "quoted" part.
+func lex(s string) ([]token, error) {
+	tokens := make([]token, 0, 8)
+	i := 0
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		default:
+			start := i
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' && s[i] != '\r' && s[i] != '\n' &&
+				s[i] != '(' && s[i] != ')' {
+				if s[i] == '"' {
+					quote := i
+					for i++; i < len(s) && s[i] != '"'; i++ {
+						if s[i] == '\\' {
+							i++
+						}
+					}
+					if i >= len(s) {
+						return nil, errorAt(quote, "unterminated quote")
+					}
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, s[start:i], start})
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(s)}), nil
+}
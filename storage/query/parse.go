@@ -0,0 +1,339 @@
+// Package query parses the GET /entries 'search' query language, e.g.
+//
+//	type:upload AND actor:user:1234 AND context.filesize>5000 AND NOT source:img-*
+//
+// Terms are 'field op value' where op is one of : = != > >= < <=, combined with
+// AND (or just a space), OR, NOT and parentheses. Values can be "quoted", and an
+// unquoted * is a wildcard. A tag's key and value can each be quoted, e.g.
+// tag:"key":"value". Fields are source, type, actor, object, target,
+// trace_id, parent_span_id, span_id, seq, repeated, published, tag and context
+// paths like context.file.size. A term without a known field, e.g. 'priority:high',
+// is a tag search.
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError reports the position (1-based) in the query where it failed.
+type SyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("search syntax error at position %d: %s", e.Pos, e.Message)
+}
+
+func errorAt(pos int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Pos: pos + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+type Node interface {
+	node()
+}
+
+type And struct {
+	Left, Right Node
+}
+
+type Or struct {
+	Left, Right Node
+}
+
+type Not struct {
+	X Node
+}
+
+// Compare is a 'field op value' term. Path is set for context fields.
+type Compare struct {
+	Field  string
+	Path   []string
+	Op     string
+	Value  string
+	Quoted bool
+	Pos    int
+}
+
+// Tag matches entries in a trace or span with the tag 'key:value' (or any key if Key is "").
+type Tag struct {
+	Key   string
+	Value string
+	Pos   int
+}
+
+func (*And) node()     {}
+func (*Or) node()      {}
+func (*Not) node()     {}
+func (*Compare) node() {}
+func (*Tag) node()     {}
+
+var Fields = []string{"source", "type", "actor", "object", "target",
+	"trace_id", "parent_span_id", "span_id", "seq", "repeated", "published", "tag"}
+
+var ops = []string{"!=", ">=", "<=", ":", "=", ">", "<"}
+
+// Parse parses the query, returning nil for an empty query.
+func Parse(s string) (Node, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, nil
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, errorAt(t.pos, "unexpected '%s'", t.text)
+	}
+	return n, nil
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.isKeyword("AND") {
+			p.next()
+		} else if t.kind == tokenEOF || t.kind == tokenRParen || t.isKeyword("OR") {
+			return left, nil
+		}
+		// adjacent terms are implicitly ANDed
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{left, right}
+	}
+}
+
+func (p *parser) parseNot() (Node, error) {
+	if p.peek().isKeyword("NOT") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.kind != tokenRParen {
+			return nil, errorAt(r.pos, "expected ')' to close '(' at position %d", t.pos+1)
+		}
+		return n, nil
+	case tokenWord:
+		if t.isKeyword("AND") || t.isKeyword("OR") {
+			return nil, errorAt(t.pos, "expected a term before '%s'", t.text)
+		}
+		return parseTerm(t)
+	case tokenEOF:
+		return nil, errorAt(t.pos, "unexpected end of search, expected a term")
+	default:
+		return nil, errorAt(t.pos, "unexpected '%s'", t.text)
+	}
+}
+
+// parseTerm splits a word into 'field op value', or else a tag search.
+func parseTerm(t token) (Node, error) {
+	word := t.text
+
+	i := 0
+	for i < len(word) && isFieldChar(word[i]) {
+		i++
+	}
+	field := word[:i]
+	op := ""
+	for _, o := range ops {
+		if strings.HasPrefix(word[i:], o) {
+			op = o
+			break
+		}
+	}
+
+	if field == "" || op == "" || !isField(field) {
+		if op != "" && op != ":" && field != "" {
+			return nil, errorAt(t.pos, "unknown field '%s'", field)
+		}
+		// a bare tag value or 'key:value'
+		value, quoted, err := unquote(word, t.pos)
+		if err != nil {
+			return nil, err
+		}
+		if quoted {
+			return &Tag{Value: value, Pos: t.pos}, nil
+		}
+		key, value := splitTag(value)
+		return &Tag{Key: key, Value: value, Pos: t.pos}, nil
+	}
+
+	valuePos := t.pos + i + len(op)
+	if word[i+len(op):] == "" {
+		return nil, errorAt(valuePos, "missing value for '%s'", field)
+	}
+	if field == "tag" {
+		if op != ":" && op != "=" {
+			return nil, errorAt(t.pos+i, "'tag' only supports ':'")
+		}
+		return parseTag(word[i+len(op):], valuePos, t.pos)
+	}
+
+	value, quoted, err := unquote(word[i+len(op):], valuePos)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Compare{Field: field, Op: op, Value: value, Quoted: quoted, Pos: t.pos}
+	if strings.HasPrefix(field, "context.") {
+		c.Field = "context"
+		c.Path = strings.Split(field[len("context."):], ".")
+		for _, segment := range c.Path {
+			if segment == "" {
+				return nil, errorAt(t.pos, "empty key in context path '%s'", field)
+			}
+		}
+	}
+	return c, nil
+}
+
+func isFieldChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-'
+}
+
+func isField(field string) bool {
+	if strings.HasPrefix(field, "context.") {
+		return true
+	}
+	for _, f := range Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTag parses the 'value' or 'key:value' of a tag term, where the key and
+// value can each be quoted, e.g. "a key":"a value". A quoted value alone matches
+// any key, even if it contains ':'.
+func parseTag(s string, pos, termPos int) (Node, error) {
+	key := ""
+	if j := tagKeyEnd(s); j != -1 {
+		k, _, err := unquote(s[:j], pos)
+		if err != nil {
+			return nil, err
+		}
+		key, s, pos = k, s[j+1:], pos+j+1
+	}
+	value, _, err := unquote(s, pos)
+	if err != nil {
+		return nil, err
+	}
+	return &Tag{Key: key, Value: value, Pos: termPos}, nil
+}
+
+// tagKeyEnd returns the index of the first ':' outside of quotes, or -1.
+func tagKeyEnd(s string) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitTag(tag string) (key, value string) {
+	if i := strings.Index(tag, ":"); i != -1 {
+		return tag[:i], tag[i+1:]
+	}
+	return "", tag
+}
+
+// Quote quotes the value, escaping '"' and '\\', so that it's matched exactly.
+func Quote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+}
+
+// unquote returns the value of a "quoted" string with \" and \\ escapes, or s if it isn't quoted.
+func unquote(s string, pos int) (string, bool, error) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s, `"`); i != -1 {
+			return "", false, errorAt(pos+i, "quote in the middle of a value")
+		}
+		return s, false, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			if i != len(s)-1 {
+				return "", false, errorAt(pos+i+1, "unexpected text after closing quote")
+			}
+			return b.String(), true, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false, errorAt(pos, "unterminated quote")
+}
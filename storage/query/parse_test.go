@@ -0,0 +1,143 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// format writes the node in prefix form with each term's position, e.g.
+// (AND type:"upload"@0 (NOT tag[""]"vip"@16)), to compare parses concisely.
+func format(n Node) string {
+	switch n := n.(type) {
+	case nil:
+		return "nil"
+	case *And:
+		return "(AND " + format(n.Left) + " " + format(n.Right) + ")"
+	case *Or:
+		return "(OR " + format(n.Left) + " " + format(n.Right) + ")"
+	case *Not:
+		return "(NOT " + format(n.X) + ")"
+	case *Tag:
+		return fmt.Sprintf("tag[%q]%q@%d", n.Key, n.Value, n.Pos)
+	case *Compare:
+		field := n.Field
+		if n.Path != nil {
+			field += "[" + strings.Join(n.Path, ",") + "]"
+		}
+		quoted := ""
+		if n.Quoted {
+			quoted = "quoted "
+		}
+		return fmt.Sprintf("%s%s%s%q@%d", field, n.Op, quoted, n.Value, n.Pos)
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		search string
+		want   string
+	}{
+		{"", "nil"},
+		{"  ", "nil"},
+		{"type:upload", `type:"upload"@0`},
+
+		// precedence: NOT binds tighter than AND (or a space), which binds tighter than OR
+		{"a:1 b:2", `(AND tag["a"]"1"@0 tag["b"]"2"@4)`},
+		{"type:a AND type:b OR type:c", `(OR (AND type:"a"@0 type:"b"@11) type:"c"@21)`},
+		{"type:a OR type:b AND type:c", `(OR type:"a"@0 (AND type:"b"@10 type:"c"@21))`},
+		{"type:a OR type:b type:c", `(OR type:"a"@0 (AND type:"b"@10 type:"c"@17))`},
+		{"NOT type:a AND type:b", `(AND (NOT type:"a"@4) type:"b"@15)`},
+		{"NOT NOT type:a", `(NOT (NOT type:"a"@8))`},
+		{"(type:a OR type:b) AND type:c", `(AND (OR type:"a"@1 type:"b"@11) type:"c"@23)`},
+		{"type:a AND type:b AND type:c", `(AND (AND type:"a"@0 type:"b"@11) type:"c"@22)`},
+
+		// operators
+		{"seq>=10", `seq>="10"@0`},
+		{"seq<10", `seq<"10"@0`},
+		{"source!=web", `source!="web"@0`},
+		{"context.file.size>5000", `context[file,size]>"5000"@0`},
+
+		// quotes
+		{`type:"an upload"`, `type:quoted "an upload"@0`},
+		{`type:"a (b) OR c"`, `type:quoted "a (b) OR c"@0`},
+		{`type:"say \"hi\""`, `type:quoted "say \"hi\""@0`},
+		{`type:"back\\slash"`, `type:quoted "back\\slash"@0`},
+		{`type:""`, `type:quoted ""@0`},
+		{`type:"img-*"`, `type:quoted "img-*"@0`},
+
+		// tags
+		{"priority:high", `tag["priority"]"high"@0`},
+		{"vip", `tag[""]"vip"@0`},
+		{`"cat.jpg"`, `tag[""]"cat.jpg"@0`},
+		{"tag:vip", `tag[""]"vip"@0`},
+		{"tag:priority:high", `tag["priority"]"high"@0`},
+		{"tag:a:b:c", `tag["a"]"b:c"@0`},
+		{`tag:"a:b"`, `tag[""]"a:b"@0`},
+		{`tag:"priority":"very high"`, `tag["priority"]"very high"@0`},
+		{`tag:priority:"very high"`, `tag["priority"]"very high"@0`},
+		{`tag:"a:b":"c\"d"`, `tag["a:b"]"c\"d"@0`},
+		{`tag:"k":""`, `tag["k"]""@0`},
+	}
+	for _, test := range tests {
+		n, err := Parse(test.search)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.search, err)
+			continue
+		}
+		if got := format(n); got != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.search, got, test.want)
+		}
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	tests := []struct {
+		search  string
+		pos     int
+		message string
+	}{
+		{"(type:a", 8, "expected ')' to close '(' at position 1"},
+		{"type:a)", 7, "unexpected ')'"},
+		{"AND type:a", 1, "expected a term before 'AND'"},
+		{"type:a OR", 10, "unexpected end of search, expected a term"},
+		{"type:a AND OR type:b", 12, "expected a term before 'OR'"},
+		{"NOT", 4, "unexpected end of search, expected a term"},
+		{"()", 2, "unexpected ')'"},
+		{`type:"upload`, 6, "unterminated quote"},
+		{`type:up"load"`, 8, "quote in the middle of a value"},
+		{`type:"up"load`, 10, "unexpected text after closing quote"},
+		{"type:", 6, "missing value for 'type'"},
+		{"priority>high", 1, "unknown field 'priority'"},
+		{"tag>a", 4, "'tag' only supports ':'"},
+		{"tag:", 5, "missing value for 'tag'"},
+		{`tag:"k"x:v`, 8, "unexpected text after closing quote"},
+		{`tag:k:v"x"`, 8, "quote in the middle of a value"},
+		{"context.a..b:1", 1, "empty key in context path 'context.a..b'"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.search)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%q) error = %v, want a SyntaxError", test.search, err)
+			continue
+		}
+		if e.Pos != test.pos || e.Message != test.message {
+			t.Errorf("Parse(%q) error at %d %q, want at %d %q", test.search, e.Pos, e.Message, test.pos, test.message)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, value := range []string{"", "vip", "very high", `say "hi"`, `back\slash`, `\"`, "a:b", "(x) OR y*"} {
+		n, err := Parse("tag:" + Quote(value))
+		if err != nil {
+			t.Errorf("Parse(tag:%s): %v", Quote(value), err)
+			continue
+		}
+		if tag, ok := n.(*Tag); !ok || tag.Key != "" || tag.Value != value {
+			t.Errorf("Parse(tag:%s) = %s, want value %q", Quote(value), format(n), value)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var columns = map[string]string{
+	"source":         "e.source",
+	"type":           "e.type",
+	"actor":          "e.actor",
+	"object":         "e.object",
+	"target":         "e.target",
+	"trace_id":       "e.trace_id",
+	"parent_span_id": "e.parent_span_id",
+	"span_id":        "e.span_id",
+	"seq":            "e.seq",
+	"repeated":       "e.repeated",
+	"published":      "e.published",
+}
+
+var sqlOps = map[string]string{":": "=", "=": "=", "!=": "<>", ">": ">", ">=": ">=", "<": "<", "<=": "<="}
+
+// SQL returns the condition for the query node on table alias 'e' (entry), with
+// '?' placeholders for the returned args. Values are never put into the SQL.
+func SQL(n Node) (string, []interface{}, error) {
+	b := &builder{}
+	if err := b.write(n); err != nil {
+		return "", nil, err
+	}
+	return b.sql.String(), b.args, nil
+}
+
+type builder struct {
+	sql  strings.Builder
+	args []interface{}
+}
+
+func (b *builder) arg(value interface{}) {
+	b.sql.WriteString("?")
+	b.args = append(b.args, value)
+}
+
+func (b *builder) write(n Node) error {
+	switch n := n.(type) {
+	case *And:
+		return b.binary(n.Left, " AND ", n.Right)
+	case *Or:
+		return b.binary(n.Left, " OR ", n.Right)
+	case *Not:
+		b.sql.WriteString("NOT (")
+		if err := b.write(n.X); err != nil {
+			return err
+		}
+		b.sql.WriteString(")")
+	case *Tag:
+		b.sql.WriteString("EXISTS (SELECT 1 FROM span_tag t WHERE t.project_id = e.project_id")
+		if n.Key != "" {
+			b.sql.WriteString(" AND t.key = ")
+			b.arg(n.Key)
+		}
+		b.sql.WriteString(" AND t.value = ")
+		b.arg(n.Value)
+		b.sql.WriteString(" AND (t.trace_id = e.trace_id OR t.span_id = e.parent_span_id OR t.span_id = e.span_id))")
+	case *Compare:
+		if n.Field == "context" {
+			return b.context(n)
+		}
+		return b.column(n)
+	}
+	return nil
+}
+
+func (b *builder) binary(left Node, op string, right Node) error {
+	b.sql.WriteString("(")
+	if err := b.write(left); err != nil {
+		return err
+	}
+	b.sql.WriteString(op)
+	if err := b.write(right); err != nil {
+		return err
+	}
+	b.sql.WriteString(")")
+	return nil
+}
+
+func (b *builder) column(n *Compare) error {
+	column := columns[n.Field]
+
+	var value interface{} = n.Value
+	switch n.Field {
+	case "seq", "repeated":
+		i, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			return errorAt(n.Pos, "'%s' must be an integer", n.Field)
+		}
+		value = i
+	case "published":
+		t, err := parseTime(n.Value)
+		if err != nil {
+			return errorAt(n.Pos, "'published' must be in RFC 3339 format")
+		}
+		value = t
+	default:
+		if n.isWildcard() {
+			b.sql.WriteString(column + n.likeOp())
+			b.arg(likePattern(n.Value))
+			return nil
+		}
+	}
+
+	b.sql.WriteString(column + " " + sqlOps[n.Op] + " ")
+	b.arg(value)
+	return nil
+}
+
+func (b *builder) context(n *Compare) error {
+	path := pq.Array(n.Path)
+
+	switch {
+	case n.isExists():
+		b.sql.WriteString("e.context #> ")
+		b.arg(path)
+		b.sql.WriteString("::text[] IS NOT NULL")
+	case n.isWildcard():
+		b.sql.WriteString("e.context #>> ")
+		b.arg(path)
+		b.sql.WriteString("::text[]" + n.likeOp())
+		b.arg(likePattern(n.Value))
+	case n.Op == ":" || n.Op == "=":
+		b.sql.WriteString("e.context #>> ")
+		b.arg(path)
+		b.sql.WriteString("::text[] = ")
+		b.arg(n.Value)
+	case n.Op == "!=":
+		b.sql.WriteString("e.context #>> ")
+		b.arg(path)
+		b.sql.WriteString("::text[] IS DISTINCT FROM ")
+		b.arg(n.Value)
+	default:
+		if f, err := strconv.ParseFloat(n.Value, 64); err == nil {
+			// compare only numbers numerically, a cast of other values would fail the query
+			b.sql.WriteString("(CASE WHEN jsonb_typeof(e.context #> ")
+			b.arg(path)
+			b.sql.WriteString("::text[]) = 'number' THEN (e.context #>> ")
+			b.arg(path)
+			b.sql.WriteString("::text[])::numeric END) " + sqlOps[n.Op] + " ")
+			b.arg(f)
+		} else {
+			b.sql.WriteString("e.context #>> ")
+			b.arg(path)
+			b.sql.WriteString("::text[] " + sqlOps[n.Op] + " ")
+			b.arg(n.Value)
+		}
+	}
+	return nil
+}
+
+// isExists is true for 'context.key:*' meaning the key is present.
+func (n *Compare) isExists() bool {
+	return n.Field == "context" && n.Value == "*" && !n.Quoted && (n.Op == ":" || n.Op == "=")
+}
+
+func (n *Compare) isWildcard() bool {
+	return !n.Quoted && strings.Contains(n.Value, "*") && (n.Op == ":" || n.Op == "=" || n.Op == "!=")
+}
+
+func (n *Compare) likeOp() string {
+	if n.Op == "!=" {
+		return " NOT LIKE "
+	}
+	return " LIKE "
+}
+
+func likePattern(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `%`, `\%`, -1)
+	value = strings.Replace(value, `_`, `\_`, -1)
+	return strings.Replace(value, "*", "%", -1)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, strings.Replace(value, " ", "T", 1)); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,118 @@
+package query
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const tagSQL = "EXISTS (SELECT 1 FROM span_tag t WHERE t.project_id = e.project_id%s AND t.value = ?" +
+	" AND (t.trace_id = e.trace_id OR t.span_id = e.parent_span_id OR t.span_id = e.span_id))"
+
+func TestSQL(t *testing.T) {
+	path := func(keys ...string) interface{} {
+		return pq.Array(keys)
+	}
+	tests := []struct {
+		search string
+		sql    string
+		args   []interface{}
+	}{
+		{"type:upload", "e.type = ?", []interface{}{"upload"}},
+		{"source!=web", "e.source <> ?", []interface{}{"web"}},
+		{"seq>=10", "e.seq >= ?", []interface{}{int64(10)}},
+		{"repeated>1", "e.repeated > ?", []interface{}{int64(1)}},
+		{"published<2020-01-02", "e.published < ?", []interface{}{time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}},
+		{"published>=2020-01-02T03:04:05Z", "e.published >= ?", []interface{}{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}},
+
+		{"type:a type:b OR NOT type:c", "((e.type = ? AND e.type = ?) OR NOT (e.type = ?))", []interface{}{"a", "b", "c"}},
+		{"type:a AND (type:b OR type:c)", "(e.type = ? AND (e.type = ? OR e.type = ?))", []interface{}{"a", "b", "c"}},
+
+		// wildcards, with LIKE's own special characters escaped
+		{"source:img-*", "e.source LIKE ?", []interface{}{"img-%"}},
+		{"source!=img-*", "e.source NOT LIKE ?", []interface{}{"img-%"}},
+		{`source:50%_off\*`, "e.source LIKE ?", []interface{}{`50\%\_off\\%`}},
+		{`source:"img-*"`, "e.source = ?", []interface{}{"img-*"}},
+		{"source>img-*", "e.source > ?", []interface{}{"img-*"}},
+
+		// context
+		{"context.file.name:*", "e.context #> ?::text[] IS NOT NULL", []interface{}{path("file", "name")}},
+		{`context.file.name:"*"`, "e.context #>> ?::text[] = ?", []interface{}{path("file", "name"), "*"}},
+		{"context.file.name:cat*", "e.context #>> ?::text[] LIKE ?", []interface{}{path("file", "name"), "cat%"}},
+		{"context.file.name:cat.jpg", "e.context #>> ?::text[] = ?", []interface{}{path("file", "name"), "cat.jpg"}},
+		{"context.file.name!=cat.jpg", "e.context #>> ?::text[] IS DISTINCT FROM ?", []interface{}{path("file", "name"), "cat.jpg"}},
+		{"context.size>5000", "(CASE WHEN jsonb_typeof(e.context #> ?::text[]) = 'number' THEN (e.context #>> ?::text[])::numeric END) > ?",
+			[]interface{}{path("size"), path("size"), float64(5000)}},
+		{"context.name<m", "e.context #>> ?::text[] < ?", []interface{}{path("name"), "m"}},
+
+		// tags
+		{"vip", fmt.Sprintf(tagSQL, ""), []interface{}{"vip"}},
+		{"priority:high", fmt.Sprintf(tagSQL, " AND t.key = ?"), []interface{}{"priority", "high"}},
+		{`tag:"a:b"`, fmt.Sprintf(tagSQL, ""), []interface{}{"a:b"}},
+	}
+	for _, test := range tests {
+		n, err := Parse(test.search)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.search, err)
+			continue
+		}
+		sql, args, err := SQL(n)
+		if err != nil {
+			t.Errorf("SQL(%q): %v", test.search, err)
+			continue
+		}
+		if sql != test.sql {
+			t.Errorf("SQL(%q) = %s, want %s", test.search, sql, test.sql)
+		}
+		if !reflect.DeepEqual(values(t, args), values(t, test.args)) {
+			t.Errorf("SQL(%q) args = %v, want %v", test.search, args, test.args)
+		}
+	}
+}
+
+// values converts the args to driver values so that arrays compare by their contents.
+func values(t *testing.T, args []interface{}) []interface{} {
+	vs := make([]interface{}, len(args))
+	for i, arg := range args {
+		vs[i] = arg
+		if v, ok := arg.(driver.Valuer); ok {
+			var err error
+			if vs[i], err = v.Value(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return vs
+}
+
+func TestSQLError(t *testing.T) {
+	tests := []struct {
+		search  string
+		pos     int
+		message string
+	}{
+		{"seq:ten", 1, "'seq' must be an integer"},
+		{"type:a repeated>1.5", 8, "'repeated' must be an integer"},
+		{"published>yesterday", 1, "'published' must be in RFC 3339 format"},
+	}
+	for _, test := range tests {
+		n, err := Parse(test.search)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.search, err)
+			continue
+		}
+		_, _, err = SQL(n)
+		e, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("SQL(%q) error = %v, want a SyntaxError", test.search, err)
+			continue
+		}
+		if e.Pos != test.pos || e.Message != test.message {
+			t.Errorf("SQL(%q) error at %d %q, want at %d %q", test.search, e.Pos, e.Message, test.pos, test.message)
+		}
+	}
+}
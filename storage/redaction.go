@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage/span_tag"
+)
+
+const (
+	RedactionConfig = "redaction"
+	// RedactionSaltConfig is the project's hash key, kept apart from the rules so
+	// that it's never served with them.
+	RedactionSaltConfig = "redaction_salt"
+)
+
+const (
+	RedactDrop       = "drop"
+	RedactMask       = "mask"
+	RedactHash       = "hash"
+	RedactTruncateIP = "truncate_ip"
+)
+
+const redactedMask = "***"
+
+var (
+	redactionFields = []string{"source", "type", "actor", "object", "target"}
+	ipv4Pattern     = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+)
+
+// RedactionRule redacts the Fields (entry fields, or context paths like
+// "context.user.email" where a "*" key matches any key, by default all of them)
+// that match the Pattern regexp (by default the whole value) with the Action:
+//   - drop: remove the context key
+//   - mask: replace the match with "***"
+//   - hash: replace the match with an HMAC-SHA256 of it keyed per project
+//   - truncate_ip: zero the last octet of IPv4 addresses (/24) or IPv6 after /48,
+//     where a value is an IP address or else has IPv4 addresses in it
+//
+// A context path to an object or array applies to all strings within it. Inline
+// tags are redacted as if each were a context key with its value.
+type RedactionRule struct {
+	Fields  []string `json:"fields"`
+	Pattern string   `json:"pattern"`
+	Action  string   `json:"action"`
+}
+
+// Redaction is a project's redaction rules, applied in order to entries before they
+// are stored, with the project's salt (hash key) which is stored separately.
+type Redaction struct {
+	Salt  string          `json:"-"`
+	Rules []RedactionRule `json:"rules"`
+
+	// patterns are the compiled rule patterns, set by Validate
+	patterns []*regexp.Regexp
+}
+
+// RedactionChange is a change to an entry field or context path made by a rule.
+type RedactionChange struct {
+	Rule   int         `json:"rule"`
+	Field  string      `json:"field"`
+	Action string      `json:"action"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Validate checks the rules and compiles their patterns.
+func (r *Redaction) Validate() error {
+	r.patterns = make([]*regexp.Regexp, len(r.Rules))
+	for i, rule := range r.Rules {
+		switch rule.Action {
+		case RedactMask, RedactHash, RedactTruncateIP:
+		case RedactDrop:
+			if len(rule.Fields) == 0 && rule.Pattern == "" {
+				return fmt.Errorf("rule %d: dropping needs 'fields' or a 'pattern'", i)
+			}
+			for _, field := range rule.Fields {
+				if !strings.HasPrefix(field, "context.") {
+					return fmt.Errorf("rule %d: only context keys can be dropped", i)
+				}
+			}
+		default:
+			return fmt.Errorf("rule %d: 'action' must be one of '%s', '%s', '%s', or '%s'",
+				i, RedactDrop, RedactMask, RedactHash, RedactTruncateIP)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("rule %d: 'pattern': %v", i, err)
+			}
+			r.patterns[i] = pattern
+		}
+		for _, field := range rule.Fields {
+			if _, ok := redactionPath(field); !ok {
+				return fmt.Errorf("rule %d: 'fields' must be %s or context.<path>", i,
+					strings.Join(redactionFields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// NewRedactionSalt returns a random salt.
+func NewRedactionSalt() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// CreateRedactionSalt generates the project's salt if it doesn't have one yet, and
+// keeps it otherwise so that hashes stay the same.
+func CreateRedactionSalt(projectId int32, db *sql.DB, ctx context.Context) error {
+	salt, err := NewRedactionSalt()
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(salt)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO project_config (project_id, name, config, updated) VALUES (?, ?, ?, ?)` +
+		` ON CONFLICT (project_id, name) DO NOTHING`
+	if _, err = execContext(db, ctx, query, projectId, RedactionSaltConfig, config, time.Now()); err != nil {
+		return err
+	}
+	ForgetProjectConfig(projectId, RedactionSaltConfig)
+	return nil
+}
+
+// redactionPath returns the context path of a field ("context" is the root), or
+// nil for an entry field.
+func redactionPath(field string) ([]string, bool) {
+	for _, f := range redactionFields {
+		if field == f {
+			return nil, true
+		}
+	}
+	if field == "context" {
+		return []string{}, true
+	}
+	if strings.HasPrefix(field, "context.") {
+		path, err := ParseContextPath(strings.TrimPrefix(field, "context."))
+		return path, err == nil
+	}
+	return nil, false
+}
+
+type cachedRedaction struct {
+	config    []byte
+	salt      string
+	redaction *Redaction
+}
+
+var (
+	redactionsMutex sync.Mutex
+	redactions      = make(map[int32]cachedRedaction)
+)
+
+// GetRedaction returns the project's redaction with its salt, or nil if it has none.
+// Its patterns are compiled again only when the project's config changes.
+func GetRedaction(projectId int32, db queryRower, ctx context.Context) (*Redaction, error) {
+	var config json.RawMessage
+	if ok, err := GetProjectConfig(projectId, RedactionConfig, &config, db, ctx); err != nil {
+		return nil, err
+	} else if !ok {
+		redactionsMutex.Lock()
+		delete(redactions, projectId)
+		redactionsMutex.Unlock()
+		return nil, nil
+	}
+	var salt string
+	if ok, err := GetProjectConfig(projectId, RedactionSaltConfig, &salt, db, ctx); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("project %d has redaction rules but no salt", projectId)
+	}
+
+	redactionsMutex.Lock()
+	cached, ok := redactions[projectId]
+	redactionsMutex.Unlock()
+	if ok && bytes.Equal(cached.config, config) && cached.salt == salt {
+		return cached.redaction, nil
+	}
+
+	r := &Redaction{}
+	if err := json.Unmarshal(config, r); err != nil {
+		return nil, err
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	r.Salt = salt
+	redactionsMutex.Lock()
+	redactions[projectId] = cachedRedaction{config: config, salt: salt, redaction: r}
+	redactionsMutex.Unlock()
+	return r, nil
+}
+
+// Apply redacts the entry in place and returns the changes made. The redaction
+// is expected to have been validated.
+func (r Redaction) Apply(e *Entry) []RedactionChange {
+	changes := make([]RedactionChange, 0)
+	for i, rule := range r.Rules {
+		a := redactor{rule: rule, index: i, salt: r.Salt, root: "context", changes: &changes}
+		if rule.Pattern != "" {
+			a.pattern = r.patterns[i]
+		}
+
+		fields := map[string]*string{"source": &e.Source, "type": &e.Type, "actor": &e.Actor,
+			"object": &e.Object, "target": &e.Target}
+		paths := make([][]string, 0, len(rule.Fields))
+		if len(rule.Fields) == 0 {
+			if rule.Action != RedactDrop {
+				for _, f := range redactionFields {
+					a.field(f, fields[f])
+				}
+			}
+			paths = append(paths, []string{})
+		}
+		for _, field := range rule.Fields {
+			if path, _ := redactionPath(field); path != nil {
+				paths = append(paths, path)
+			} else {
+				a.field(field, fields[field])
+			}
+		}
+
+		if e.Context != nil {
+			a.paths(map[string]interface{}(e.Context), paths)
+		}
+		if len(e.Tags) > 0 {
+			a.root = "tags"
+			a.tags(e, paths)
+		}
+	}
+	return changes
+}
+
+// paths applies the rule to the values of m at the context paths.
+func (a redactor) paths(m map[string]interface{}, paths [][]string) {
+	for _, path := range paths {
+		if len(path) == 0 && a.rule.Action == RedactDrop {
+			a.dropMatching(m, []string{})
+			continue
+		}
+		a.walk(m, []string{}, path)
+	}
+}
+
+// tags applies the rule to the entry's inline tags as if each were a context key
+// with its value, so that they aren't a way around redaction. A dropped tag is removed.
+func (a redactor) tags(e *Entry, paths [][]string) {
+	tags := make([]string, 0, len(e.Tags))
+	for _, tag := range e.Tags {
+		key, value := span_tag.ParseTag(tag)
+		m := map[string]interface{}{key: value}
+		a.paths(m, paths)
+		if value, ok := m[key].(string); ok {
+			if key != "" {
+				value = key + ":" + value
+			}
+			tags = append(tags, value)
+		}
+	}
+	e.Tags = tags
+}
+
+type redactor struct {
+	rule    RedactionRule
+	index   int
+	pattern *regexp.Regexp
+	salt    string
+	// root is where the paths of changes are, "context" or "tags"
+	root    string
+	changes *[]RedactionChange
+}
+
+func (a redactor) field(name string, value *string) {
+	if after, ok := a.redact(*value); ok {
+		*a.changes = append(*a.changes, RedactionChange{Rule: a.index, Field: name, Action: a.rule.Action,
+			Before: *value, After: after})
+		*value = after
+	}
+}
+
+// walk applies the rule to the values of m at the remaining path.
+func (a redactor) walk(m map[string]interface{}, prefix, path []string) {
+	if len(path) == 0 {
+		for _, key := range sortedKeys(m) {
+			m[key] = a.tree(m[key], childPath(prefix, key))
+		}
+		return
+	}
+	for _, key := range sortedKeys(m) {
+		if path[0] != "*" && path[0] != key {
+			continue
+		}
+		p := childPath(prefix, key)
+		if len(path) == 1 && a.rule.Action == RedactDrop {
+			s, isString := m[key].(string)
+			if a.pattern == nil || isString && a.pattern.MatchString(s) {
+				a.change(p, m[key], nil)
+				delete(m, key)
+			}
+			continue
+		}
+		if len(path) == 1 {
+			m[key] = a.tree(m[key], p)
+			continue
+		}
+		switch v := m[key].(type) {
+		case map[string]interface{}:
+			a.walk(v, p, path[1:])
+		case []interface{}:
+			for _, e := range v {
+				if em, ok := e.(map[string]interface{}); ok {
+					a.walk(em, p, path[1:])
+				}
+			}
+		}
+	}
+}
+
+// dropMatching drops the keys of string values matching the pattern anywhere in m.
+func (a redactor) dropMatching(m map[string]interface{}, prefix []string) {
+	for _, key := range sortedKeys(m) {
+		p := childPath(prefix, key)
+		switch v := m[key].(type) {
+		case string:
+			if a.pattern == nil || a.pattern.MatchString(v) {
+				a.change(p, v, nil)
+				delete(m, key)
+			}
+		case map[string]interface{}:
+			a.dropMatching(v, p)
+		case []interface{}:
+			for _, e := range v {
+				if em, ok := e.(map[string]interface{}); ok {
+					a.dropMatching(em, p)
+				}
+			}
+		}
+	}
+}
+
+// tree returns the value with the rule applied to all the strings in it.
+func (a redactor) tree(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case string:
+		if after, ok := a.redact(v); ok {
+			a.change(path, v, after)
+			return after
+		}
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			v[key] = a.tree(v[key], childPath(path, key))
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = a.tree(v[i], path)
+		}
+	}
+	return value
+}
+
+func (a redactor) change(path []string, before, after interface{}) {
+	*a.changes = append(*a.changes, RedactionChange{Rule: a.index, Field: strings.Join(append([]string{a.root}, path...), "."),
+		Action: a.rule.Action, Before: before, After: after})
+}
+
+// redact returns the redacted string and true if it changed.
+func (a redactor) redact(s string) (string, bool) {
+	var after string
+	if a.pattern != nil {
+		after = a.pattern.ReplaceAllStringFunc(s, a.transform)
+	} else {
+		after = a.transform(s)
+	}
+	return after, after != s
+}
+
+func (a redactor) transform(s string) string {
+	switch a.rule.Action {
+	case RedactMask:
+		return redactedMask
+	case RedactHash:
+		mac := hmac.New(sha256.New, []byte(a.salt))
+		mac.Write([]byte(s))
+		return "hash:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	case RedactTruncateIP:
+		return truncateIPs(s)
+	}
+	return s
+}
+
+// truncateIPs truncates the IP address s, or the IPv4 addresses in it.
+func truncateIPs(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return truncateIP(ip)
+	}
+	return ipv4Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		if ip := net.ParseIP(match); ip != nil {
+			return truncateIP(ip)
+		}
+		return match
+	})
+}
+
+func truncateIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func childPath(path []string, key string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), key)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
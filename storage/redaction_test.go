@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestRedactionApply dry-runs rules on an entry, as POST /projects/{id}/redaction/dry-run does.
+func TestRedactionApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		entry   string
+		want    string
+		changes []string
+	}{
+		{
+			name:    "truncate IPv4",
+			rules:   `[{"fields": ["context.ip"], "action": "truncate_ip"}]`,
+			entry:   `{"context": {"ip": "203.0.113.77"}}`,
+			want:    `{"context": {"ip": "203.0.113.0"}}`,
+			changes: []string{"context.ip"},
+		},
+		{
+			name:    "truncate IPv6",
+			rules:   `[{"fields": ["context.ip"], "action": "truncate_ip"}]`,
+			entry:   `{"context": {"ip": "2001:db8:85a3:8d3:1319:8a2e:370:7348"}}`,
+			want:    `{"context": {"ip": "2001:db8:85a3::"}}`,
+			changes: []string{"context.ip"},
+		},
+		{
+			name:    "truncate short IPv6",
+			rules:   `[{"fields": ["context.ip"], "action": "truncate_ip"}]`,
+			entry:   `{"context": {"ip": "2001:db8::1"}}`,
+			want:    `{"context": {"ip": "2001:db8::"}}`,
+			changes: []string{"context.ip"},
+		},
+		{
+			name:    "truncate IPv4 in text",
+			rules:   `[{"action": "truncate_ip"}]`,
+			entry:   `{"actor": "user:1", "context": {"msg": "from 198.51.100.9 via 10.0.0.1"}}`,
+			want:    `{"actor": "user:1", "context": {"msg": "from 198.51.100.0 via 10.0.0.0"}}`,
+			changes: []string{"context.msg"},
+		},
+		{
+			name:    "mask pattern",
+			rules:   `[{"pattern": "\\b\\d{13,16}\\b", "action": "mask"}]`,
+			entry:   `{"object": "card 4111111111111111", "context": {"n": 4111111111111111, "card": "4111111111111111"}}`,
+			want:    `{"object": "card ***", "context": {"n": 4111111111111111, "card": "***"}}`,
+			changes: []string{"object", "context.card"},
+		},
+		{
+			name:    "drop",
+			rules:   `[{"fields": ["context.*.token"], "action": "drop"}]`,
+			entry:   `{"context": {"a": {"token": "x", "id": 1}, "b": [{"token": "y"}], "token": "z"}}`,
+			want:    `{"context": {"a": {"id": 1}, "b": [{}], "token": "z"}}`,
+			changes: []string{"context.a.token", "context.b.token"},
+		},
+		{
+			name:    "tags",
+			rules:   `[{"fields": ["context.ip"], "action": "truncate_ip"}, {"fields": ["context.token"], "action": "drop"}]`,
+			entry:   `{"trace_id": "t1", "tags": ["ip:2001:db8::1", "token:x", "vip"]}`,
+			want:    `{"trace_id": "t1", "tags": ["ip:2001:db8::", "vip"]}`,
+			changes: []string{"tags.ip", "tags.token"},
+		},
+	}
+	for _, test := range tests {
+		r := &Redaction{Salt: "salt"}
+		if err := json.Unmarshal([]byte(test.rules), &r.Rules); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := r.Validate(); err != nil {
+			t.Errorf("%s: Validate: %v", test.name, err)
+			continue
+		}
+		var e, want Entry
+		if err := json.Unmarshal([]byte(test.entry), &e); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		changes := r.Apply(&e)
+		if !reflect.DeepEqual(e, want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, e, want)
+		}
+		fields := make([]string, 0, len(changes))
+		for _, c := range changes {
+			fields = append(fields, c.Field)
+		}
+		if !reflect.DeepEqual(fields, test.changes) {
+			t.Errorf("%s: changed %v, want %v", test.name, fields, test.changes)
+		}
+	}
+}
+
+func TestRedactionHash(t *testing.T) {
+	r := &Redaction{Salt: "salt", Rules: []RedactionRule{{Fields: []string{"actor"}, Action: RedactHash}}}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e1, e2, e3 := Entry{Actor: "a@example.com"}, Entry{Actor: "a@example.com"}, Entry{Actor: "b@example.com"}
+	r.Apply(&e1)
+	r.Apply(&e2)
+	r.Apply(&e3)
+	if e1.Actor == "a@example.com" || e1.Actor != e2.Actor || e1.Actor == e3.Actor {
+		t.Errorf("hashes %q, %q, %q: want equal values to hash equally and differ from others", e1.Actor, e2.Actor, e3.Actor)
+	}
+
+	r.Salt = "pepper"
+	e4 := Entry{Actor: "a@example.com"}
+	r.Apply(&e4)
+	if e4.Actor == e1.Actor {
+		t.Errorf("hash %q with another salt: want it to differ", e4.Actor)
+	}
+}
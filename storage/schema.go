@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const SchemasConfig = "schemas"
+
+const (
+	// SchemaEnforce rejects entries that don't match their type's schema.
+	SchemaEnforce = "enforce"
+	// SchemaWarn accepts them tagged SchemaInvalidTag, with the violations in their
+	// context at SchemaErrorsKey unless the key is already used.
+	SchemaWarn = "warn"
+)
+
+const (
+	SchemaInvalidTag = "schema:invalid"
+	SchemaErrorsKey  = "schema_errors"
+)
+
+// Schema constrains the entries of a type: their Context by a JSON Schema, and
+// the Actor, Object and Target by formats such as "user:<int>", where the
+// placeholders are <int>, <uuid>, <hex>, <word> (letters, digits, '_' and '-')
+// and <any>. A value must match one of the formats of its field, if it has any;
+// Required lists those of actor, object and target that mustn't be empty.
+type Schema struct {
+	Mode        string      `json:"mode"`
+	Description string      `json:"description,omitempty"`
+	Context     *JSONSchema `json:"context,omitempty"`
+	Actor       []string    `json:"actor,omitempty"`
+	Object      []string    `json:"object,omitempty"`
+	Target      []string    `json:"target,omitempty"`
+	Required    []string    `json:"required,omitempty"`
+}
+
+// Schemas is a project's schema registry, by entry type.
+type Schemas struct {
+	Types map[string]*Schema `json:"types"`
+}
+
+// SchemaField is a field described by a schema, for discovering the fields of a type.
+type SchemaField struct {
+	Field       string          `json:"field"`
+	Type        JSONSchemaTypes `json:"type,omitempty"`
+	Formats     []string        `json:"formats,omitempty"`
+	Required    bool            `json:"required"`
+	Description string          `json:"description,omitempty"`
+}
+
+var schemaFormatPlaceholders = map[string]string{
+	"<int>":  `-?\d+`,
+	"<uuid>": `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	"<hex>":  `[0-9a-fA-F]+`,
+	"<word>": `[\w-]+`,
+	"<any>":  `.+`,
+}
+
+var schemaPlaceholder = regexp.MustCompile(`<\w+>`)
+
+func (s *Schemas) Validate() error {
+	for _, typ := range s.types() {
+		schema := s.Types[typ]
+		if schema == nil {
+			return fmt.Errorf("type '%s': schema is null", typ)
+		}
+		if schema.Mode != SchemaEnforce && schema.Mode != SchemaWarn {
+			return fmt.Errorf("type '%s': 'mode' must be '%s' or '%s'", typ, SchemaEnforce, SchemaWarn)
+		}
+		if schema.Context != nil {
+			if err := schema.Context.check("context"); err != nil {
+				return fmt.Errorf("type '%s': %v", typ, err)
+			}
+		}
+		for _, formats := range [][]string{schema.Actor, schema.Object, schema.Target} {
+			for _, format := range formats {
+				if _, err := schemaFormatPattern(format); err != nil {
+					return fmt.Errorf("type '%s': %v", typ, err)
+				}
+			}
+		}
+		for _, field := range schema.Required {
+			if field != "actor" && field != "object" && field != "target" {
+				return fmt.Errorf("type '%s': 'required' may only have 'actor', 'object' and 'target'", typ)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schemas) types() []string {
+	types := make([]string, 0, len(s.Types))
+	for typ := range s.Types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// schemaFormatPattern returns the pattern matching the format.
+func schemaFormatPattern(format string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range schemaPlaceholder.FindAllStringIndex(format, -1) {
+		placeholder := format[loc[0]:loc[1]]
+		pattern, ok := schemaFormatPlaceholders[placeholder]
+		if !ok {
+			return "", fmt.Errorf("format '%s' has an unknown placeholder %s", format, placeholder)
+		}
+		b.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+		b.WriteString(pattern)
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(format[last:]))
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+func GetSchemas(projectId int32, db queryRower, ctx context.Context) (*Schemas, error) {
+	var s Schemas
+	if ok, err := GetProjectConfig(projectId, SchemasConfig, &s, db, ctx); !ok || err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Check returns the violations of the schema by the entry, in field order.
+func (s *Schema) Check(e Entry) []FieldError {
+	errs := make([]FieldError, 0)
+	fields := []struct {
+		name    string
+		value   string
+		formats []string
+	}{{"actor", e.Actor, s.Actor}, {"object", e.Object, s.Object}, {"target", e.Target, s.Target}}
+	for _, f := range fields {
+		if f.value == "" {
+			if containsString(s.Required, f.name) {
+				errs = append(errs, FieldError{Field: f.name, Message: "is required"})
+			}
+			continue
+		}
+		if len(f.formats) > 0 && !matchesFormat(f.value, f.formats) {
+			errs = append(errs, FieldError{Field: f.name,
+				Message: fmt.Sprintf("must match '%s'", strings.Join(f.formats, "' or '"))})
+		}
+	}
+
+	if s.Context != nil {
+		var c interface{} = map[string]interface{}(e.Context)
+		if e.Context == nil {
+			c = map[string]interface{}{}
+		}
+		s.Context.validate(c, "context", &errs)
+	}
+	return errs
+}
+
+func matchesFormat(value string, formats []string) bool {
+	for _, format := range formats {
+		pattern, err := schemaFormatPattern(format)
+		if err != nil {
+			continue
+		}
+		if re, err := compilePattern(pattern); err == nil && re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields returns the fields described by the schema.
+func (s *Schema) Fields() []SchemaField {
+	fields := make([]SchemaField, 0)
+	for _, f := range []struct {
+		name    string
+		formats []string
+	}{{"actor", s.Actor}, {"object", s.Object}, {"target", s.Target}} {
+		if len(f.formats) > 0 || containsString(s.Required, f.name) {
+			fields = append(fields, SchemaField{Field: f.name, Type: JSONSchemaTypes{"string"}, Formats: f.formats,
+				Required: containsString(s.Required, f.name)})
+		}
+	}
+	if s.Context != nil {
+		s.Context.fields("context", false, &fields)
+	}
+	return fields
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The service map has an edge from the source of a parent span to the source of
+// each child span in another source, e.g. web-browser -> api-server -> image-svc.
+// UpdateServiceMap aggregates new entries into per-minute service_edge rows so
+// that GetServiceMap only sums up the rows in its window.
+//
+// Each call is counted once: a new entry as 1 plus the repeats it was created with,
+// and the repeats later collapsed into it from entry_repeat, in the minute they were
+// published. A child whose parent hasn't arrived yet is deferred in
+// service_edge_deferred for up to serviceMapParentWait.
+//
+// The child's context "status" (>= 500 or an "error" key is an error) and
+// "duration_ms" are used when present, as logged by client/middleware.
+
+const (
+	serviceMapBatch      = 10000
+	serviceMapParentWait = 10 * time.Minute
+	// histogram bucket i counts durations up to 0.1ms * 2^(i/2)
+	histogramBuckets = 50
+)
+
+type ServiceMap struct {
+	Sources []string      `json:"sources"`
+	Edges   []ServiceEdge `json:"edges"`
+}
+
+type ServiceEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Calls int64  `json:"calls"`
+	// Errors are out of the StatusCalls that have a known status.
+	StatusCalls int64    `json:"status_calls"`
+	Errors      int64    `json:"errors"`
+	ErrorRate   *float64 `json:"error_rate,omitempty"`
+	// Percentiles of the DurationCalls with a known duration.
+	DurationCalls int64    `json:"duration_calls"`
+	P50Ms         *float64 `json:"p50_ms,omitempty"`
+	P90Ms         *float64 `json:"p90_ms,omitempty"`
+	P99Ms         *float64 `json:"p99_ms,omitempty"`
+
+	histogram []int64
+}
+
+type serviceEdgeKey struct {
+	minute time.Time
+	from   string
+	to     string
+}
+
+// UpdateServiceMap aggregates the entries and repeats of each project created since
+// the last update. They are only aggregated once the next update comes around, to
+// give concurrent transactions with lower seqs (ids) time to commit. A project that
+// fails is logged and retried on the next update.
+func UpdateServiceMap(db *sql.DB, ctx context.Context) error {
+	projects := make([]Project, 0)
+	if err := ListProjects("", "", &projects, db, ctx); err != nil {
+		return err
+	}
+	for _, p := range projects {
+		if err := updateProjectServiceMap(p.Id, db, ctx); err != nil {
+			log.Printf("Error updating service map of project %d: %v\n", p.Id, err)
+		}
+	}
+	return nil
+}
+
+func updateProjectServiceMap(projectId int32, db *sql.DB, ctx context.Context) error {
+	var seq, pendingSeq, repeatId, pendingRepeatId int64
+	query := `SELECT seq, pending_seq, repeat_id, pending_repeat_id FROM service_map_state WHERE project_id = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId).Scan(&seq, &pendingSeq, &repeatId, &pendingRepeatId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	edges := make(map[serviceEdgeKey]*ServiceEdge)
+	upTo, upToRepeat := pendingSeq, pendingRepeatId
+	if upTo > seq {
+		query = "SELECT c.seq, 0, c.published, p.source, c.source, " + serviceEntryCalls + ", " + serviceCallCols +
+			" FROM entry c LEFT JOIN LATERAL (" + serviceParentSource + "c.parent_span_id" + serviceParentOrder + ") p ON true" +
+			" WHERE c.project_id = ? AND c.seq > ? AND c.seq <= ? AND c.parent_span_id IS NOT NULL" +
+			" AND (p.source IS NULL OR p.source <> c.source) ORDER BY c.seq LIMIT ?"
+		events, err := serviceEvents(tx, ctx, query, projectId, seq, upTo, serviceMapBatch)
+		if err != nil {
+			return err
+		}
+		if seq = upTo; len(events) == serviceMapBatch {
+			seq = events[len(events)-1].seq
+		}
+		if err = aggregateServiceEvents(projectId, events, edges, now, tx, ctx); err != nil {
+			return err
+		}
+	}
+	if upToRepeat > repeatId {
+		query = "SELECT r.seq, r.id, r.published, p.source, c.source, r.repeats, " + serviceCallCols +
+			" FROM entry_repeat r JOIN entry c ON c.project_id = r.project_id AND c.seq = r.seq" +
+			" LEFT JOIN LATERAL (" + serviceParentSource + "r.parent_span_id" + serviceParentOrder + ") p ON true" +
+			" WHERE r.project_id = ? AND r.id > ? AND r.id <= ? AND r.parent_span_id IS NOT NULL" +
+			" AND (p.source IS NULL OR p.source <> c.source) ORDER BY r.id LIMIT ?"
+		events, err := serviceEvents(tx, ctx, query, projectId, repeatId, upToRepeat, serviceMapBatch)
+		if err != nil {
+			return err
+		}
+		if repeatId = upToRepeat; len(events) == serviceMapBatch {
+			repeatId = events[len(events)-1].repeatId
+		}
+		if err = aggregateServiceEvents(projectId, events, edges, now, tx, ctx); err != nil {
+			return err
+		}
+	}
+	if err = aggregateDeferredServiceEvents(projectId, edges, now, tx, ctx); err != nil {
+		return err
+	}
+	for k, edge := range edges {
+		if err = addServiceEdge(projectId, k.minute, edge, tx, ctx); err != nil {
+			return err
+		}
+	}
+
+	var maxSeq, maxRepeatId sql.NullInt64
+	query = `SELECT max(seq) FROM entry WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxSeq); err != nil {
+		return err
+	}
+	if seq == upTo {
+		pendingSeq = maxSeq.Int64
+	}
+	query = `SELECT max(id) FROM entry_repeat WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxRepeatId); err != nil {
+		return err
+	}
+	if repeatId == upToRepeat {
+		pendingRepeatId = maxRepeatId.Int64
+	}
+
+	query = `INSERT INTO service_map_state (project_id, seq, pending_seq, repeat_id, pending_repeat_id)` +
+		` VALUES (?, ?, ?, ?, ?) ON CONFLICT (project_id) DO UPDATE SET seq = EXCLUDED.seq,` +
+		` pending_seq = EXCLUDED.pending_seq, repeat_id = EXCLUDED.repeat_id, pending_repeat_id = EXCLUDED.pending_repeat_id`
+	if _, err = execTxContext(tx, ctx, query, projectId, seq, pendingSeq, repeatId, pendingRepeatId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const (
+	// serviceEntryCalls counts an entry as 1 plus the repeats not in entry_repeat
+	serviceEntryCalls = "1 + c.repeated - coalesce((SELECT sum(repeats) FROM entry_repeat" +
+		" WHERE project_id = c.project_id AND seq = c.seq), 0)"
+	serviceCallCols     = "c.context ->> 'status', c.context ->> 'duration_ms', coalesce(c.context ?? 'error', false)"
+	serviceParentSource = "SELECT source FROM entry WHERE project_id = c.project_id AND span_id = "
+	serviceParentOrder  = " ORDER BY seq LIMIT 1"
+)
+
+// serviceEvent is an entry (repeatId 0) or its repeats with a parent span, and the
+// parent's source if it has arrived.
+type serviceEvent struct {
+	seq       int64
+	repeatId  int64
+	published time.Time
+	from      sql.NullString
+	to        string
+	calls     int64
+	status    sql.NullString
+	duration  sql.NullString
+	hasError  bool
+}
+
+func serviceEvents(tx *sql.Tx, ctx context.Context, query string, args ...interface{}) ([]serviceEvent, error) {
+	rows, err := queryTxContext(tx, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]serviceEvent, 0)
+	for rows.Next() {
+		var e serviceEvent
+		if err = rows.Scan(&e.seq, &e.repeatId, &e.published, &e.from, &e.to, &e.calls,
+			&e.status, &e.duration, &e.hasError); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// aggregateServiceEvents adds the events to the edges, deferring those whose parent
+// hasn't arrived.
+func aggregateServiceEvents(projectId int32, events []serviceEvent, edges map[serviceEdgeKey]*ServiceEdge,
+	now time.Time, tx *sql.Tx, ctx context.Context) error {
+	for _, e := range events {
+		if e.from.Valid {
+			addServiceEvent(e, edges)
+			continue
+		}
+		query := `INSERT INTO service_edge_deferred (project_id, seq, repeat_id, created) VALUES (?, ?, ?, ?)` +
+			` ON CONFLICT DO NOTHING`
+		if _, err := execTxContext(tx, ctx, query, projectId, e.seq, e.repeatId, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregateDeferredServiceEvents adds the deferred events whose parent has since
+// arrived, and drops those that waited longer than serviceMapParentWait.
+func aggregateDeferredServiceEvents(projectId int32, edges map[serviceEdgeKey]*ServiceEdge,
+	now time.Time, tx *sql.Tx, ctx context.Context) error {
+	query := "SELECT c.seq, d.repeat_id, coalesce(r.published, c.published), p.source, c.source," +
+		" CASE WHEN d.repeat_id = 0 THEN " + serviceEntryCalls + " ELSE r.repeats END, " + serviceCallCols +
+		" FROM service_edge_deferred d JOIN entry c ON c.project_id = d.project_id AND c.seq = d.seq" +
+		" LEFT JOIN entry_repeat r ON r.id = d.repeat_id" +
+		" JOIN LATERAL (" + serviceParentSource + "coalesce(r.parent_span_id, c.parent_span_id)" + serviceParentOrder + ") p ON true" +
+		" WHERE d.project_id = ? AND (d.repeat_id = 0 OR r.id IS NOT NULL) ORDER BY d.created LIMIT ?"
+	events, err := serviceEvents(tx, ctx, query, projectId, serviceMapBatch)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.from.String != e.to {
+			addServiceEvent(e, edges)
+		}
+		query = `DELETE FROM service_edge_deferred WHERE project_id = ? AND seq = ? AND repeat_id = ?`
+		if _, err = execTxContext(tx, ctx, query, projectId, e.seq, e.repeatId); err != nil {
+			return err
+		}
+	}
+
+	query = `DELETE FROM service_edge_deferred WHERE project_id = ? AND created < ?`
+	_, err = execTxContext(tx, ctx, query, projectId, now.Add(-serviceMapParentWait))
+	return err
+}
+
+func addServiceEvent(e serviceEvent, edges map[serviceEdgeKey]*ServiceEdge) {
+	if e.calls <= 0 {
+		return
+	}
+	k := serviceEdgeKey{e.published.UTC().Truncate(time.Minute), e.from.String, e.to}
+	edge, ok := edges[k]
+	if !ok {
+		edge = &ServiceEdge{From: k.from, To: k.to, histogram: make([]int64, histogramBuckets)}
+		edges[k] = edge
+	}
+	edge.Calls += e.calls
+	if code, err := strconv.ParseFloat(e.status.String, 64); err == nil {
+		edge.StatusCalls += e.calls
+		if code >= 500 || e.hasError {
+			edge.Errors += e.calls
+		}
+	} else if e.hasError {
+		edge.StatusCalls += e.calls
+		edge.Errors += e.calls
+	}
+	if ms, err := strconv.ParseFloat(e.duration.String, 64); err == nil && ms >= 0 {
+		edge.DurationCalls += e.calls
+		edge.histogram[histogramBucket(ms)] += e.calls
+	}
+}
+
+func addServiceEdge(projectId int32, minute time.Time, edge *ServiceEdge, tx *sql.Tx, ctx context.Context) error {
+	var calls, statusCalls, errors, durationCalls int64
+	var histogram pq.Int64Array
+	query := `SELECT calls, status_calls, errors, duration_calls, histogram FROM service_edge` +
+		` WHERE project_id = ? AND minute = ? AND from_source = ? AND to_source = ? FOR UPDATE`
+	err := queryRowTxContext(tx, ctx, query, projectId, minute, edge.From, edge.To).
+		Scan(&calls, &statusCalls, &errors, &durationCalls, &histogram)
+	switch {
+	case err == sql.ErrNoRows:
+		query = `INSERT INTO service_edge (project_id, minute, from_source, to_source,` +
+			` calls, status_calls, errors, duration_calls, histogram) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		_, err = execTxContext(tx, ctx, query, projectId, minute, edge.From, edge.To,
+			edge.Calls, edge.StatusCalls, edge.Errors, edge.DurationCalls, pq.Int64Array(edge.histogram))
+		return err
+	case err != nil:
+		return err
+	}
+
+	mergeHistogram(edge.histogram, histogram)
+	query = `UPDATE service_edge SET calls = ?, status_calls = ?, errors = ?, duration_calls = ?, histogram = ?` +
+		` WHERE project_id = ? AND minute = ? AND from_source = ? AND to_source = ?`
+	_, err = execTxContext(tx, ctx, query, calls+edge.Calls, statusCalls+edge.StatusCalls, errors+edge.Errors,
+		durationCalls+edge.DurationCalls, pq.Int64Array(edge.histogram), projectId, minute, edge.From, edge.To)
+	return err
+}
+
+// GetServiceMap sums up the service edges of the project with minutes in the window.
+func GetServiceMap(projectId int, publishedMin, publishedMax time.Time, db *sql.DB, ctx context.Context) (ServiceMap, error) {
+	query := `SELECT from_source, to_source, calls, status_calls, errors, duration_calls, histogram` +
+		` FROM service_edge WHERE project_id = ? AND minute >= ? AND minute <= ?`
+	rows, err := queryContext(db, ctx, query, projectId, publishedMin.Truncate(time.Minute), publishedMax)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return ServiceMap{}, err
+	}
+
+	edges := make(map[serviceEdgeKey]*ServiceEdge)
+	for rows.Next() {
+		var e ServiceEdge
+		var histogram pq.Int64Array
+		if err = rows.Scan(&e.From, &e.To, &e.Calls, &e.StatusCalls, &e.Errors, &e.DurationCalls, &histogram); err != nil {
+			return ServiceMap{}, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		k := serviceEdgeKey{from: e.From, to: e.To}
+		edge, ok := edges[k]
+		if !ok {
+			edge = &ServiceEdge{From: e.From, To: e.To, histogram: make([]int64, histogramBuckets)}
+			edges[k] = edge
+		}
+		edge.Calls += e.Calls
+		edge.StatusCalls += e.StatusCalls
+		edge.Errors += e.Errors
+		edge.DurationCalls += e.DurationCalls
+		mergeHistogram(edge.histogram, histogram)
+	}
+	if err = rows.Err(); err != nil {
+		return ServiceMap{}, err
+	}
+
+	m := ServiceMap{Sources: make([]string, 0), Edges: make([]ServiceEdge, 0, len(edges))}
+	sources := make(map[string]bool)
+	for _, edge := range edges {
+		if edge.StatusCalls > 0 {
+			rate := float64(edge.Errors) / float64(edge.StatusCalls)
+			edge.ErrorRate = &rate
+		}
+		edge.P50Ms = percentile(edge.histogram, 0.50)
+		edge.P90Ms = percentile(edge.histogram, 0.90)
+		edge.P99Ms = percentile(edge.histogram, 0.99)
+		m.Edges = append(m.Edges, *edge)
+		sources[edge.From] = true
+		sources[edge.To] = true
+	}
+	for source := range sources {
+		m.Sources = append(m.Sources, source)
+	}
+	sort.Strings(m.Sources)
+	sort.Slice(m.Edges, func(i, j int) bool {
+		if m.Edges[i].From != m.Edges[j].From {
+			return m.Edges[i].From < m.Edges[j].From
+		}
+		return m.Edges[i].To < m.Edges[j].To
+	})
+	return m, nil
+}
+
+func histogramBucket(ms float64) int {
+	if ms <= 0.1 {
+		return 0
+	}
+	i := int(math.Ceil(2 * math.Log2(ms/0.1)))
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+func histogramBound(i int) float64 {
+	return 0.1 * math.Pow(2, float64(i)/2)
+}
+
+func mergeHistogram(into []int64, h []int64) {
+	for i := 0; i < len(h) && i < len(into); i++ {
+		into[i] += h[i]
+	}
+}
+
+// percentile returns the upper bound of the bucket containing the percentile, or nil if empty.
+func percentile(h []int64, p float64) *float64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	var n int64
+	for i, count := range h {
+		n += count
+		if n >= rank {
+			ms := math.Round(histogramBound(i)*1000) / 1000
+			return &ms
+		}
+	}
+	return nil
+}
@@ -17,19 +17,45 @@ type SpanTag struct {
 
 func CreateSpanTag(t SpanTag, tx *sql.Tx, ctx context.Context) error {
 	query := "INSERT INTO span_tag" +
-		" (project_id, trace_id, span_id, `key`, value)" +
-		" VALUES (?, ?, ?, ?, ?);"
+		" (project_id, trace_id, span_id, key, value)" +
+		" VALUES ($1, $2, $3, $4, $5);"
 	if _, err := tx.ExecContext(ctx, query, t.ProjectId, t.TraceId, t.SpanId, t.Key, t.Value); err != nil {
 		return err
 	}
 	return nil
 }
 
+// CreateSpanTags creates the tags, ignoring those that already exist.
+func CreateSpanTags(tags []SpanTag, tx *sql.Tx, ctx context.Context) error {
+	for len(tags) > 0 {
+		n := len(tags)
+		if n > maxInsertRows {
+			n = maxInsertRows
+		}
+		values := make([]string, n)
+		args := make([]interface{}, 0, 5*n)
+		for i, t := range tags[:n] {
+			values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", 5*i+1, 5*i+2, 5*i+3, 5*i+4, 5*i+5)
+			args = append(args, t.ProjectId, t.TraceId, t.SpanId, t.Key, t.Value)
+		}
+		query := "INSERT INTO span_tag (project_id, trace_id, span_id, key, value) VALUES " +
+			strings.Join(values, ", ") + " ON CONFLICT DO NOTHING"
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		tags = tags[n:]
+	}
+	return nil
+}
+
+// maxInsertRows keeps the parameters of a multi-row INSERT within the Postgres limit.
+const maxInsertRows = 1000
+
 func ListSpanTags(projectId int, traceId, spanId, tag string, tx *sql.DB, ctx context.Context) ([]SpanTag, error) {
 	var rows *sql.Rows
 
 	var err error
-	fields := "project_id, trace_id, span_id, `key`, value"
+	fields := "project_id, trace_id, span_id, key, value"
 
 	traceOrSpanId := ""
 	traceOrSpanCols := ""
@@ -48,15 +74,15 @@ func ListSpanTags(projectId int, traceId, spanId, tag string, tx *sql.DB, ctx co
 	if tag != "" {
 		key, value := ParseTag(tag)
 		if key != "" {
-			query := "SELECT " + fields + " FROM span_tag WHERE project_id = ? AND `key` = ? AND value = ?"
+			query := "SELECT " + fields + " FROM span_tag WHERE project_id = $1 AND key = $2 AND value = $3"
 			rows, err = tx.QueryContext(ctx, query, projectId, key, value)
 		} else {
-			query := "SELECT " + fields + " FROM span_tag WHERE project_id = ? AND value = ?"
+			query := "SELECT " + fields + " FROM span_tag WHERE project_id = $1 AND value = $2"
 			rows, err = tx.QueryContext(ctx, query, projectId, value)
 		}
 	} else {
-		query := "SELECT " + fields + " FROM span_tag WHERE project_id = ?" +
-			" AND ? IN " + traceOrSpanCols
+		query := "SELECT " + fields + " FROM span_tag WHERE project_id = $1" +
+			" AND $2 IN " + traceOrSpanCols
 		rows, err = tx.QueryContext(ctx, query, projectId, traceOrSpanId)
 	}
 
@@ -87,6 +113,77 @@ func ListSpanTags(projectId int, traceId, spanId, tag string, tx *sql.DB, ctx co
 	return spanTags, nil
 }
 
+// KeyStats are the number of tags with a key and the number of distinct values
+// (cardinality) they have. A key with a high cardinality, like a request id,
+// bloats the span_tag index without being useful to search by.
+type KeyStats struct {
+	Key         string `json:"key"`
+	Tags        int64  `json:"tags"`
+	Cardinality int64  `json:"cardinality"`
+}
+
+// ListKeyStats returns the stats of the project's tag keys starting with the prefix,
+// highest cardinality first, from the counts in span_tag_key (see storage.UpdateTagStats).
+func ListKeyStats(projectId int, prefix string, db *sql.DB, ctx context.Context) ([]KeyStats, error) {
+	query := "SELECT key, tags, cardinality FROM span_tag_key WHERE project_id = $1 AND key LIKE $2" +
+		" ORDER BY cardinality DESC, key"
+	rows, err := db.QueryContext(ctx, query, projectId, likePrefix(prefix))
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]KeyStats, 0)
+	for rows.Next() {
+		var k KeyStats
+		if err = rows.Scan(&k.Key, &k.Tags, &k.Cardinality); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		stats = append(stats, k)
+	}
+	return stats, rows.Err()
+}
+
+// ValueCount is the number of spans with a tag value.
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// ListValueCounts returns up to limit values of the project's tags with the key,
+// starting with the prefix, most frequent first, from the counts in span_tag_value.
+func ListValueCounts(projectId int, key, prefix string, limit int, db *sql.DB, ctx context.Context) ([]ValueCount, error) {
+	query := "SELECT value, spans FROM span_tag_value WHERE project_id = $1 AND key = $2 AND value LIKE $3" +
+		" ORDER BY spans DESC, value LIMIT $4"
+	rows, err := db.QueryContext(ctx, query, projectId, key, likePrefix(prefix), limit)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]ValueCount, 0)
+	for rows.Next() {
+		var c ValueCount
+		if err = rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// likePrefix returns a LIKE pattern for values starting with prefix.
+func likePrefix(prefix string) string {
+	prefix = strings.Replace(prefix, `\`, `\\`, -1)
+	prefix = strings.Replace(prefix, `%`, `\%`, -1)
+	prefix = strings.Replace(prefix, `_`, `\_`, -1)
+	return prefix + "%"
+}
+
 func ParseTag(tag string) (key, value string) {
 	i := strings.Index(tag, ":")
 	if i == -1 {
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage/query"
+	"github.com/lib/pq"
+)
+
+// A Subscription has the entries of its project matching Filter (in the query
+// language of the storage/query package, all entries if empty) POSTed to URL.
+// QueueDeliveries adds a delivery for each new matching entry, and for each time
+// repeats are collapsed into one (from entry_repeat), outside of the transactions
+// that create entries, and the deliveries are claimed, sent and recorded by a
+// background sender, retried with backoff until DeliveryMaxAttempts.
+type Subscription struct {
+	Id        int64     `json:"id"`
+	ProjectId int32     `json:"project_id"`
+	Filter    string    `json:"filter"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	DeliveryMaxAttempts = 8
+	deliveryMinBackoff  = 10 * time.Second
+	deliveryMaxBackoff  = time.Hour
+)
+
+// Delivery is the delivery of an entry to a subscription, or with Repeats, of the
+// repeats collapsed into it. Deliveries that fail DeliveryMaxAttempts times are
+// dead letters, kept until retried or deleted.
+type Delivery struct {
+	Id             int64      `json:"id"`
+	SubscriptionId int64      `json:"subscription_id"`
+	Seq            int64      `json:"seq"`
+	Repeats        int32      `json:"repeats,omitempty"`
+	Status         string     `json:"status"`
+	Attempts       int32      `json:"attempts"`
+	NextAttempt    *time.Time `json:"next_attempt,omitempty"`
+	LastAttempt    *time.Time `json:"last_attempt,omitempty"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Created        time.Time  `json:"created"`
+
+	// set on claimed deliveries
+	Entry  Entry  `json:"-"`
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+func (s Subscription) Validate() error {
+	if _, err := query.Parse(s.Filter); err != nil {
+		return fmt.Errorf("'filter': %v", err)
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'url' must be an http or https URL")
+	}
+	return nil
+}
+
+// CreateSubscription creates the subscription, which gets the entries created from now on.
+func CreateSubscription(s Subscription, tx *sql.Tx, ctx context.Context) (int64, error) {
+	var id int64
+	query := `INSERT INTO subscription (project_id, filter, url, secret, created, seq, pending_seq, repeat_id, pending_repeat_id)` +
+		` SELECT ?, ?, ?, ?, ?, e.seq, e.seq, r.id, r.id` +
+		` FROM (SELECT coalesce(max(seq), 0) AS seq FROM entry WHERE project_id = ?) e,` +
+		` (SELECT coalesce(max(id), 0) AS id FROM entry_repeat WHERE project_id = ?) r` +
+		` RETURNING id`
+	err := queryRowTxContext(tx, ctx, query, s.ProjectId, s.Filter, s.URL, s.Secret, s.Created, s.ProjectId,
+		s.ProjectId).Scan(&id)
+	return id, err
+}
+
+// ListSubscriptions returns the project's subscriptions without their secrets.
+func ListSubscriptions(projectId int32, db *sql.DB, ctx context.Context) ([]Subscription, error) {
+	query := `SELECT id, project_id, filter, url, created FROM subscription WHERE project_id = ? ORDER BY id`
+	rows, err := queryContext(db, ctx, query, projectId)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]Subscription, 0)
+	for rows.Next() {
+		var s Subscription
+		if err = rows.Scan(&s.Id, &s.ProjectId, &s.Filter, &s.URL, &s.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		s.Created = s.Created.UTC()
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// GetSubscription returns the subscription without its secret, or nil if there's no such subscription.
+func GetSubscription(projectId int32, id int64, db *sql.DB, ctx context.Context) (*Subscription, error) {
+	var s Subscription
+	query := `SELECT id, project_id, filter, url, created FROM subscription WHERE project_id = ? AND id = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId, id).Scan(&s.Id, &s.ProjectId, &s.Filter, &s.URL, &s.Created)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	s.Created = s.Created.UTC()
+	return &s, nil
+}
+
+// DeleteSubscription deletes the subscription and its deliveries, returning false if there was no such subscription.
+func DeleteSubscription(projectId int32, id int64, tx *sql.Tx, ctx context.Context) (bool, error) {
+	query := `DELETE FROM subscription WHERE project_id = ? AND id = ?`
+	result, err := execTxContext(tx, ctx, query, projectId, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	query = `DELETE FROM delivery WHERE subscription_id = ?`
+	_, err = execTxContext(tx, ctx, query, id)
+	return err == nil, err
+}
+
+// QueueDeliveries adds a pending delivery for each entry matching a subscription
+// since it was last queued. As with the service map, entries are only queued on
+// the next call to give concurrent transactions with lower seqs time to commit.
+// A subscription that fails is logged and skipped so that it doesn't hold up the others.
+func QueueDeliveries(db *sql.DB, ctx context.Context) error {
+	rows, err := queryContext(db, ctx, `SELECT id FROM subscription ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan result set: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err = queueSubscriptionDeliveries(id, db, ctx); err != nil {
+			log.Printf("Error queueing deliveries of subscription %d: %v\n", id, err)
+		}
+	}
+	return nil
+}
+
+func queueSubscriptionDeliveries(id int64, db *sql.DB, ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var projectId int32
+	var filter string
+	var seq, pendingSeq, repeatId, pendingRepeatId int64
+	query := `SELECT project_id, filter, seq, pending_seq, repeat_id, pending_repeat_id FROM subscription WHERE id = ? FOR UPDATE`
+	err = queryRowTxContext(tx, ctx, query, id).Scan(&projectId, &filter, &seq, &pendingSeq, &repeatId, &pendingRepeatId)
+	switch {
+	case err == sql.ErrNoRows:
+		// deleted since listed
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if pendingSeq > seq {
+		f := EntryFilter{ProjectId: int(projectId), SeqMin: int(seq) + 1, SeqMax: int(pendingSeq), Search: filter}
+		where, args, err := f.where(IndexedKeys{})
+		if err != nil {
+			return err
+		}
+		query = "INSERT INTO delivery (subscription_id, seq, status, attempts, next_attempt, created)" +
+			" SELECT ?::bigint, e.seq, '" + DeliveryPending + "', 0, ?::timestamptz, ?::timestamptz" +
+			" FROM entry e WHERE " + where
+		now := time.Now()
+		if _, err = execTxContext(tx, ctx, query, append([]interface{}{id, now, now}, args...)...); err != nil {
+			return err
+		}
+	}
+	if pendingRepeatId > repeatId {
+		// the repeats collapsed into matching entries, with the entries as they are now
+		f := EntryFilter{ProjectId: int(projectId), SeqMin: MinInt, SeqMax: MaxInt, Search: filter}
+		where, args, err := f.where(IndexedKeys{})
+		if err != nil {
+			return err
+		}
+		query = "INSERT INTO delivery (subscription_id, seq, repeats, status, attempts, next_attempt, created)" +
+			" SELECT ?::bigint, r.seq, r.repeats, '" + DeliveryPending + "', 0, ?::timestamptz, ?::timestamptz" +
+			" FROM entry_repeat r JOIN entry e ON e.project_id = r.project_id AND e.seq = r.seq" +
+			" WHERE r.project_id = ? AND r.id > ? AND r.id <= ? AND " + where + " ORDER BY r.id"
+		now := time.Now()
+		args = append([]interface{}{id, now, now, projectId, repeatId, pendingRepeatId}, args...)
+		if _, err = execTxContext(tx, ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	var maxSeq, maxRepeatId sql.NullInt64
+	query = `SELECT max(seq) FROM entry WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxSeq); err != nil {
+		return err
+	}
+	seq = pendingSeq
+	if maxSeq.Int64 > pendingSeq {
+		pendingSeq = maxSeq.Int64
+	}
+	query = `SELECT max(id) FROM entry_repeat WHERE project_id = ?`
+	if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxRepeatId); err != nil {
+		return err
+	}
+	repeatId = pendingRepeatId
+	if maxRepeatId.Int64 > pendingRepeatId {
+		pendingRepeatId = maxRepeatId.Int64
+	}
+
+	query = `UPDATE subscription SET seq = ?, pending_seq = ?, repeat_id = ?, pending_repeat_id = ? WHERE id = ?`
+	if _, err = execTxContext(tx, ctx, query, seq, pendingSeq, repeatId, pendingRepeatId, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimDeliveries claims up to limit pending deliveries that are due, with their
+// entries, for the lease duration. Deliveries whose entry was deleted are dead.
+func ClaimDeliveries(limit int, lease time.Duration, db *sql.DB, ctx context.Context) ([]Delivery, error) {
+	now := time.Now()
+	query := "UPDATE delivery d SET next_attempt = ? FROM subscription s" +
+		" WHERE d.id IN (SELECT id FROM delivery WHERE status = '" + DeliveryPending + "' AND next_attempt <= ?" +
+		"   ORDER BY next_attempt, id LIMIT ? FOR UPDATE SKIP LOCKED) AND s.id = d.subscription_id" +
+		" RETURNING d.id, d.subscription_id, s.project_id, d.seq, coalesce(d.repeats, 0), d.attempts, d.created, s.url, s.secret"
+	rows, err := queryContext(db, ctx, query, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		if err = rows.Scan(&d.Id, &d.SubscriptionId, &d.Entry.ProjectId, &d.Seq, &d.Repeats, &d.Attempts, &d.Created,
+			&d.URL, &d.Secret); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		d.Status = DeliveryPending
+		claimed = append(claimed, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(claimed))
+	for _, d := range claimed {
+		rows, err := queryContext(db, ctx, "SELECT "+entryCols+" FROM entry WHERE project_id = ? AND seq = ?",
+			d.Entry.ProjectId, d.Seq)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := resultEntries(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			query = `UPDATE delivery SET status = ?, next_attempt = NULL, error = ? WHERE id = ?`
+			if _, err = execContext(db, ctx, query, DeliveryDead, "entry no longer exists", d.Id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		d.Entry = entries[0]
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// RecordDeliveryAttempt records an attempt at sending the claimed delivery, which
+// failed if deliveryErr isn't nil. A failed delivery is retried after a backoff,
+// or is dead after DeliveryMaxAttempts.
+func RecordDeliveryAttempt(d Delivery, responseStatus int, deliveryErr error, db *sql.DB, ctx context.Context) error {
+	now := time.Now()
+	attempts := d.Attempts + 1
+	status := DeliveryDelivered
+	var nextAttempt pq.NullTime
+	var errMessage sql.NullString
+	if deliveryErr != nil {
+		errMessage = StringToNullable(deliveryErr.Error())
+		if attempts >= DeliveryMaxAttempts {
+			status = DeliveryDead
+		} else {
+			status = DeliveryPending
+			nextAttempt = pq.NullTime{Time: now.Add(deliveryBackoff(attempts)), Valid: true}
+		}
+	}
+	var response sql.NullInt64
+	if responseStatus != 0 {
+		response = sql.NullInt64{Int64: int64(responseStatus), Valid: true}
+	}
+
+	query := `UPDATE delivery SET status = ?, attempts = ?, next_attempt = ?, last_attempt = ?,` +
+		` response_status = ?, error = ? WHERE id = ?`
+	_, err := execContext(db, ctx, query, status, attempts, nextAttempt, now, response, errMessage, d.Id)
+	return err
+}
+
+// deliveryBackoff doubles from deliveryMinBackoff with each attempt, up to
+// deliveryMaxBackoff, and adds up to 20% jitter.
+func deliveryBackoff(attempts int32) time.Duration {
+	backoff := deliveryMinBackoff
+	for i := int32(1); i < attempts && backoff < deliveryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > deliveryMaxBackoff {
+		backoff = deliveryMaxBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff/5)+1))
+}
+
+// ListDeliveries returns up to limit of the subscription's latest deliveries,
+// with the status if it isn't empty.
+func ListDeliveries(subscriptionId int64, status string, limit int, db *sql.DB, ctx context.Context) ([]Delivery, error) {
+	query := `SELECT id, subscription_id, seq, coalesce(repeats, 0), status, attempts, next_attempt, last_attempt,` +
+		` response_status, error, created FROM delivery WHERE subscription_id = ?`
+	args := []interface{}{subscriptionId}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := queryContext(db, ctx, query, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		var nextAttempt, lastAttempt pq.NullTime
+		var response sql.NullInt64
+		var errMessage sql.NullString
+		if err = rows.Scan(&d.Id, &d.SubscriptionId, &d.Seq, &d.Repeats, &d.Status, &d.Attempts, &nextAttempt,
+			&lastAttempt, &response, &errMessage, &d.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan result set: %s", err)
+		}
+		if nextAttempt.Valid {
+			t := nextAttempt.Time.UTC()
+			d.NextAttempt = &t
+		}
+		if lastAttempt.Valid {
+			t := lastAttempt.Time.UTC()
+			d.LastAttempt = &t
+		}
+		d.ResponseStatus = int(response.Int64)
+		d.Error = errMessage.String
+		d.Created = d.Created.UTC()
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RetryDelivery makes a dead delivery pending again with fresh attempts,
+// returning false if the subscription has no such dead delivery.
+func RetryDelivery(subscriptionId, id int64, tx *sql.Tx, ctx context.Context) (bool, error) {
+	query := `UPDATE delivery SET status = ?, attempts = 0, next_attempt = ?` +
+		` WHERE subscription_id = ? AND id = ? AND status = ?`
+	result, err := execTxContext(tx, ctx, query, DeliveryPending, time.Now(), subscriptionId, id, DeliveryDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// PurgeDeliveries deletes delivered deliveries last attempted before the given time.
+func PurgeDeliveries(before time.Time, db *sql.DB, ctx context.Context) error {
+	query := `DELETE FROM delivery WHERE status = ? AND last_attempt < ?`
+	_, err := execContext(db, ctx, query, DeliveryDelivered, before)
+	return err
+}
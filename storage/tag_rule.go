@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/karmakaze/quicklog/storage/span_tag"
+)
+
+const TagRulesConfig = "tag_rules"
+
+// TagRule promotes the value of an entry field (source, type, actor, object or
+// target) or context path (e.g. "context.customer.id") to a tag 'key:value' of
+// the entry's span when the entry is created. The Key is by default the field
+// name or the last key of the path. Each scalar of an array value is a tag.
+type TagRule struct {
+	Field string `json:"field"`
+	Key   string `json:"key,omitempty"`
+}
+
+// TagRules are a project's tag extraction rules.
+type TagRules struct {
+	Rules []TagRule `json:"rules"`
+}
+
+func (t *TagRules) Validate() error {
+	for i, rule := range t.Rules {
+		if path, ok := redactionPath(rule.Field); !ok || path != nil && len(path) == 0 {
+			return fmt.Errorf("rule %d: 'field' must be %s or context.<path>", i, strings.Join(redactionFields, ", "))
+		}
+		if strings.Contains(rule.Key, ":") {
+			return fmt.Errorf("rule %d: 'key' must not contain ':'", i)
+		}
+	}
+	return nil
+}
+
+func GetTagRules(projectId int32, db queryRower, ctx context.Context) (*TagRules, error) {
+	var t TagRules
+	if ok, err := GetProjectConfig(projectId, TagRulesConfig, &t, db, ctx); !ok || err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// spanTags returns the inline tags of the entry and those extracted by the rules,
+// which may be nil. Tags are of the span, or the trace if there's no span, so an
+// entry without a trace has none (POST /entries rejects one with inline tags).
+func (e Entry) spanTags(rules *TagRules) []span_tag.SpanTag {
+	if e.TraceId == "" {
+		return nil
+	}
+	spanId := e.SpanId
+	if spanId == "" {
+		spanId = e.TraceId
+	}
+	tags := make([]span_tag.SpanTag, 0)
+	add := func(key, value string) {
+		if value != "" {
+			tags = append(tags, span_tag.SpanTag{ProjectId: e.ProjectId, TraceId: e.TraceId, SpanId: spanId,
+				Key: key, Value: value})
+		}
+	}
+
+	for _, tag := range e.Tags {
+		add(span_tag.ParseTag(tag))
+	}
+	if rules == nil {
+		return tags
+	}
+	fields := map[string]string{"source": e.Source, "type": e.Type, "actor": e.Actor, "object": e.Object,
+		"target": e.Target}
+	for _, rule := range rules.Rules {
+		path, ok := redactionPath(rule.Field)
+		if !ok {
+			continue
+		}
+		key := rule.Key
+		if path == nil {
+			if key == "" {
+				key = rule.Field
+			}
+			add(key, fields[rule.Field])
+			continue
+		}
+		if len(path) == 0 {
+			continue
+		}
+		if key == "" {
+			key = path[len(path)-1]
+		}
+		var v interface{} = map[string]interface{}(e.Context)
+		for _, k := range path {
+			m, _ := v.(map[string]interface{})
+			v = m[k]
+		}
+		values, isArray := v.([]interface{})
+		if !isArray {
+			values = []interface{}{v}
+		}
+		for _, value := range values {
+			add(key, tagValue(value))
+		}
+	}
+	return tags
+}
+
+// tagValue formats a scalar JSON value as a tag value, "" for others.
+func tagValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// createSpanTags creates the span tags of the entries.
+func createSpanTags(entries []Entry, tx *sql.Tx, ctx context.Context) error {
+	tags := make([]span_tag.SpanTag, 0)
+	rules := make(map[int32]*TagRules)
+	for _, e := range entries {
+		if e.TraceId == "" {
+			continue
+		}
+		r, ok := rules[e.ProjectId]
+		if !ok {
+			var err error
+			if r, err = GetTagRules(e.ProjectId, tx, ctx); err != nil {
+				return err
+			}
+			rules[e.ProjectId] = r
+		}
+		tags = append(tags, e.spanTags(r)...)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return span_tag.CreateSpanTags(tags, tx, ctx)
+}
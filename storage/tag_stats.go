@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// The tags of each key and value are counted in span_tag_key and span_tag_value,
+// so that listing them (GET /tags/keys) doesn't scan span_tag. UpdateTagStats adds
+// the tags created since the last update by their id, in the background rather
+// than as they're created so that concurrent writers of a key don't contend on
+// its row. Tags are never deleted, so the counts only grow.
+
+const tagStatsBatch = 10000
+
+// UpdateTagStats counts the tags of each project created since the last update.
+// Like UpdateFieldValues, it counts up to the max id of the previous update so
+// that the transactions that took lower ids have had time to commit. A project
+// that fails is logged and retried on the next update.
+func UpdateTagStats(db *sql.DB, ctx context.Context) error {
+	projects := make([]Project, 0)
+	if err := ListProjects("", "", &projects, db, ctx); err != nil {
+		return err
+	}
+	for _, p := range projects {
+		if err := updateProjectTagStats(p.Id, db, ctx); err != nil {
+			log.Printf("Error updating tag stats of project %d: %v\n", p.Id, err)
+		}
+	}
+	return nil
+}
+
+func updateProjectTagStats(projectId int32, db *sql.DB, ctx context.Context) error {
+	var id, pendingId int64
+	query := `SELECT id, pending_id FROM span_tag_state WHERE project_id = ?`
+	err := db.QueryRowContext(ctx, numberArgs(query), projectId).Scan(&id, &pendingId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upTo := pendingId
+	if upTo > id {
+		if id, err = addTagStats(projectId, id, upTo, tx, ctx); err != nil {
+			return err
+		}
+	}
+
+	if id == upTo {
+		var maxId sql.NullInt64
+		query = `SELECT max(id) FROM span_tag WHERE project_id = ?`
+		if err = queryRowTxContext(tx, ctx, query, projectId).Scan(&maxId); err != nil {
+			return err
+		}
+		if maxId.Valid {
+			pendingId = maxId.Int64
+		}
+	}
+
+	query = `INSERT INTO span_tag_state (project_id, id, pending_id) VALUES (?, ?, ?)` +
+		` ON CONFLICT (project_id) DO UPDATE SET id = EXCLUDED.id, pending_id = EXCLUDED.pending_id`
+	if _, err = execTxContext(tx, ctx, query, projectId, id, pendingId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addTagStats counts the tags with id in (fromId, toId] into span_tag_value, and
+// into span_tag_key with the values new to it, and returns the id it got up to
+// (toId unless there were more than a batch).
+func addTagStats(projectId int32, fromId, toId int64, tx *sql.Tx, ctx context.Context) (int64, error) {
+	var lastId sql.NullInt64
+	var n int
+	query := `SELECT max(id), count(*) FROM (SELECT id FROM span_tag WHERE project_id = ? AND id > ? AND id <= ?` +
+		` ORDER BY id LIMIT ?) batch`
+	if err := queryRowTxContext(tx, ctx, query, projectId, fromId, toId, tagStatsBatch).Scan(&lastId, &n); err != nil {
+		return fromId, err
+	}
+	if n < tagStatsBatch {
+		lastId.Int64 = toId
+	}
+	if n == 0 {
+		return toId, nil
+	}
+
+	// both inserts see span_tag_value as it was before the statement
+	query = "WITH batch AS (SELECT project_id, key, value, count(*) AS spans FROM span_tag" +
+		"   WHERE project_id = ? AND id > ? AND id <= ? GROUP BY project_id, key, value)," +
+		" key_counts AS (INSERT INTO span_tag_key (project_id, key, tags, cardinality)" +
+		"   SELECT b.project_id, b.key, sum(b.spans), count(*) FILTER (WHERE NOT EXISTS (SELECT 1 FROM span_tag_value v" +
+		"     WHERE v.project_id = b.project_id AND v.key = b.key AND v.value = b.value))" +
+		"   FROM batch b GROUP BY b.project_id, b.key" +
+		"   ON CONFLICT (project_id, key) DO UPDATE SET tags = span_tag_key.tags + EXCLUDED.tags," +
+		"   cardinality = span_tag_key.cardinality + EXCLUDED.cardinality)" +
+		" INSERT INTO span_tag_value (project_id, key, value, spans) SELECT * FROM batch" +
+		" ON CONFLICT (project_id, key, value) DO UPDATE SET spans = span_tag_value.spans + EXCLUDED.spans"
+	if _, err := execTxContext(tx, ctx, query, projectId, fromId, lastId.Int64); err != nil {
+		return fromId, err
+	}
+	return lastId.Int64, nil
+}
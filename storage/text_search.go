@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Full-text search uses the entry 'search' tsvector column (see schema.sql),
+// generated from source, type, actor, object, target and the string values in
+// context with the 'simple' configuration so that identifiers aren't stemmed.
+
+const (
+	HighlightStart = "«"
+	HighlightStop  = "»"
+)
+
+// textQuery returns a tsquery matching entries with all the words of text as
+// prefixes, e.g. 'cat.jpg':* & 'timeout':*. Each word is quoted so text can't
+// cause a tsquery syntax error.
+func textQuery(text string) string {
+	words := strings.Fields(text)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.Replace(word, `\`, `\\`, -1)
+		word = strings.Replace(word, `'`, `''`, -1)
+		terms = append(terms, "'"+word+"':*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// searchEntries returns up to limit entries matching where and the text, best
+// ranked first, with a highlighted snippet of the matched text.
+func searchEntries(text, where string, args []interface{}, limit int, db *sql.DB, ctx context.Context) ([]Entry, error) {
+	tsquery := textQuery(text)
+	if tsquery == "" {
+		return make([]Entry, 0), nil
+	}
+
+	// rank and limit first so that only the returned entries are highlighted
+	query := "SELECT " + entryCols + ", rank," +
+		" ts_headline('simple', concat_ws(' ', source, type, actor, object, target," +
+		"   (SELECT string_agg(v #>> '{}', ' ') FROM jsonb_path_query(context, 'strict $.** ?? (@.type() == \"string\")') v))," +
+		"   to_tsquery('simple', ?), 'StartSel=" + HighlightStart + ", StopSel=" + HighlightStop + ", MaxFragments=3')" +
+		" FROM (SELECT " + entryColsE + ", ts_rank(e.search, to_tsquery('simple', ?)) AS rank" +
+		"   FROM entry e WHERE " + where + " AND e.search @@ to_tsquery('simple', ?)" +
+		"   ORDER BY rank DESC, e.seq DESC LIMIT ?) ranked" +
+		" ORDER BY rank DESC, seq DESC"
+
+	queryArgs := make([]interface{}, 0, len(args)+4)
+	queryArgs = append(queryArgs, tsquery, tsquery)
+	queryArgs = append(queryArgs, args...)
+	queryArgs = append(queryArgs, tsquery, limit)
+
+	rows, err := queryContext(db, ctx, query, queryArgs...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var rank float32
+		var highlight sql.NullString
+		e, err := scanEntry(rows, &rank, &highlight)
+		if err != nil {
+			return nil, err
+		}
+		e.Rank = rank
+		e.Highlight = highlight.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
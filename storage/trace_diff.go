@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Two traces, e.g. of an upload that succeeded and one that failed, are compared
+// by aligning their span trees by source, type and position: the n-th child span
+// of a source and type in one is matched with the n-th in the other. Matched spans
+// that are out of order (not in the longest run in order) are reordered, and the
+// unmatched spans are added (only in b) or missing (only in a).
+
+const (
+	SpanMatched   = "matched"
+	SpanReordered = "reordered"
+	SpanAdded     = "added"
+	SpanMissing   = "missing"
+)
+
+// traceDiffLimit is the most entries of a trace compared, the first ones.
+const traceDiffLimit = 10000
+
+type TraceDiff struct {
+	A               TraceSummary `json:"a"`
+	B               TraceSummary `json:"b"`
+	DurationDeltaMs float64      `json:"duration_delta_ms"`
+	Added           int          `json:"added"`
+	Missing         int          `json:"missing"`
+	Reordered       int          `json:"reordered"`
+	Changed         int          `json:"changed"`
+	// Spans are in tree order, with the missing spans after their preceding siblings in a.
+	Spans []SpanDiff `json:"spans"`
+}
+
+type TraceSummary struct {
+	TraceId    string  `json:"trace_id"`
+	Spans      int     `json:"spans"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// SpanDiff is a span of either or both traces. The deltas are b - a.
+type SpanDiff struct {
+	Status          string          `json:"status"`
+	Depth           int             `json:"depth"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	A               *TraceSpan      `json:"a,omitempty"`
+	B               *TraceSpan      `json:"b,omitempty"`
+	OffsetDeltaMs   *float64        `json:"offset_delta_ms,omitempty"`
+	DurationDeltaMs *float64        `json:"duration_delta_ms,omitempty"`
+	Changes         []ContextChange `json:"changes,omitempty"`
+}
+
+// TraceSpan is a span of a trace, timed from the start of the trace. The duration
+// is its context "duration_ms" if it has one, or else the time between its first
+// and last entries.
+type TraceSpan struct {
+	Seq        int64    `json:"seq"`
+	SpanId     string   `json:"span_id,omitempty"`
+	OffsetMs   float64  `json:"offset_ms"`
+	DurationMs *float64 `json:"duration_ms,omitempty"`
+
+	source, typ string
+	start, end  time.Time
+	context     map[string]interface{}
+	children    []*TraceSpan
+}
+
+// ContextChange is a context value that differs, null where absent.
+type ContextChange struct {
+	Field string      `json:"field"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+}
+
+// DiffTraces compares trace b of the project to trace a, ignoring changes to the
+// context fields (e.g. "context.request_id") with the ignored prefixes. It returns
+// nil if either trace has no entries.
+func DiffTraces(projectId int, a, b string, ignore []string, db *sql.DB, ctx context.Context) (*TraceDiff, error) {
+	diff := TraceDiff{Spans: make([]SpanDiff, 0)}
+	var roots [2][]*TraceSpan
+	for i, traceId := range []string{a, b} {
+		f := EntryFilter{ProjectId: projectId, SeqMin: 0, SeqMax: MaxInt, TraceId: traceId}
+		entries, err := ListEntries(f, traceDiffLimit, db, ctx)
+		if err != nil || len(entries) == 0 {
+			return nil, err
+		}
+		var summary TraceSummary
+		roots[i], summary = buildSpanTree(traceId, entries)
+		if i == 0 {
+			diff.A = summary
+		} else {
+			diff.B = summary
+		}
+	}
+	diff.DurationDeltaMs = diff.B.DurationMs - diff.A.DurationMs
+
+	d := traceDiffer{diff: &diff, ignore: ignore}
+	d.align(roots[0], roots[1], 0)
+	return &diff, nil
+}
+
+// buildSpanTree returns the root spans of the entries of a trace, each span with
+// its children in order of their start. Entries without a span are spans of their own.
+func buildSpanTree(traceId string, entries []Entry) ([]*TraceSpan, TraceSummary) {
+	spans := make(map[string]*TraceSpan)
+	ordered := make([]*TraceSpan, 0)
+	parents := make(map[*TraceSpan]string)
+	for _, e := range entries {
+		id := e.SpanId
+		if id == "" {
+			id = fmt.Sprintf("seq:%d", e.Seq)
+		}
+		s, ok := spans[id]
+		if !ok {
+			s = &TraceSpan{Seq: e.Seq, SpanId: e.SpanId, source: e.Source, typ: e.Type,
+				start: e.FirstPublished, end: e.Published, context: make(map[string]interface{})}
+			spans[id] = s
+			ordered = append(ordered, s)
+			parents[s] = e.ParentSpanId
+		}
+		if e.FirstPublished.Before(s.start) {
+			s.start = e.FirstPublished
+		}
+		if e.Published.After(s.end) {
+			s.end = e.Published
+		}
+		for k, v := range e.Context {
+			s.context[k] = v
+		}
+	}
+
+	summary := TraceSummary{TraceId: traceId, Spans: len(ordered)}
+	traceStart, traceEnd := ordered[0].start, ordered[0].end
+	for _, s := range ordered {
+		if s.start.Before(traceStart) {
+			traceStart = s.start
+		}
+	}
+	roots := make([]*TraceSpan, 0)
+	for _, s := range ordered {
+		s.OffsetMs = milliseconds(s.start.Sub(traceStart))
+		if ms, ok := s.context["duration_ms"].(float64); ok {
+			s.DurationMs = &ms
+		} else if s.end.After(s.start) {
+			ms := milliseconds(s.end.Sub(s.start))
+			s.DurationMs = &ms
+		}
+		end := s.end
+		if s.DurationMs != nil {
+			if e := s.start.Add(time.Duration(*s.DurationMs * float64(time.Millisecond))); e.After(end) {
+				end = e
+			}
+		}
+		if end.After(traceEnd) {
+			traceEnd = end
+		}
+
+		if parent, ok := spans[parents[s]]; ok && parent != s {
+			parent.children = append(parent.children, s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+	summary.DurationMs = milliseconds(traceEnd.Sub(traceStart))
+
+	sortSpans(roots)
+	for _, s := range ordered {
+		sortSpans(s.children)
+	}
+	return roots, summary
+}
+
+func sortSpans(spans []*TraceSpan) {
+	sort.SliceStable(spans, func(i, j int) bool {
+		if !spans[i].start.Equal(spans[j].start) {
+			return spans[i].start.Before(spans[j].start)
+		}
+		return spans[i].Seq < spans[j].Seq
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type traceDiffer struct {
+	diff   *TraceDiff
+	ignore []string
+}
+
+// align appends the diffs of sibling spans a and b and their descendants at the depth.
+func (d traceDiffer) align(a, b []*TraceSpan, depth int) {
+	// match the n-th span of each source and type
+	matchA := make([]int, len(a))
+	matchB := make([]int, len(b))
+	positions := make(map[string][]int)
+	for i, s := range a {
+		matchA[i] = -1
+		k := s.source + "\x00" + s.typ
+		positions[k] = append(positions[k], i)
+	}
+	for j, s := range b {
+		matchB[j] = -1
+		k := s.source + "\x00" + s.typ
+		if len(positions[k]) > 0 {
+			i := positions[k][0]
+			positions[k] = positions[k][1:]
+			matchA[i], matchB[j] = j, i
+		}
+	}
+	inOrder := longestInOrder(matchB)
+
+	// spans in the order of b, with the missing spans after their preceding siblings
+	// in a that are in order
+	missingAfter := func(i int) {
+		for i++; i < len(a) && (matchA[i] == -1 || !inOrder[matchA[i]]); i++ {
+			if matchA[i] == -1 {
+				d.missing(a[i], depth)
+			}
+		}
+	}
+	missingAfter(-1)
+	for j, s := range b {
+		i := matchB[j]
+		if i == -1 {
+			d.added(s, depth)
+			continue
+		}
+		if !inOrder[j] {
+			d.diff.Reordered++
+			d.matched(a[i], s, SpanReordered, depth)
+			continue
+		}
+		d.matched(a[i], s, SpanMatched, depth)
+		missingAfter(i)
+	}
+}
+
+// longestInOrder returns which of the matched b spans are in the longest run of
+// increasing a indexes, so that the others are the ones reordered.
+func longestInOrder(matchB []int) []bool {
+	// patience sorting: tails[k] is the b index ending the best run of length k+1
+	tails := make([]int, 0)
+	prev := make([]int, len(matchB))
+	for j, i := range matchB {
+		prev[j] = -1
+		if i == -1 {
+			continue
+		}
+		k := sort.Search(len(tails), func(k int) bool { return matchB[tails[k]] >= i })
+		if k > 0 {
+			prev[j] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, j)
+		} else {
+			tails[k] = j
+		}
+	}
+	inOrder := make([]bool, len(matchB))
+	if len(tails) > 0 {
+		for j := tails[len(tails)-1]; j != -1; j = prev[j] {
+			inOrder[j] = true
+		}
+	}
+	return inOrder
+}
+
+func (d traceDiffer) matched(a, b *TraceSpan, status string, depth int) {
+	sd := SpanDiff{Status: status, Depth: depth, Source: b.source, Type: b.typ, A: a, B: b}
+	offsetDelta := b.OffsetMs - a.OffsetMs
+	sd.OffsetDeltaMs = &offsetDelta
+	if a.DurationMs != nil && b.DurationMs != nil {
+		durationDelta := *b.DurationMs - *a.DurationMs
+		sd.DurationDeltaMs = &durationDelta
+	}
+	sd.Changes = d.changes(a.context, b.context)
+	if len(sd.Changes) > 0 {
+		d.diff.Changed++
+	}
+	d.diff.Spans = append(d.diff.Spans, sd)
+	d.align(a.children, b.children, depth+1)
+}
+
+func (d traceDiffer) added(b *TraceSpan, depth int) {
+	d.diff.Added++
+	d.diff.Spans = append(d.diff.Spans, SpanDiff{Status: SpanAdded, Depth: depth, Source: b.source, Type: b.typ, B: b})
+	for _, c := range b.children {
+		d.added(c, depth+1)
+	}
+}
+
+func (d traceDiffer) missing(a *TraceSpan, depth int) {
+	d.diff.Missing++
+	d.diff.Spans = append(d.diff.Spans, SpanDiff{Status: SpanMissing, Depth: depth, Source: a.source, Type: a.typ, A: a})
+	for _, c := range a.children {
+		d.missing(c, depth+1)
+	}
+}
+
+// changes returns the differing leaf values of the contexts, except the duration.
+func (d traceDiffer) changes(a, b map[string]interface{}) []ContextChange {
+	leavesA := make(map[string]interface{})
+	leavesB := make(map[string]interface{})
+	flattenContext(a, "context", leavesA)
+	flattenContext(b, "context", leavesB)
+	delete(leavesA, "context.duration_ms")
+	delete(leavesB, "context.duration_ms")
+
+	fields := make([]string, 0, len(leavesA)+len(leavesB))
+	for field := range leavesA {
+		fields = append(fields, field)
+	}
+	for field := range leavesB {
+		if _, ok := leavesA[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := make([]ContextChange, 0)
+	for _, field := range fields {
+		if d.ignored(field) {
+			continue
+		}
+		va, okA := leavesA[field]
+		vb, okB := leavesB[field]
+		if okA != okB || !reflect.DeepEqual(va, vb) {
+			changes = append(changes, ContextChange{Field: field, A: va, B: vb})
+		}
+	}
+	return changes
+}
+
+func (d traceDiffer) ignored(field string) bool {
+	for _, prefix := range d.ignore {
+		if field == prefix || strings.HasPrefix(field, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenContext puts the non-object values of m into leaves by their paths.
+func flattenContext(m map[string]interface{}, path string, leaves map[string]interface{}) {
+	for k, v := range m {
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flattenContext(child, path+"."+k, leaves)
+		} else {
+			leaves[path+"."+k] = v
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package wal is a write-ahead log of records in numbered segment files in a
+// directory. Appended records are fsynced before Append returns, with
+// concurrent appends sharing an fsync, and are read back in order from a
+// Position until the segments before it are truncated. The directory is synced
+// when segments and the log's id are created, so they survive a crash too.
+package wal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SegmentSize is the size after which appends go to a new segment.
+const SegmentSize = 64 << 20
+
+// MaxRecordSize is the largest record that can be appended.
+const MaxRecordSize = 16 << 20
+
+const (
+	segmentExt = ".wal"
+	idFile     = "id"
+	headerSize = 8 // length and CRC-32C of the record
+)
+
+var (
+	ErrClosed   = errors.New("wal: log is closed")
+	ErrTooLarge = errors.New("wal: record too large")
+	errCorrupt  = errors.New("wal: corrupt record")
+	castagnoli  = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Position is the position of a record in the log.
+type Position struct {
+	Segment int64
+	Offset  int64
+}
+
+func (p Position) Before(q Position) bool {
+	return p.Segment < q.Segment || p.Segment == q.Segment && p.Offset < q.Offset
+}
+
+type Log struct {
+	dir      string
+	id       string
+	appended chan struct{}
+
+	// syncMu is held while syncing and rotating so that the file being synced isn't closed.
+	syncMu sync.Mutex
+
+	mu     sync.Mutex
+	file   *os.File
+	end    Position
+	synced Position
+	closed bool
+}
+
+// Open opens the log in dir, creating it if needed. A partially written record
+// at the end of the last segment, from a crash while appending, is discarded.
+func Open(dir string) (*Log, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err = syncDir(filepath.Dir(dir)); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	id, err := readId(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, id: id, appended: make(chan struct{}, 1)}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	last := int64(1)
+	if len(segments) != 0 {
+		last = segments[len(segments)-1]
+	}
+	file, err := os.OpenFile(l.segmentPath(last), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		// the first segment must not vanish in a crash once records are synced to it
+		if err = syncDir(dir); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	size, err := validSize(file)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.file = file
+	l.end = Position{last, size}
+	l.synced = l.end
+	return l, nil
+}
+
+// readId returns the id of the log, which is generated when the log is created.
+// A new id is written to a temporary file that is synced and renamed, so that a
+// crash leaves either no id file or a complete one that survives.
+func readId(dir string) (string, error) {
+	path := filepath.Join(dir, idFile)
+	id, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(id)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	newId := hex.EncodeToString(b)
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write([]byte(newId + "\n"))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return newId, nil
+}
+
+// syncDir syncs the directory so that files created or renamed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// validSize returns the size of the complete, valid records at the start of the file.
+func validSize(file *os.File) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	var size int64
+	for {
+		_, n, err := readRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorrupt {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+}
+
+// Id identifies the log, e.g. to checkpoint the position read up to elsewhere.
+func (l *Log) Id() string {
+	return l.id
+}
+
+// Appended receives after records are appended.
+func (l *Log) Appended() <-chan struct{} {
+	return l.appended
+}
+
+// Append appends the record and returns once it is synced to disk.
+func (l *Log) Append(record []byte) error {
+	if len(record) > MaxRecordSize {
+		return ErrTooLarge
+	}
+	buf := make([]byte, headerSize+len(record))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(record, castagnoli))
+	copy(buf[headerSize:], record)
+
+	l.mu.Lock()
+	if l.end.Offset+int64(len(buf)) > SegmentSize && l.end.Offset > 0 {
+		l.mu.Unlock()
+		if err := l.rotate(int64(len(buf))); err != nil {
+			return err
+		}
+		l.mu.Lock()
+	}
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	if _, err := l.file.Write(buf); err != nil {
+		// don't leave a partial record for later appends to follow
+		l.file.Truncate(l.end.Offset)
+		l.file.Seek(l.end.Offset, io.SeekStart)
+		l.mu.Unlock()
+		return err
+	}
+	l.end.Offset += int64(len(buf))
+	end := l.end
+	l.mu.Unlock()
+
+	if err := l.sync(end); err != nil {
+		return err
+	}
+	select {
+	case l.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sync syncs the current segment if it hasn't already been synced up to end
+// by a concurrent append.
+func (l *Log) sync(end Position) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	if !l.synced.Before(end) {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	file := l.file
+	to := l.end
+	l.mu.Unlock()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.synced = to
+	l.mu.Unlock()
+	return nil
+}
+
+// rotate syncs and closes the current segment if size more doesn't fit, and starts the next.
+func (l *Log) rotate(size int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.end.Offset+size <= SegmentSize || l.end.Offset == 0 {
+		// rotated by a concurrent append
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	next := l.end.Segment + 1
+	file, err := os.OpenFile(l.segmentPath(next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syncDir(l.dir); err != nil {
+		file.Close()
+		os.Remove(l.segmentPath(next))
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.end = Position{next, 0}
+	l.synced = l.end
+	return nil
+}
+
+// Read returns up to max synced records from the position, and the position after them.
+// A position before the first segment reads from the start of the log.
+func (l *Log) Read(from Position, max int) ([][]byte, Position, error) {
+	l.mu.Lock()
+	synced := l.synced
+	l.mu.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, from, err
+	}
+	if len(segments) != 0 && from.Segment < segments[0] {
+		from = Position{segments[0], 0}
+	}
+
+	records := make([][]byte, 0)
+	pos := from
+	for len(records) < max && pos.Before(synced) {
+		file, err := os.Open(l.segmentPath(pos.Segment))
+		if err != nil {
+			return nil, from, err
+		}
+		if _, err = file.Seek(pos.Offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, from, err
+		}
+		r := bufio.NewReader(file)
+		for len(records) < max && pos.Before(synced) {
+			record, n, err := readRecord(r)
+			if err == io.EOF && pos.Segment < synced.Segment {
+				break
+			} else if err != nil {
+				file.Close()
+				return nil, from, fmt.Errorf("wal: segment %d offset %d: %v", pos.Segment, pos.Offset, err)
+			}
+			records = append(records, record)
+			pos.Offset += n
+		}
+		file.Close()
+		if len(records) < max && pos.Segment < synced.Segment {
+			pos = Position{pos.Segment + 1, 0}
+		}
+	}
+	return records, pos, nil
+}
+
+func readRecord(r *bufio.Reader) ([]byte, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > MaxRecordSize {
+		return nil, 0, errCorrupt
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.Checksum(record, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	return record, int64(headerSize + size), nil
+}
+
+// Truncate removes the segments that are entirely before the position.
+func (l *Log) Truncate(before Position) error {
+	l.mu.Lock()
+	current := l.end.Segment
+	l.mu.Unlock()
+
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment >= before.Segment || segment >= current {
+			break
+		}
+		if err = os.Remove(l.segmentPath(segment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *Log) segmentPath(segment int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", segment, segmentExt))
+}
+
+// segments returns the segment numbers in order.
+func (l *Log) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int64, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), segmentExt), 10, 64); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
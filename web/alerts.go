@@ -0,0 +1,57 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const alertInterval = 30 * time.Second
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func evaluateAlerts(db *sql.DB) {
+	for range time.Tick(alertInterval) {
+		alerts, err := storage.EvaluateAlertRules(db, context.Background())
+		if err != nil {
+			log.Printf("Error evaluating alert rules: %v\n", err)
+		}
+		for _, alert := range alerts {
+			if alert.Webhook.URL == "" {
+				continue
+			}
+			if err := sendAlert(alert); err != nil {
+				log.Printf("Error sending alert '%s' of project %d: %v\n", alert.Rule, alert.ProjectId, err)
+			}
+		}
+	}
+}
+
+// sendAlert POSTs the alert to its webhook, as the Alert or as a Slack message.
+func sendAlert(alert storage.Alert) error {
+	var payload interface{} = alert
+	if alert.Webhook.Format == storage.AlertFormatSlack {
+		payload = map[string]string{"text": alert.Message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(alert.Webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+type EntitiesHandler struct {
+	db *sql.DB
+}
+
+func NewEntitiesHandler(db *sql.DB) *EntitiesHandler {
+	return &EntitiesHandler{db: db}
+}
+
+func (h *EntitiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		if r.URL.Path == "/entities" || r.URL.Path == "/entities/" {
+			h.listEntities(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/timeline") {
+			h.listTimeline(w, r)
+		} else {
+			respondStatus(http.StatusNotFound, w)
+		}
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// listEntities lists the most recently seen entities of a 'kind' (e.g. 'user')
+// since 'published' (default the last 24 hours).
+func (h *EntitiesHandler) listEntities(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, ok := requestProjectId(r, h.db)
+	if !ok {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	if kind == "" {
+		badRequest("'kind' is required", w)
+		return
+	}
+
+	publishedMin := time.Now().Add(-24 * time.Hour)
+	if r.FormValue("published") != "" {
+		var ok bool
+		if publishedMin, _, ok = parseTimeRange("published", r); !ok || publishedMin.IsZero() {
+			badRequest("'published' must be 'from,' in RFC 3339 format", w)
+			return
+		}
+	}
+
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	entities, err := storage.ListEntities(projectId, kind, publishedMin, count, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	respondOK(entities, w)
+}
+
+// listTimeline lists the entries in which the entity at /entities/{kind:id}/timeline
+// is the actor, object or target.
+func (h *EntitiesHandler) listTimeline(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	entity := strings.TrimSuffix(strings.TrimPrefix(r.URL.EscapedPath(), "/entities/"), "/timeline")
+	entity, err := url.PathUnescape(entity)
+	if err != nil || entity == "" {
+		badRequest("entity must be /entities/{kind:id}/timeline", w)
+		return
+	}
+
+	projectId, ok := requestProjectId(r, h.db)
+	if !ok {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+
+	seqMin, seqMax, ok := parseIntRange("seq", r)
+	if !ok {
+		badRequest("'seq' must be 'from,' or ',to' or 'from,to' (integer values)", w)
+		return
+	}
+	publishedMin, publishedMax, ok := parseTimeRange("published", r)
+	if !ok {
+		badRequest("'published' must be 'from,' or ',to' or 'from,to' in RFC 3339 format", w)
+		return
+	}
+
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	entries, err := storage.ListEntityTimeline(projectId, entity, seqMin, seqMax, publishedMin, publishedMax,
+		count, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	respondOK(entries, w)
+}
+
+// parseCount returns the 'count' parameter, 100 by default.
+func parseCount(r *http.Request) (int, bool) {
+	value := r.FormValue("count")
+	if value == "" {
+		return 100, true
+	}
+	count, err := strconv.Atoi(value)
+	return count, err == nil && count >= 1 && count <= 1000
+}
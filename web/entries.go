@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,11 +12,17 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/karmakaze/quicklog/enrich"
 	"github.com/karmakaze/quicklog/storage"
+	"github.com/karmakaze/quicklog/storage/query"
 )
 
 type EntriesHandler struct {
 	db *sql.DB
+	// ingest, if set, is where POSTed entries go to be written asynchronously
+	ingest *ingestWriter
+	// usage, if set, enforces the projects' ingest limits
+	usage *usageTracker
 }
 
 func NewEntriesHandler(db *sql.DB) *EntriesHandler {
@@ -23,6 +30,11 @@ func NewEntriesHandler(db *sql.DB) *EntriesHandler {
 }
 
 func (h *EntriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/entries/") {
+		h.serveEntry(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "OPTIONS":
 		respondNoContent(w)
@@ -40,80 +52,186 @@ func (h *EntriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (h *EntriesHandler) listEntries(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
-    projectId := 0
-    if r.Referer() != "" {
-        if refererUrl, err := url.Parse(r.Referer()); err == nil {
-            projects := make([]storage.Project, 0, 1)
-            if err := storage.ListProjects("domain", refererUrl.Hostname(), &projects, h.db, r.Context()); err == nil {
-                for _, p := range projects {
-                    projectId = int(p.Id)
-                }
-            }
-        } else {
-            log.Printf("Could not parse 'referer' URL: %s\n'", r.Referer())
-        }
-    }
-
-    if projectId == 0 {
-        var err error
-        if projectId, err = strconv.Atoi(r.FormValue("project_id")); err != nil {
-            badRequest("'project_id' is required (numeric)", w)
-            return
-        }
-    }
+	filter, message := parseEntryFilter(r, h.db)
+	if message != "" {
+		badRequest(message, w)
+		return
+	}
 
-	seqMin, seqMax, ok := parseIntRange("seq", r)
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	entries, err := storage.ListEntries(filter, count, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	respondOK(entries, w)
+}
+
+// serveEntry serves /entries/{seq} and /entries/{seq}/around.
+func (h *EntriesHandler) serveEntry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+		return
+	case "GET":
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+		return
+	}
 
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/entries/"), "/", 2)
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || seq <= 0 {
+		badRequest("seq must be numeric", w)
+		return
+	}
+	if len(parts) == 2 && parts[1] != "around" {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+
+	r.ParseForm()
+	projectId, ok := requestProjectId(r, h.db)
 	if !ok {
-		badRequest("'seq' must be 'from,' or ',to' or 'from,to' (integer values)", w)
+		badRequest("'project_id' is required (numeric)", w)
 		return
 	}
-	publishedMin, publishedMax, ok := parseTimeRange("published", r)
+	entry, err := storage.GetEntry(projectId, seq, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	if entry == nil {
+		sendMessage(http.StatusNotFound, fmt.Sprintf("entry %d not found", seq), w)
+		return
+	}
+	if len(parts) == 1 {
+		respondOK(entry, w)
+		return
+	}
+	h.listEntriesAround(*entry, w, r)
+}
+
+// listEntriesAround responds with the entry and the 'before' (default 10) entries
+// preceding it and 'after' (default 10) following it, in its project or the 'scope'
+// of the same source, actor or trace.
+func (h *EntriesHandler) listEntriesAround(entry storage.Entry, w http.ResponseWriter, r *http.Request) {
+	before, ok := parseAroundCount("before", r)
 	if !ok {
-		badRequest("'published' must be 'from,' or ',to' or 'from,to' in RFC 3339 format", w)
+		badRequest("'before' must be between 0 to 1000", w)
 		return
 	}
-	if (seqMin != storage.MinInt || seqMax != storage.MaxInt) && (!publishedMin.IsZero() || !publishedMax.IsZero()) {
-		badRequest("'seq' and 'published' cannot both be specified", w)
+	after, ok := parseAroundCount("after", r)
+	if !ok {
+		badRequest("'after' must be between 0 to 1000", w)
+		return
+	}
+
+	scope := r.FormValue("scope")
+	switch scope {
+	case "":
+		scope = storage.AroundProject
+	case storage.AroundProject, storage.AroundSource, storage.AroundActor:
+	case storage.AroundTrace:
+		if entry.TraceId == "" {
+			badRequest(fmt.Sprintf("entry %d has no 'trace_id'", entry.Seq), w)
+			return
+		}
+	default:
+		badRequest(fmt.Sprintf("'scope' must be '%s', '%s', '%s' or '%s'", storage.AroundProject,
+			storage.AroundSource, storage.AroundActor, storage.AroundTrace), w)
 		return
 	}
 
+	preceding, following, err := storage.ListEntriesAround(entry, scope, before, after, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	around := struct {
+		Before []storage.Entry `json:"before"`
+		Entry  storage.Entry   `json:"entry"`
+		After  []storage.Entry `json:"after"`
+	}{Before: preceding, Entry: entry, After: following}
+	respondOK(around, w)
+}
+
+func parseAroundCount(name string, r *http.Request) (int, bool) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 10, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= 0 && n <= 1000
+}
+
+// parseEntryFilter parses the GET /entries filter parameters, returning a
+// message for the first invalid one.
+func parseEntryFilter(r *http.Request, db *sql.DB) (storage.EntryFilter, string) {
+	var filter storage.EntryFilter
+
+	projectId, ok := requestProjectId(r, db)
+	if !ok {
+		return filter, "'project_id' is required (numeric)"
+	}
+
+	seqMin, seqMax, ok := parseIntRange("seq", r)
+	if !ok {
+		return filter, "'seq' must be 'from,' or ',to' or 'from,to' (integer values)"
+	}
+	publishedMin, publishedMax, ok := parseTimeRange("published", r)
+	if !ok {
+		return filter, "'published' must be 'from,' or ',to' or 'from,to' in RFC 3339 format"
+	}
+	if (seqMin != storage.MinInt || seqMax != storage.MaxInt) && (!publishedMin.IsZero() || !publishedMax.IsZero()) {
+		return filter, "'seq' and 'published' cannot both be specified"
+	}
+
 	traceId := r.FormValue("trace_id")
 	spanId := r.FormValue("span_id")
 	search := r.FormValue("search")
 	tag := r.FormValue("tag")
 	if search != "" && tag != "" {
-		badRequest("'tag' cannot be specified with 'search'", w)
-		return
+		return filter, "'tag' cannot be specified with 'search'"
 	}
 	if tag != "" {
-		search = "tag:" + search
+		// quote the key and value so that the tag is matched exactly rather than as a search
+		if i := strings.Index(tag, ":"); i != -1 {
+			search = "tag:" + query.Quote(tag[:i]) + ":" + query.Quote(tag[i+1:])
+		} else {
+			search = "tag:" + query.Quote(tag)
+		}
 	}
 	if (traceId != "" || spanId != "") && (search != "" || tag != "") {
-		badRequest("'trace_id' or 'span_id' cannot be specified with 'search'/'tag'", w)
-		return
+		return filter, "'trace_id' or 'span_id' cannot be specified with 'search'/'tag'"
 	}
 	if traceId != "" && spanId != "" && traceId != spanId {
-		badRequest("'trace_id' and 'span_id' cannot both be specified (unless they are the same)", w)
-		return
+		return filter, "'trace_id' and 'span_id' cannot both be specified (unless they are the same)"
 	}
 
-	count := 100
-	if value := r.FormValue("count"); value != "" {
-	    var err error
-		if count, err = strconv.Atoi(value); err != nil || count < 1 || count > 1000 {
-			badRequest("'count' must be between 1 to 1000", w)
-			return
-		}
+	contextFilters, err := parseContextFilters(r)
+	if err != nil {
+		return filter, err.Error()
 	}
 
-	entries, err := storage.ListEntries(projectId, seqMin, seqMax, publishedMin, publishedMax,
-		traceId, spanId, search, count, h.db, r.Context())
-	if err != nil {
-		badRequest(err.Error(), w)
-		return
+	filter = storage.EntryFilter{
+		ProjectId:    projectId,
+		SeqMin:       seqMin,
+		SeqMax:       seqMax,
+		PublishedMin: publishedMin,
+		PublishedMax: publishedMax,
+		TraceId:      traceId,
+		SpanId:       spanId,
+		Search:       search,
+		Context:      contextFilters,
+		Text:         r.FormValue("q"),
 	}
-	respondOK(entries, w)
+	return filter, ""
 }
 
 func (h *EntriesHandler) createEntry(w http.ResponseWriter, r *http.Request) {
@@ -125,34 +243,53 @@ func (h *EntriesHandler) createEntry(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
 	if err != nil {
+		if len(body) >= maxRequestBytes {
+			sendMessage(http.StatusRequestEntityTooLarge, fmt.Sprintf("payload is larger than %d bytes", maxRequestBytes), w)
+			return
+		}
 		badRequest(fmt.Sprintf("Error reading POST /entries body: %v", err), w)
 		return
 	}
 
+	if isJsonArray(body) {
+		h.createEntries(body, w, r)
+		return
+	}
+
 	var entry storage.Entry
 	if err = json.Unmarshal(body, &entry); err != nil {
 		badRequest(fmt.Sprintf("Error parsing POST /entries body: %v\n", err), w)
 		return
 	}
 
-	if entry.ProjectId <= 0 {
-		badRequest("'project_id' is required", w)
+	if message := validateEntry(&entry); message != "" {
+		badRequest(message, w)
 		return
 	}
 
-	entry.Seq = 0
-	if entry.Published.IsZero() {
-		badRequest("'published' is required", w)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		entry.EventId = key
+	}
+
+	entries := []storage.Entry{entry}
+	if !h.checkSchemas(entries, w, r) {
 		return
 	}
-	if entry.Source == "" {
-		badRequest("'source' is required", w)
+	a, ok := h.admit(entries, len(body), w, r)
+	if !ok {
 		return
 	}
-	if entry.Type == "" {
-		badRequest("'type' is required", w)
+	if err = prepareEntries(entries, h.db, r.Context()); err != nil {
+		h.failed(a)
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	entry = entries[0]
+
+	if h.ingest != nil {
+		h.appendEntries(entries, a, w)
 		return
 	}
 
@@ -160,19 +297,267 @@ func (h *EntriesHandler) createEntry(w http.ResponseWriter, r *http.Request) {
 
 	tx, err := h.db.BeginTx(r.Context(), nil)
 	if err != nil {
+		h.failed(a)
 		respondError(http.StatusInternalServerError, err, w)
 		return
 	}
-	if err = storage.CreateEntry(entry, tx, r.Context()); err != nil {
+	// a replay of an idempotency key is resolved to the original entry, not written again
+	var seq int64
+	if entry.EventId != "" {
+		if seq, err = storage.LookupIdempotencyKey(entry.ProjectId, entry.EventId, tx, r.Context()); err != nil {
+			tx.Rollback()
+			h.failed(a)
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+	}
+	if seq != 0 {
 		tx.Rollback()
-		if !storage.IsUniqueViolation(err) {
+		h.failed(a)
+	} else if seq, err = storage.CreateEntry(entry, tx, r.Context()); err != nil {
+		tx.Rollback()
+		h.failed(a)
+		if !storage.IsUniqueViolation(err) || entry.EventId == "" {
 			respondError(http.StatusInternalServerError, err, w)
 			return
 		}
+		// a concurrent request with the same idempotency key won
+		if seq, err = storage.LookupIdempotencyKeyDB(entry.ProjectId, entry.EventId, h.db, r.Context()); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+	} else if err = tx.Commit(); err != nil {
+		h.failed(a)
+		respondError(http.StatusInternalServerError, err, w)
+		return
 	} else {
-		tx.Commit()
+		h.written(a)
+	}
+	respondCreated(entryUrl(entry.ProjectId, seq), w)
+}
+
+// createEntries creates a JSON array of entries in a single transaction and
+// responds with their seqs. Entries should have an 'event_id' so that a failed
+// batch can be safely retried.
+func (h *EntriesHandler) createEntries(body []byte, w http.ResponseWriter, r *http.Request) {
+	var entries []storage.Entry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		badRequest(fmt.Sprintf("Error parsing POST /entries body: %v\n", err), w)
+		return
+	}
+	if len(entries) == 0 || len(entries) > maxBatchSize {
+		badRequest(fmt.Sprintf("batch must have between 1 to %d entries", maxBatchSize), w)
+		return
+	}
+	for i := range entries {
+		if message := validateEntry(&entries[i]); message != "" {
+			badRequest(fmt.Sprintf("entry %d: %s", i, message), w)
+			return
+		}
+	}
+
+	if !h.checkSchemas(entries, w, r) {
+		return
+	}
+	a, ok := h.admit(entries, len(body), w, r)
+	if !ok {
+		return
+	}
+	if err := prepareEntries(entries, h.db, r.Context()); err != nil {
+		h.failed(a)
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+
+	if h.ingest != nil {
+		h.appendEntries(entries, a, w)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		h.failed(a)
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	seqs := make([]int64, len(entries))
+	for i, entry := range entries {
+		if entry.EventId != "" {
+			if seqs[i], err = storage.LookupIdempotencyKey(entry.ProjectId, entry.EventId, tx, r.Context()); err != nil {
+				tx.Rollback()
+				h.failed(a)
+				respondError(http.StatusInternalServerError, err, w)
+				return
+			}
+			if seqs[i] != 0 {
+				h.replayed(a, entry.ProjectId)
+				continue
+			}
+		}
+		if seqs[i], err = storage.CreateEntry(entry, tx, r.Context()); err != nil {
+			tx.Rollback()
+			h.failed(a)
+			if storage.IsUniqueViolation(err) {
+				sendMessage(http.StatusConflict, "concurrent batch with the same 'event_id', retry", w)
+				return
+			}
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		h.failed(a)
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	h.written(a)
+	sendData(http.StatusCreated, seqs, w)
+}
+
+const (
+	maxBatchSize = 1000
+	// maxRequestBytes caps the POST /entries body read, before a project's
+	// max_payload_bytes (which needs the body parsed to know the project).
+	maxRequestBytes = 16 << 20
+)
+
+// admit returns true, and the admission to count once the entries are written, if
+// the entries of the request body are within their projects' limits, or else
+// responds with why not.
+func (h *EntriesHandler) admit(entries []storage.Entry, size int, w http.ResponseWriter, r *http.Request) (*admission, bool) {
+	if h.usage == nil {
+		return nil, true
+	}
+	a, le, err := h.usage.admit(entries, int64(size), r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return nil, false
+	}
+	if le != nil {
+		respondLimited(le, w)
+		return nil, false
+	}
+	return a, true
+}
+
+// written counts the usage of the admitted entries once they are written.
+func (h *EntriesHandler) written(a *admission) {
+	if a != nil {
+		h.usage.written(a)
+	}
+}
+
+// replayed takes back the admission of an entry of the project that was a
+// replay of an idempotency key, so that the rest are counted by written.
+func (h *EntriesHandler) replayed(a *admission, projectId int32) {
+	if a != nil {
+		h.usage.replayed(a, projectId)
+	}
+}
+
+// failed takes back the admission of entries that weren't written.
+func (h *EntriesHandler) failed(a *admission) {
+	if a != nil {
+		h.usage.failed(a)
+	}
+}
+
+// appendEntries appends the entries to the ingest log and responds 202 Accepted
+// once they are durable.
+func (h *EntriesHandler) appendEntries(entries []storage.Entry, a *admission, w http.ResponseWriter) {
+	if err := h.ingest.append(entries); err != nil {
+		h.failed(a)
+		respondError(http.StatusServiceUnavailable, err, w)
+		return
+	}
+	h.written(a)
+	respondStatus(http.StatusAccepted, w)
+}
+
+func isJsonArray(body []byte) bool {
+	for _, b := range body {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b == '['
+	}
+	return false
+}
+
+// prepareEntries runs the enrichers of the entries' projects on them and then applies their redaction
+// rules, so that enriched data is redacted too.
+func prepareEntries(entries []storage.Entry, db *sql.DB, ctx context.Context) error {
+	if err := enrich.Entries(entries, db, ctx); err != nil {
+		return err
+	}
+	return redactEntries(entries, db, ctx)
+}
+
+// redactEntries applies the redaction rules of the entries' projects to them in place.
+func redactEntries(entries []storage.Entry, db *sql.DB, ctx context.Context) error {
+	redactions := make(map[int32]*storage.Redaction)
+	for i := range entries {
+		redaction, ok := redactions[entries[i].ProjectId]
+		if !ok {
+			var err error
+			if redaction, err = storage.GetRedaction(entries[i].ProjectId, db, ctx); err != nil {
+				return err
+			}
+			redactions[entries[i].ProjectId] = redaction
+		}
+		if redaction != nil {
+			redaction.Apply(&entries[i])
+		}
+	}
+	return nil
+}
+
+// validateEntry returns a message for the first missing required field, or "".
+func validateEntry(entry *storage.Entry) string {
+	if entry.ProjectId <= 0 {
+		return "'project_id' is required"
+	}
+
+	entry.Seq = 0
+	if entry.Published.IsZero() {
+		return "'published' is required"
+	}
+	if entry.Source == "" {
+		return "'source' is required"
+	}
+	if entry.Type == "" {
+		return "'type' is required"
+	}
+	if len(entry.Tags) > 0 && entry.TraceId == "" {
+		return "'tags' require a 'trace_id'"
+	}
+	return ""
+}
+
+// requestProjectId returns the project of the 'referer' domain, or else the 'project_id' parameter.
+func requestProjectId(r *http.Request, db *sql.DB) (int, bool) {
+	if r.Referer() != "" {
+		if refererUrl, err := url.Parse(r.Referer()); err == nil {
+			projects := make([]storage.Project, 0, 1)
+			if err := storage.ListProjects("domain", refererUrl.Hostname(), &projects, db, r.Context()); err == nil &&
+				len(projects) != 0 {
+				return int(projects[len(projects)-1].Id), true
+			}
+		} else {
+			log.Printf("Could not parse 'referer' URL: %s\n'", r.Referer())
+		}
+	}
+
+	projectId, err := strconv.Atoi(r.FormValue("project_id"))
+	return projectId, err == nil
+}
+
+func entryUrl(projectId int32, seq int64) string {
+	if seq == 0 {
+		return ""
 	}
-	respondCreated("", w)
+	return fmt.Sprintf("/entries?project_id=%d&seq=%d,%d", projectId, seq, seq)
 }
 
 func (h *EntriesHandler) deleteEntries(w http.ResponseWriter, r *http.Request) {
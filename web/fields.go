@@ -0,0 +1,95 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const (
+	fieldValuesInterval = 30 * time.Second
+	fieldValuesDays     = 7
+)
+
+// FieldsHandler serves the values of the entry fields, e.g. for autocomplete in filter UIs.
+type FieldsHandler struct {
+	db *sql.DB
+}
+
+func NewFieldsHandler(db *sql.DB) *FieldsHandler {
+	return &FieldsHandler{db: db}
+}
+
+func (h *FieldsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/fields/"), "/")
+		if len(parts) != 2 || parts[1] != "values" {
+			respondStatus(http.StatusNotFound, w)
+			return
+		}
+		h.listValues(parts[0], w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// listValues responds with the most frequent values of the field starting with
+// the 'prefix', published in the last 'days' (UTC, by default 7, including today).
+func (h *FieldsHandler) listValues(field string, w http.ResponseWriter, r *http.Request) {
+	known := false
+	for _, f := range storage.FieldValueFields {
+		known = known || f == field
+	}
+	if !known {
+		sendMessage(http.StatusNotFound, fmt.Sprintf("field must be one of '%s'",
+			strings.Join(storage.FieldValueFields, "', '")), w)
+		return
+	}
+
+	r.ParseForm()
+
+	projectId, ok := requestProjectId(r, h.db)
+	if !ok {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+	days := fieldValuesDays
+	if value := r.FormValue("days"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days < 1 {
+			badRequest("'days' must be a positive number", w)
+			return
+		}
+	}
+	since := storage.UsageDay(time.Now().AddDate(0, 0, 1-days))
+
+	values, err := storage.ListFieldValues(projectId, field, r.FormValue("prefix"), since, count, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	respondOK(values, w)
+}
+
+func updateFieldValues(db *sql.DB) {
+	for range time.Tick(fieldValuesInterval) {
+		if err := storage.UpdateFieldValues(db, context.Background()); err != nil {
+			log.Printf("Error updating field values: %v\n", err)
+		}
+	}
+}
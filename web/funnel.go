@@ -0,0 +1,160 @@
+package web
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const (
+	funnelMaxSteps      = 10
+	funnelWindowSeconds = 3600
+	funnelSamples       = 10
+	sessionGapSeconds   = 1800
+)
+
+// FunnelHandler serves the conversion of actors through a sequence of steps.
+type FunnelHandler struct {
+	db *sql.DB
+}
+
+func NewFunnelHandler(db *sql.DB) *FunnelHandler {
+	return &FunnelHandler{db: db}
+}
+
+func (h *FunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.getFunnel(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// getFunnel responds with how many groups ('by' actor, the default, or a context.<path>)
+// of the entries selected by the GET /entries filter parameters (by default over the
+// last day) went through each 'step' search in order within 'window_seconds' of the
+// first, with up to 'samples' of those dropping off after each step.
+func (h *FunnelHandler) getFunnel(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	filter, message := parseEntryFilter(r, h.db)
+	if message != "" {
+		badRequest(message, w)
+		return
+	}
+	if filter.Text != "" {
+		badRequest("'q' cannot be specified for a funnel", w)
+		return
+	}
+	if filter.SeqMin == storage.MinInt && filter.SeqMax == storage.MaxInt &&
+		filter.PublishedMin.IsZero() && filter.PublishedMax.IsZero() {
+		filter.PublishedMin = time.Now().Add(-24 * time.Hour)
+	}
+
+	steps := r.Form["step"]
+	if len(steps) < 2 || len(steps) > funnelMaxSteps {
+		badRequest("'step' must be given 2 to 10 times", w)
+		return
+	}
+	window, ok := parseSeconds("window_seconds", funnelWindowSeconds, r)
+	if !ok {
+		badRequest("'window_seconds' must be a positive number", w)
+		return
+	}
+	by := r.FormValue("by")
+	if by == "" {
+		by = "actor"
+	}
+	samples := funnelSamples
+	if value := r.FormValue("samples"); value != "" {
+		var err error
+		if samples, err = strconv.Atoi(value); err != nil || samples < 0 || samples > 100 {
+			badRequest("'samples' must be between 0 to 100", w)
+			return
+		}
+	}
+
+	funnel, err := storage.BuildFunnel(filter, steps, window, by, samples, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	respondOK(funnel, w)
+}
+
+// SessionsHandler serves the sessions of an actor.
+type SessionsHandler struct {
+	db *sql.DB
+}
+
+func NewSessionsHandler(db *sql.DB) *SessionsHandler {
+	return &SessionsHandler{db: db}
+}
+
+func (h *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.listSessions(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// listSessions responds with the latest 'count' sessions of the 'actor' in the entries
+// selected by the GET /entries filter parameters, split where no entries were
+// published for more than 'gap_seconds' (by default 30 minutes).
+func (h *SessionsHandler) listSessions(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	filter, message := parseEntryFilter(r, h.db)
+	if message != "" {
+		badRequest(message, w)
+		return
+	}
+	if filter.Text != "" {
+		badRequest("'q' cannot be specified for sessions", w)
+		return
+	}
+	actor := r.FormValue("actor")
+	if actor == "" {
+		badRequest("'actor' is required", w)
+		return
+	}
+	gap, ok := parseSeconds("gap_seconds", sessionGapSeconds, r)
+	if !ok {
+		badRequest("'gap_seconds' must be a positive number", w)
+		return
+	}
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	sessions, err := storage.ListSessions(filter, actor, gap, count, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	respondOK(sessions, w)
+}
+
+// parseSeconds returns the named positive number of seconds, or the default if not given.
+func parseSeconds(name string, defaultSeconds int, r *http.Request) (time.Duration, bool) {
+	seconds := defaultSeconds
+	if value := r.FormValue(name); value != "" {
+		var err error
+		if seconds, err = strconv.Atoi(value); err != nil || seconds <= 0 {
+			return 0, false
+		}
+	}
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+type GraphHandler struct {
+	db *sql.DB
+}
+
+func NewGraphHandler(db *sql.DB) *GraphHandler {
+	return &GraphHandler{db: db}
+}
+
+func (h *GraphHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.getGraph(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// getGraph responds with the entity/source graph of the entries selected by the
+// GET /entries filter parameters (by default over the last hour) as 'format'
+// json (default), dot (Graphviz) or mermaid (flowchart).
+func (h *GraphHandler) getGraph(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	filter, message := parseEntryFilter(r, h.db)
+	if message != "" {
+		badRequest(message, w)
+		return
+	}
+	if filter.Text != "" {
+		badRequest("'q' cannot be specified for a graph", w)
+		return
+	}
+	if filter.SeqMin == storage.MinInt && filter.SeqMax == storage.MaxInt &&
+		filter.PublishedMin.IsZero() && filter.PublishedMax.IsZero() {
+		filter.PublishedMin = time.Now().Add(-time.Hour)
+	}
+
+	format := r.FormValue("format")
+	switch format {
+	case "", "json", "dot", "mermaid":
+	default:
+		badRequest("'format' must be 'json', 'dot' or 'mermaid'", w)
+		return
+	}
+
+	graph, err := storage.BuildGraph(filter, 10000, h.db, r.Context())
+	if err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+
+	switch format {
+	case "dot":
+		respondText("text/vnd.graphviz; charset=utf-8", graphDot(graph), w)
+	case "mermaid":
+		respondText("text/plain; charset=utf-8", graphMermaid(graph), w)
+	default:
+		respondOK(graph, w)
+	}
+}
+
+func graphDot(g storage.Graph) string {
+	var b strings.Builder
+	b.WriteString("digraph quicklog {\n  rankdir=LR;\n")
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Kind == "source" {
+			shape = "box"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", n.Id, dotQuote(n.Name), shape)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", e.From, e.To, dotQuote(fmt.Sprintf("%s (%d)", e.Type, e.Count)))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func graphMermaid(g storage.Graph) string {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	for _, n := range g.Nodes {
+		if n.Kind == "source" {
+			fmt.Fprintf(&b, "  %s[%s]\n", n.Id, mermaidQuote(n.Name))
+		} else {
+			fmt.Fprintf(&b, "  %s([%s])\n", n.Id, mermaidQuote(n.Name))
+		}
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "  %s -->|%s| %s\n", e.From, mermaidQuote(fmt.Sprintf("%s (%d)", e.Type, e.Count)), e.To)
+	}
+	return b.String()
+}
+
+// mermaidQuote quotes a label, using entity codes for characters that would end it.
+func mermaidQuote(s string) string {
+	s = strings.Replace(s, `"`, "#quot;", -1)
+	s = strings.Replace(s, "|", "#124;", -1)
+	return `"` + s + `"`
+}
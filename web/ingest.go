@@ -0,0 +1,160 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+	"github.com/karmakaze/quicklog/wal"
+)
+
+const (
+	// ingestBatchRecords is the most log records (each a POST /entries body) written in a transaction.
+	ingestBatchRecords = 100
+	ingestInterval     = time.Second
+	ingestMaxBackoff   = 30 * time.Second
+)
+
+// ingestWriter writes the entries appended to a write-ahead log to the database
+// in batches, for the asynchronous ingest mode. The log position written up to
+// is checkpointed with each batch, and the log is replayed from there on restart.
+type ingestWriter struct {
+	log *wal.Log
+	db  *sql.DB
+}
+
+func newIngestWriter(dir string, db *sql.DB) (*ingestWriter, error) {
+	l, err := wal.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &ingestWriter{log: l, db: db}
+	go w.run()
+	return w, nil
+}
+
+// append durably appends the validated entries of a request, to be written later.
+func (w *ingestWriter) append(entries []storage.Entry) error {
+	record, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return w.log.Append(record)
+}
+
+func (w *ingestWriter) run() {
+	ctx := context.Background()
+	segment, offset, err := storage.GetIngestCheckpoint(w.log.Id(), w.db, ctx)
+	for err != nil {
+		log.Printf("Error reading ingest checkpoint: %v\n", err)
+		time.Sleep(ingestMaxBackoff)
+		segment, offset, err = storage.GetIngestCheckpoint(w.log.Id(), w.db, ctx)
+	}
+	pos := wal.Position{Segment: segment, Offset: offset}
+
+	backoff := ingestInterval
+	ticker := time.NewTicker(ingestInterval)
+	defer ticker.Stop()
+	for {
+		next, n, err := w.write(pos, ctx)
+		if err != nil {
+			log.Printf("Error writing ingested entries: %v\n", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > ingestMaxBackoff {
+				backoff = ingestMaxBackoff
+			}
+			continue
+		}
+		backoff = ingestInterval
+		if next != pos {
+			if err = w.log.Truncate(next); err != nil {
+				log.Printf("Error truncating ingest log: %v\n", err)
+			}
+			pos = next
+		}
+		if n == ingestBatchRecords {
+			continue
+		}
+		select {
+		case <-w.log.Appended():
+		case <-ticker.C:
+		}
+	}
+}
+
+// write writes a batch of records from the position, returning the position
+// after them and the number of records.
+func (w *ingestWriter) write(pos wal.Position, ctx context.Context) (wal.Position, int, error) {
+	records, next, err := w.log.Read(pos, ingestBatchRecords)
+	if err != nil || len(records) == 0 {
+		return pos, 0, err
+	}
+
+	entries := make([]storage.Entry, 0, len(records))
+	var bad []badRecord
+	for _, record := range records {
+		var batch []storage.Entry
+		if err = json.Unmarshal(record, &batch); err != nil {
+			// can't happen for records that were appended, but rather than block the log
+			// or drop acknowledged entries, move the record to the dead letter table
+			log.Printf("Error parsing ingest log record at %v (moved to ingest_dead_letter): %v\n", pos, err)
+			bad = append(bad, badRecord{record, err})
+			continue
+		}
+		entries = append(entries, batch...)
+	}
+
+	err = w.writeEntries(entries, bad, next, false, ctx)
+	if storage.IsDataError(err) {
+		// a bad entry would fail the batch forever, so write them one at a time
+		log.Printf("Error writing ingested entries, writing them one at a time: %v\n", err)
+		err = w.writeEntries(entries, bad, next, true, ctx)
+	}
+	if err != nil {
+		return pos, 0, err
+	}
+	return next, len(records), nil
+}
+
+// badRecord is an ingest log record that couldn't be parsed.
+type badRecord struct {
+	record []byte
+	err    error
+}
+
+// writeEntries writes the entries and checkpoints the position after them in a
+// transaction, in a batch or, if each, one at a time with those failing due to
+// their data moved to the dead letter table, as are the bad records.
+func (w *ingestWriter) writeEntries(entries []storage.Entry, bad []badRecord, next wal.Position, each bool, ctx context.Context) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, b := range bad {
+		if err = storage.CreateRecordDeadLetter(w.log.Id(), b.record, b.err, tx, ctx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if !each {
+		err = storage.CreateEntryBatch(entries, tx, ctx)
+	} else {
+		var deadLetters []storage.DeadLetter
+		deadLetters, err = storage.CreateEntriesEach(w.log.Id(), entries, tx, ctx)
+		for _, d := range deadLetters {
+			log.Printf("Error writing ingested entry of project %d (moved to ingest_dead_letter): %v\n",
+				d.Entry.ProjectId, d.Error)
+		}
+	}
+	if err == nil {
+		err = storage.PutIngestCheckpoint(w.log.Id(), next.Segment, next.Offset, tx, ctx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
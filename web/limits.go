@@ -0,0 +1,331 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const usageFlushInterval = 10 * time.Second
+
+// usageTracker enforces the projects' ingest limits (see storage.Limits) and
+// counts their usage, which is flushed to the database periodically. The rate
+// limit is a token bucket per project in this process.
+type usageTracker struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	projects map[int32]*projectUsage
+	// unflushed usage of previous days
+	pending map[int32][]storage.Usage
+}
+
+type projectUsage struct {
+	tokens   float64
+	refilled time.Time
+	// stored is the day's usage in the database as of the last flush, and
+	// unflushed what's been counted since.
+	stored    storage.Usage
+	unflushed storage.Usage
+}
+
+// limitError is why a request is over its project's limits.
+type limitError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func newUsageTracker(db *sql.DB) *usageTracker {
+	t := &usageTracker{db: db,
+		projects: make(map[int32]*projectUsage),
+		pending:  make(map[int32][]storage.Usage),
+	}
+	go t.run()
+	return t
+}
+
+// admission is the usage of a request's admitted entries, counted once they are
+// written (or taken back if they aren't).
+type admission struct {
+	counts map[int32]int64
+	limits map[int32]storage.Limits
+	size   int64
+	total  int64
+}
+
+// admit checks the entries of a request with a body of the size against the
+// limits of their projects, and takes their rate limit tokens if they are all
+// admitted. Their usage is counted by written.
+func (t *usageTracker) admit(entries []storage.Entry, size int64, ctx context.Context) (*admission, *limitError, error) {
+	counts := make(map[int32]int64)
+	limits := make(map[int32]storage.Limits)
+	for _, e := range entries {
+		counts[e.ProjectId]++
+		if _, ok := limits[e.ProjectId]; ok {
+			continue
+		}
+		l, err := storage.GetLimits(e.ProjectId, t.db, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		limits[e.ProjectId] = l
+		if err = t.load(e.ProjectId, ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, e := range entries {
+		if message := checkContext(e.Context, limits[e.ProjectId]); message != "" {
+			if len(entries) > 1 {
+				message = fmt.Sprintf("entry %d: %s", i, message)
+			}
+			t.reject(e.ProjectId, counts[e.ProjectId])
+			return nil, &limitError{status: http.StatusRequestEntityTooLarge, message: message}, nil
+		}
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for projectId, n := range counts {
+		if le := t.check(projectId, n, size, limits[projectId], now); le != nil {
+			t.projects[projectId].unflushed.Rejected += n
+			return nil, le, nil
+		}
+	}
+	for projectId, n := range counts {
+		if limits[projectId].EventsPerSecond > 0 {
+			t.projects[projectId].tokens -= float64(n)
+		}
+	}
+	return &admission{counts: counts, limits: limits, size: size, total: int64(len(entries))}, nil, nil
+}
+
+// written counts the usage of the admitted entries once they are created or
+// appended to the ingest log.
+func (t *usageTracker) written(a *admission) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for projectId, n := range a.counts {
+		p := t.projects[projectId]
+		p.unflushed.Events += n
+		p.unflushed.Bytes += a.size * n / a.total
+	}
+}
+
+// replayed gives back the rate limit token of an admitted entry of the project
+// that was a replay of an idempotency key, and leaves it out of written.
+func (t *usageTracker) replayed(a *admission, projectId int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a.limits[projectId].EventsPerSecond > 0 {
+		t.projects[projectId].tokens++
+	}
+	a.counts[projectId]--
+}
+
+// failed gives back the rate limit tokens of admitted entries that weren't written.
+func (t *usageTracker) failed(a *admission) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for projectId, n := range a.counts {
+		if a.limits[projectId].EventsPerSecond > 0 {
+			t.projects[projectId].tokens += float64(n)
+		}
+	}
+}
+
+// check returns why n events in a request of the size are over the limits, or nil. t.mu is held.
+func (t *usageTracker) check(projectId int32, n, size int64, limits storage.Limits, now time.Time) *limitError {
+	if limits.MaxPayloadBytes > 0 && size > limits.MaxPayloadBytes {
+		return &limitError{status: http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("payload is larger than %d bytes", limits.MaxPayloadBytes)}
+	}
+
+	p := t.projects[projectId]
+	if limits.DailyQuota > 0 && p.stored.Events+p.unflushed.Events+n > limits.DailyQuota {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return &limitError{status: http.StatusTooManyRequests, retryAfter: tomorrow.Sub(now),
+			message: fmt.Sprintf("daily quota of %d events exceeded", limits.DailyQuota)}
+	}
+
+	if limits.EventsPerSecond > 0 {
+		burst := float64(limits.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(limits.EventsPerSecond))
+		}
+		if p.refilled.IsZero() {
+			p.tokens = burst
+		} else {
+			p.tokens = math.Min(burst, p.tokens+now.Sub(p.refilled).Seconds()*limits.EventsPerSecond)
+		}
+		p.refilled = now
+
+		// a batch larger than the burst is admitted with a full bucket, going into debt
+		if need := math.Min(float64(n), burst); p.tokens < need {
+			wait := time.Duration((need - p.tokens) / limits.EventsPerSecond * float64(time.Second))
+			return &limitError{status: http.StatusTooManyRequests, retryAfter: wait,
+				message: fmt.Sprintf("rate limit of %g events per second exceeded", limits.EventsPerSecond)}
+		}
+	}
+	return nil
+}
+
+func (t *usageTracker) reject(projectId int32, n int64) {
+	t.mu.Lock()
+	t.projects[projectId].unflushed.Rejected += n
+	t.mu.Unlock()
+}
+
+// load loads the project's usage today, if it isn't loaded yet.
+func (t *usageTracker) load(projectId int32, ctx context.Context) error {
+	today := storage.UsageDay(time.Now())
+	t.mu.Lock()
+	p, ok := t.projects[projectId]
+	loaded := ok && p.stored.Day == today
+	t.mu.Unlock()
+	if loaded {
+		return nil
+	}
+
+	stored, err := storage.GetUsage(projectId, today, t.db, ctx)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok = t.projects[projectId]; !ok {
+		p = &projectUsage{}
+		t.projects[projectId] = p
+	} else if p.stored.Day == today {
+		return nil
+	}
+	if p.unflushed != (storage.Usage{Day: p.unflushed.Day}) {
+		t.pending[projectId] = append(t.pending[projectId], p.unflushed)
+	}
+	p.stored = stored
+	p.unflushed = storage.Usage{Day: today}
+	return nil
+}
+
+// today returns the project's usage today, including what hasn't been flushed.
+func (t *usageTracker) today(projectId int32, ctx context.Context) (storage.Usage, error) {
+	if err := t.load(projectId, ctx); err != nil {
+		return storage.Usage{}, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.projects[projectId]
+	u := p.stored
+	u.Events += p.unflushed.Events
+	u.Bytes += p.unflushed.Bytes
+	u.Rejected += p.unflushed.Rejected
+	return u, nil
+}
+
+func (t *usageTracker) run() {
+	for range time.Tick(usageFlushInterval) {
+		t.flush(context.Background())
+	}
+}
+
+// flush adds the unflushed usage to the database and reloads the stored usage,
+// which includes that of other processes.
+func (t *usageTracker) flush(ctx context.Context) {
+	t.mu.Lock()
+	flushing := t.pending
+	t.pending = make(map[int32][]storage.Usage)
+	for projectId, p := range t.projects {
+		if p.unflushed != (storage.Usage{Day: p.unflushed.Day}) {
+			flushing[projectId] = append(flushing[projectId], p.unflushed)
+			if p.unflushed.Day == p.stored.Day {
+				p.stored.Events += p.unflushed.Events
+				p.stored.Bytes += p.unflushed.Bytes
+				p.stored.Rejected += p.unflushed.Rejected
+			}
+			p.unflushed = storage.Usage{Day: p.unflushed.Day}
+		}
+	}
+	t.mu.Unlock()
+
+	for projectId, usage := range flushing {
+		for i, u := range usage {
+			if err := storage.AddUsage(projectId, u, t.db, ctx); err != nil {
+				log.Printf("Error adding usage of project %d: %v\n", projectId, err)
+				t.mu.Lock()
+				t.pending[projectId] = append(t.pending[projectId], usage[i:]...)
+				t.mu.Unlock()
+				break
+			}
+		}
+
+		today := storage.UsageDay(time.Now())
+		stored, err := storage.GetUsage(projectId, today, t.db, ctx)
+		if err != nil {
+			log.Printf("Error loading usage of project %d: %v\n", projectId, err)
+			continue
+		}
+		t.mu.Lock()
+		if p := t.projects[projectId]; p != nil && p.stored.Day == today {
+			p.stored = stored
+		}
+		t.mu.Unlock()
+	}
+}
+
+// checkContext returns why the context is over the limits, or "".
+func checkContext(c storage.ContextMap, limits storage.Limits) string {
+	if c == nil {
+		return ""
+	}
+	if limits.MaxContextDepth > 0 && jsonDepth(map[string]interface{}(c)) > limits.MaxContextDepth {
+		return fmt.Sprintf("'context' is nested deeper than %d", limits.MaxContextDepth)
+	}
+	if limits.MaxContextBytes > 0 {
+		if j, err := json.Marshal(c); err == nil && int64(len(j)) > limits.MaxContextBytes {
+			return fmt.Sprintf("'context' is larger than %d bytes", limits.MaxContextBytes)
+		}
+	}
+	return ""
+}
+
+// jsonDepth is the nesting depth of objects and arrays in the decoded JSON value, 0 for a scalar.
+func jsonDepth(v interface{}) int {
+	depth := 0
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, e := range v {
+			if d := jsonDepth(e); d > depth {
+				depth = d
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if d := jsonDepth(e); d > depth {
+				depth = d
+			}
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
+
+// respondLimited responds to a request over its project's limits.
+func respondLimited(le *limitError, w http.ResponseWriter) {
+	if le.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(le.retryAfter.Seconds()))))
+	}
+	sendMessage(le.status, le.message, w)
+}
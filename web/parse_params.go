@@ -1,7 +1,10 @@
 package web
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -62,7 +65,10 @@ func parseTimeRange(name string, r *http.Request) (time.Time, time.Time, bool) {
 }
 
 func parseRange(name string, r *http.Request) (string, string, bool) {
-	value := r.FormValue(name)
+	return parseRangeValue(r.FormValue(name))
+}
+
+func parseRangeValue(value string) (string, string, bool) {
 	value = strings.TrimLeft(value, "[(")
 	value = strings.TrimRight(value, ")]")
 	value = strings.Replace(value, "~", ",", -1)
@@ -81,3 +87,72 @@ func parseRange(name string, r *http.Request) (string, string, bool) {
 		return value, value, true
 	}
 }
+
+// parseContextFilters parses the context filters:
+//
+//	context_has=a.b           the key path exists
+//	context.a.b=value         the value at the key path equals value (a string or number)
+//	context.a.b=[from,to]     the number at the key path is in the range, or '[from,]' or '[,to]'
+//	context_contains={"a":1}  the context contains the JSON document
+func parseContextFilters(r *http.Request) ([]storage.ContextFilter, error) {
+	filters := make([]storage.ContextFilter, 0)
+
+	for _, has := range r.Form["context_has"] {
+		path, err := storage.ParseContextPath(has)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, storage.ContextFilter{Op: storage.ContextExists, Path: path})
+	}
+
+	for _, doc := range r.Form["context_contains"] {
+		var o map[string]interface{}
+		if err := json.Unmarshal([]byte(doc), &o); err != nil {
+			return nil, fmt.Errorf("'context_contains' must be a JSON object: %v", err)
+		}
+		filters = append(filters, storage.ContextFilter{Op: storage.ContextContains, Value: doc})
+	}
+
+	names := make([]string, 0)
+	for name := range r.Form {
+		if strings.HasPrefix(name, "context.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path, err := storage.ParseContextPath(name[len("context."):])
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range r.Form[name] {
+			if !isBracketed(value) {
+				filters = append(filters, storage.ContextFilter{Op: storage.ContextEquals, Path: path, Value: value})
+				continue
+			}
+
+			min, max, ok := parseRangeValue(value)
+			filter := storage.ContextFilter{Op: storage.ContextRange, Path: path}
+			if min != "" {
+				f, err := strconv.ParseFloat(min, 64)
+				ok = ok && err == nil
+				filter.Min = &f
+			}
+			if max != "" {
+				f, err := strconv.ParseFloat(max, 64)
+				ok = ok && err == nil
+				filter.Max = &f
+			}
+			if !ok || min == "" && max == "" {
+				return nil, fmt.Errorf("'%s' range must be '[from,]' or '[,to]' or '[from,to]' (numbers)", name)
+			}
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+func isBracketed(value string) bool {
+	return len(value) >= 2 && strings.IndexByte("[(", value[0]) != -1 && strings.IndexByte("])", value[len(value)-1]) != -1
+}
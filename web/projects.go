@@ -1,18 +1,25 @@
 package web
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/karmakaze/quicklog/enrich"
 	"github.com/karmakaze/quicklog/storage"
 )
 
 type ProjectsHandler struct {
 	db *sql.DB
+	// usage, if set, has the usage not yet flushed to the database
+	usage *usageTracker
 }
 
 func NewProjectsHandler(db *sql.DB) *ProjectsHandler {
@@ -20,6 +27,11 @@ func NewProjectsHandler(db *sql.DB) *ProjectsHandler {
 }
 
 func (h *ProjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/projects/") {
+		h.serveProject(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "OPTIONS":
 		respondNoContent(w)
@@ -78,6 +90,10 @@ func (h *ProjectsHandler) createProject(w http.ResponseWriter, r *http.Request)
 
 	if err = storage.CreateProject(project, tx, r.Context()); err != nil {
 		tx.Rollback()
+		if storage.IsUniqueViolation(err) {
+			sendMessage(http.StatusConflict, fmt.Sprintf("project '%s' already exists", project.Name), w)
+			return
+		}
 		respondError(http.StatusInternalServerError, err, w)
 		return
 	}
@@ -85,3 +101,276 @@ func (h *ProjectsHandler) createProject(w http.ResponseWriter, r *http.Request)
 	tx.Commit()
 	respondCreated("", w)
 }
+
+// serveProject serves the per-project resources at /projects/{id}/{resource}
+func (h *ProjectsHandler) serveProject(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/projects/"), "/", 2)
+	projectId, err := strconv.Atoi(parts[0])
+	if err != nil || projectId <= 0 {
+		badRequest("project id must be numeric", w)
+		return
+	}
+	resource := ""
+	if len(parts) == 2 {
+		resource = parts[1]
+	}
+
+	if resource == "subscriptions" || strings.HasPrefix(resource, "subscriptions/") {
+		h.serveSubscriptions(int32(projectId), strings.TrimPrefix(resource, "subscriptions"), w, r)
+		return
+	}
+
+	switch resource {
+	case "dedup":
+		var policy storage.DedupPolicy
+		h.serveConfig(int32(projectId), storage.DedupConfig, &policy, func() error { return policy.Validate() }, w, r)
+	case "indexed-keys":
+		var keys storage.IndexedKeys
+		if h.serveConfig(int32(projectId), storage.IndexedKeysConfig, &keys, keys.Validate, w, r) {
+			go h.syncContextIndexes(int32(projectId))
+		}
+	case "limits":
+		var limits storage.Limits
+		h.serveConfig(int32(projectId), storage.LimitsConfig, &limits, func() error { return limits.Validate() }, w, r)
+	case "enrichers":
+		var configs enrich.Configs
+		h.serveConfig(int32(projectId), enrich.ConfigName, &configs, configs.Validate, w, r)
+	case "tag-rules":
+		var rules storage.TagRules
+		h.serveConfig(int32(projectId), storage.TagRulesConfig, &rules, rules.Validate, w, r)
+	case "schemas":
+		var schemas storage.Schemas
+		h.serveConfig(int32(projectId), storage.SchemasConfig, &schemas, schemas.Validate, w, r)
+	case "redaction":
+		var redaction storage.Redaction
+		h.serveConfig(int32(projectId), storage.RedactionConfig, &redaction, func() error {
+			if err := redaction.Validate(); err != nil {
+				return err
+			}
+			return storage.CreateRedactionSalt(int32(projectId), h.db, r.Context())
+		}, w, r)
+	case "redaction/dry-run":
+		h.dryRunRedaction(int32(projectId), w, r)
+	case "usage":
+		h.getUsage(int32(projectId), w, r)
+	case "alert-rules":
+		var rules storage.AlertRules
+		h.serveConfig(int32(projectId), storage.AlertRulesConfig, &rules, rules.Validate, w, r)
+	default:
+		respondStatus(http.StatusNotFound, w)
+	}
+}
+
+// dryRunRedaction responds with what redaction rules would change on sample entries, given
+// {"redaction": {"rules": [...]}, "entries": [...]}. The project's rules are used if none are given.
+func (h *ProjectsHandler) dryRunRedaction(projectId int32, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+		return
+	case "POST":
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		respondStatus(http.StatusUnsupportedMediaType, w)
+		return
+	}
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		badRequest(fmt.Sprintf("Error reading POST %s body: %v", r.URL.Path, err), w)
+		return
+	}
+	var dryRun struct {
+		Redaction *storage.Redaction `json:"redaction"`
+		Entries   []storage.Entry    `json:"entries"`
+	}
+	if err = json.Unmarshal(body, &dryRun); err != nil {
+		badRequest(fmt.Sprintf("Error parsing POST %s body: %v", r.URL.Path, err), w)
+		return
+	}
+
+	redaction, err := storage.GetRedaction(projectId, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	if dryRun.Redaction != nil {
+		if err = dryRun.Redaction.Validate(); err != nil {
+			badRequest(err.Error(), w)
+			return
+		}
+		// hash with the project's salt, or a throwaway one
+		if redaction != nil {
+			dryRun.Redaction.Salt = redaction.Salt
+		} else if dryRun.Redaction.Salt, err = storage.NewRedactionSalt(); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+		redaction = dryRun.Redaction
+	}
+	if redaction == nil {
+		redaction = &storage.Redaction{}
+	}
+
+	type result struct {
+		Entry   storage.Entry             `json:"entry"`
+		Changes []storage.RedactionChange `json:"changes"`
+	}
+	results := make([]result, 0, len(dryRun.Entries))
+	for _, e := range dryRun.Entries {
+		changes := redaction.Apply(&e)
+		results = append(results, result{Entry: e, Changes: changes})
+	}
+	respondOK(results, w)
+}
+
+// usageDays is how many days of usage GET /projects/{id}/usage returns.
+const usageDays = 30
+
+// getUsage responds with the project's limits, its usage today (with how much
+// of the daily quota remains) and on the days before.
+func (h *ProjectsHandler) getUsage(projectId int32, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+		return
+	case "GET":
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	limits, err := storage.GetLimits(projectId, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	now := time.Now()
+	days, err := storage.ListUsage(projectId, storage.UsageDay(now.AddDate(0, 0, 1-usageDays)), h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	today := storage.Usage{Day: storage.UsageDay(now)}
+	if h.usage != nil {
+		if today, err = h.usage.today(projectId, r.Context()); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+	} else if len(days) != 0 && days[0].Day == today.Day {
+		today = days[0]
+	}
+	if len(days) != 0 && days[0].Day == today.Day {
+		days[0] = today
+	} else {
+		days = append([]storage.Usage{today}, days...)
+	}
+
+	usage := struct {
+		ProjectId      int32           `json:"project_id"`
+		Limits         storage.Limits  `json:"limits"`
+		Today          storage.Usage   `json:"today"`
+		QuotaRemaining *int64          `json:"quota_remaining,omitempty"`
+		Days           []storage.Usage `json:"days"`
+	}{ProjectId: projectId, Limits: limits, Today: today, Days: days}
+	if limits.DailyQuota > 0 {
+		remaining := limits.DailyQuota - today.Events
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.QuotaRemaining = &remaining
+	}
+	respondOK(usage, w)
+}
+
+func (h *ProjectsHandler) syncContextIndexes(projectId int32) {
+	ctx := context.Background()
+	keys, err := storage.GetIndexedKeys(projectId, h.db, ctx)
+	if err == nil {
+		err = storage.SyncContextIndexes(projectId, keys, h.db, ctx)
+	}
+	if err != nil {
+		log.Printf("Error syncing context indexes for project %d: %v\n", projectId, err)
+	}
+}
+
+// serveConfig gets (GET), sets (PUT) or removes (DELETE) the named project config,
+// returning true if it was changed. The config is decoded into v and checked by calling validate.
+func (h *ProjectsHandler) serveConfig(projectId int32, name string, v interface{}, validate func() error,
+	w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		if ok, err := storage.GetProjectConfig(projectId, name, v, h.db, r.Context()); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+		} else if !ok {
+			respondStatus(http.StatusNotFound, w)
+		} else {
+			respondOK(v, w)
+		}
+	case "PUT":
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			respondStatus(http.StatusUnsupportedMediaType, w)
+			return false
+		}
+		defer r.Body.Close()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(fmt.Sprintf("Error reading PUT %s body: %v", r.URL.Path, err), w)
+			return false
+		}
+		if err = json.Unmarshal(body, v); err != nil {
+			badRequest(fmt.Sprintf("Error parsing PUT %s body: %v", r.URL.Path, err), w)
+			return false
+		}
+		if err = validate(); err != nil {
+			badRequest(err.Error(), w)
+			return false
+		}
+
+		tx, err := h.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		if err = storage.PutProjectConfig(projectId, name, v, tx, r.Context()); err != nil {
+			tx.Rollback()
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		if err = tx.Commit(); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		storage.ForgetProjectConfig(projectId, name)
+		respondOK(v, w)
+		return true
+	case "DELETE":
+		tx, err := h.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		if err = storage.DeleteProjectConfig(projectId, name, tx, r.Context()); err != nil {
+			tx.Rollback()
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		if err = tx.Commit(); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return false
+		}
+		storage.ForgetProjectConfig(projectId, name)
+		respondStatus(http.StatusNoContent, w)
+		return true
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+	return false
+}
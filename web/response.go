@@ -30,6 +30,15 @@ func respondOK(body interface{}, w http.ResponseWriter) {
 	sendData(http.StatusOK, body, w)
 }
 
+func respondText(contentType, text string, w http.ResponseWriter) {
+	addCorsHeaders(w)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(text)); err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
+
 func respondStatus(status int, w http.ResponseWriter) {
 	sendMessage(status, "", w)
 }
@@ -44,9 +53,9 @@ func respondError(status int, err error, w http.ResponseWriter) {
 
 func addCorsHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
 	w.Header().Set("Access-Control-Allow-Headers",
-		"Origin, X-Requested-With, Content-Type, Accept")
+		"Origin, X-Requested-With, Content-Type, Accept, Idempotency-Key")
 }
 
 func sendMessage(status int, message string, w http.ResponseWriter) error {
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+// SchemasHandler serves the schema registry of a project: its entry types with
+// their schemas and the fields they describe.
+type SchemasHandler struct {
+	db *sql.DB
+}
+
+type schemaType struct {
+	Type        string                `json:"type"`
+	Mode        string                `json:"mode"`
+	Description string                `json:"description,omitempty"`
+	Fields      []storage.SchemaField `json:"fields"`
+	Schema      *storage.Schema       `json:"schema"`
+}
+
+// schemaError is a schema violation by the entry at an index of the request.
+type schemaError struct {
+	Entry int `json:"entry"`
+	storage.FieldError
+}
+
+func NewSchemasHandler(db *sql.DB) *SchemasHandler {
+	return &SchemasHandler{db: db}
+}
+
+func (h *SchemasHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.listSchemas(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+func (h *SchemasHandler) listSchemas(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, err := strconv.Atoi(r.FormValue("project_id"))
+	if err != nil {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+	typ := r.FormValue("type")
+
+	schemas, err := storage.GetSchemas(int32(projectId), h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	types := make([]schemaType, 0)
+	if schemas != nil {
+		for _, name := range sortedSchemaTypes(schemas) {
+			if typ != "" && name != typ {
+				continue
+			}
+			s := schemas.Types[name]
+			types = append(types, schemaType{Type: name, Mode: s.Mode, Description: s.Description,
+				Fields: s.Fields(), Schema: s})
+		}
+	}
+	if typ != "" && len(types) == 0 {
+		sendMessage(http.StatusNotFound, fmt.Sprintf("type '%s' has no schema", typ), w)
+		return
+	}
+	respondOK(types, w)
+}
+
+func sortedSchemaTypes(schemas *storage.Schemas) []string {
+	types := make([]string, 0, len(schemas.Types))
+	for typ := range schemas.Types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// checkSchemas checks the entries against the schemas of their types. It returns
+// the violations of enforced schemas, and tags the entries violating warned schemas
+// with the violations in their contexts, if the client hasn't used the key.
+func checkSchemas(entries []storage.Entry, db *sql.DB, ctx context.Context) ([]schemaError, error) {
+	errs := make([]schemaError, 0)
+	projectSchemas := make(map[int32]*storage.Schemas)
+	for i := range entries {
+		e := &entries[i]
+		schemas, ok := projectSchemas[e.ProjectId]
+		if !ok {
+			var err error
+			if schemas, err = storage.GetSchemas(e.ProjectId, db, ctx); err != nil {
+				return nil, err
+			}
+			projectSchemas[e.ProjectId] = schemas
+		}
+		if schemas == nil || schemas.Types[e.Type] == nil {
+			continue
+		}
+
+		schema := schemas.Types[e.Type]
+		violations := schema.Check(*e)
+		if len(violations) == 0 {
+			continue
+		}
+		if schema.Mode == storage.SchemaEnforce {
+			for _, v := range violations {
+				errs = append(errs, schemaError{Entry: i, FieldError: v})
+			}
+			continue
+		}
+		e.Tags = append(e.Tags, storage.SchemaInvalidTag)
+		if _, ok := e.Context[storage.SchemaErrorsKey]; ok {
+			continue
+		}
+		warnings := make([]interface{}, len(violations))
+		for j, v := range violations {
+			warnings[j] = v.String()
+		}
+		if e.Context == nil {
+			e.Context = make(storage.ContextMap)
+		}
+		e.Context[storage.SchemaErrorsKey] = warnings
+	}
+	return errs, nil
+}
+
+// checkSchemas responds 422 Unprocessable Entity with the violations if any
+// entries don't match their enforced schemas.
+func (h *EntriesHandler) checkSchemas(entries []storage.Entry, w http.ResponseWriter, r *http.Request) bool {
+	errs, err := checkSchemas(entries, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return false
+	}
+	if len(errs) > 0 {
+		message := fmt.Sprintf("entry doesn't match the schema of type '%s'", entries[errs[0].Entry].Type)
+		if len(entries) > 1 {
+			message = fmt.Sprintf("entry %d: %s", errs[0].Entry, message)
+		}
+		send(http.StatusUnprocessableEntity, ResponseBody{Status: http.StatusUnprocessableEntity,
+			Message: message, Data: errs}, w)
+		return false
+	}
+	return true
+}
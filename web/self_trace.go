@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/karmakaze/quicklog/client"
+	"github.com/karmakaze/quicklog/storage"
+)
+
+var errTraceDropped = errors.New("self-trace entry dropped")
+
+// entryWriter creates entries in a project from a background goroutine, for
+// logging quicklog's own requests without holding them up.
+type entryWriter struct {
+	projectId int32
+	db        *sql.DB
+	entries   chan storage.Entry
+}
+
+func newEntryWriter(projectId int32, db *sql.DB) *entryWriter {
+	w := &entryWriter{projectId: projectId, db: db, entries: make(chan storage.Entry, 1000)}
+	go w.run()
+	return w
+}
+
+func (w *entryWriter) Log(c client.Entry) error {
+	e := storage.Entry{ProjectId: w.projectId, Published: c.Published, Source: c.Source, Type: c.Type,
+		Actor: c.Actor, Object: c.Object, Target: c.Target, Context: storage.ContextMap(c.Context),
+		TraceId: c.TraceId, ParentSpanId: c.ParentSpanId, SpanId: c.SpanId, EventId: c.EventId, Tags: c.Tags}
+	select {
+	case w.entries <- e:
+		return nil
+	default:
+		return errTraceDropped
+	}
+}
+
+func (w *entryWriter) run() {
+	ctx := context.Background()
+	for e := range w.entries {
+		tx, err := w.db.BeginTx(ctx, nil)
+		if err == nil {
+			if _, err = storage.CreateEntry(e, tx, ctx); err != nil {
+				tx.Rollback()
+			} else {
+				err = tx.Commit()
+			}
+		}
+		if err != nil {
+			log.Printf("Error logging request to project %d: %v\n", w.projectId, err)
+		}
+	}
+}
+
+// route replaces numeric path segments with "{id}" so that entry types group
+// by route, e.g. "/projects/{id}/dedup".
+func route(r *http.Request) string {
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.ParseInt(segment, 10, 64); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
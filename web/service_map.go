@@ -0,0 +1,70 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+const serviceMapInterval = 30 * time.Second
+
+type ServiceMapHandler struct {
+	db *sql.DB
+}
+
+func NewServiceMapHandler(db *sql.DB) *ServiceMapHandler {
+	return &ServiceMapHandler{db: db}
+}
+
+func (h *ServiceMapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.getServiceMap(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// getServiceMap responds with the service map over 'published' (by default the last hour).
+func (h *ServiceMapHandler) getServiceMap(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, ok := requestProjectId(r, h.db)
+	if !ok {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+
+	publishedMin, publishedMax, ok := parseTimeRange("published", r)
+	if !ok {
+		badRequest("'published' must be 'from,' or ',to' or 'from,to' in RFC 3339 format", w)
+		return
+	}
+	if publishedMax.IsZero() {
+		publishedMax = time.Now()
+	}
+	if publishedMin.IsZero() {
+		publishedMin = publishedMax.Add(-time.Hour)
+	}
+
+	serviceMap, err := storage.GetServiceMap(projectId, publishedMin, publishedMax, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	respondOK(serviceMap, w)
+}
+
+func updateServiceMap(db *sql.DB) {
+	for range time.Tick(serviceMapInterval) {
+		if err := storage.UpdateServiceMap(db, context.Background()); err != nil {
+			log.Printf("Error updating service map: %v\n", err)
+		}
+	}
+}
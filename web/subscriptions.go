@@ -0,0 +1,313 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+// Deliveries are POSTed with the entry as the JSON body and the Unix time sent,
+// signed with the subscription secret as "sha256=" + the hex HMAC-SHA256 of
+// "<timestamp>.<body>". Subscribers should reject a timestamp more than 5 minutes
+// from their time, so that a captured delivery can't be replayed.
+const (
+	deliveryHeader  = "X-Quicklog-Delivery"
+	repeatsHeader   = "X-Quicklog-Repeats"
+	signatureHeader = "X-Quicklog-Signature"
+	timestampHeader = "X-Quicklog-Timestamp"
+)
+
+const (
+	deliveryInterval    = 5 * time.Second
+	deliveryBatchSize   = 100
+	deliveryConcurrency = 10
+	deliveryLease       = 5 * time.Minute
+	deliveryRetention   = 7 * 24 * time.Hour
+)
+
+// serveSubscriptions serves /projects/{id}/subscriptions and below:
+//
+//	GET, POST subscriptions
+//	GET, DELETE subscriptions/{sid}
+//	GET subscriptions/{sid}/deliveries?status=dead&count=100
+//	POST subscriptions/{sid}/deliveries/{did}/retry
+func (h *ProjectsHandler) serveSubscriptions(projectId int32, path string, w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		respondNoContent(w)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "" {
+		switch r.Method {
+		case "GET":
+			subscriptions, err := storage.ListSubscriptions(projectId, h.db, r.Context())
+			if err != nil {
+				respondError(http.StatusInternalServerError, err, w)
+				return
+			}
+			respondOK(subscriptions, w)
+		case "POST":
+			h.createSubscription(projectId, w, r)
+		default:
+			respondStatus(http.StatusMethodNotAllowed, w)
+		}
+		return
+	}
+
+	subscriptionId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+	subscription, err := storage.GetSubscription(projectId, subscriptionId, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	} else if subscription == nil {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		respondOK(subscription, w)
+	case len(parts) == 1 && r.Method == "DELETE":
+		h.deleteSubscription(projectId, subscriptionId, w, r)
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == "GET":
+		h.listDeliveries(subscriptionId, w, r)
+	case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "retry" && r.Method == "POST":
+		h.retryDelivery(subscriptionId, parts[2], w, r)
+	case len(parts) == 1, len(parts) == 2 && parts[1] == "deliveries",
+		len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "retry":
+		respondStatus(http.StatusMethodNotAllowed, w)
+	default:
+		respondStatus(http.StatusNotFound, w)
+	}
+}
+
+// createSubscription creates a subscription from {"filter": ..., "url": ..., "secret": ...},
+// generating the secret if not given. The secret is only included in this response.
+func (h *ProjectsHandler) createSubscription(projectId int32, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		respondStatus(http.StatusUnsupportedMediaType, w)
+		return
+	}
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		badRequest(fmt.Sprintf("Error reading POST %s body: %v", r.URL.Path, err), w)
+		return
+	}
+
+	var s storage.Subscription
+	if err = json.Unmarshal(body, &s); err != nil {
+		badRequest(fmt.Sprintf("Error parsing POST %s body: %v", r.URL.Path, err), w)
+		return
+	}
+	if err = s.Validate(); err != nil {
+		badRequest(err.Error(), w)
+		return
+	}
+	s.ProjectId = projectId
+	s.Created = time.Now().UTC()
+	if s.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			respondError(http.StatusInternalServerError, err, w)
+			return
+		}
+		s.Secret = hex.EncodeToString(secret)
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	if s.Id, err = storage.CreateSubscription(s, tx, r.Context()); err != nil {
+		tx.Rollback()
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	tx.Commit()
+
+	w.Header().Set("location", fmt.Sprintf("/projects/%d/subscriptions/%d", projectId, s.Id))
+	sendData(http.StatusCreated, s, w)
+}
+
+func (h *ProjectsHandler) deleteSubscription(projectId int32, subscriptionId int64, w http.ResponseWriter, r *http.Request) {
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	ok, err := storage.DeleteSubscription(projectId, subscriptionId, tx, r.Context())
+	if err != nil {
+		tx.Rollback()
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	tx.Commit()
+	if !ok {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+	respondStatus(http.StatusNoContent, w)
+}
+
+// listDeliveries lists the latest deliveries of the subscription, optionally only
+// those with a 'status' (pending, delivered or dead).
+func (h *ProjectsHandler) listDeliveries(subscriptionId int64, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	status := r.FormValue("status")
+	switch status {
+	case "", storage.DeliveryPending, storage.DeliveryDelivered, storage.DeliveryDead:
+	default:
+		badRequest(fmt.Sprintf("'status' must be '%s', '%s' or '%s'",
+			storage.DeliveryPending, storage.DeliveryDelivered, storage.DeliveryDead), w)
+		return
+	}
+
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	deliveries, err := storage.ListDeliveries(subscriptionId, status, count, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	respondOK(deliveries, w)
+}
+
+// retryDelivery makes a dead delivery pending again.
+func (h *ProjectsHandler) retryDelivery(subscriptionId int64, id string, w http.ResponseWriter, r *http.Request) {
+	deliveryId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	ok, err := storage.RetryDelivery(subscriptionId, deliveryId, tx, r.Context())
+	if err != nil {
+		tx.Rollback()
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	tx.Commit()
+	if !ok {
+		sendMessage(http.StatusNotFound, "no such dead delivery", w)
+		return
+	}
+	respondStatus(http.StatusNoContent, w)
+}
+
+// deliverSubscriptions queues and sends subscription deliveries in the background.
+func deliverSubscriptions(db *sql.DB) {
+	ctx := context.Background()
+	purged := time.Now()
+	for range time.Tick(deliveryInterval) {
+		if err := storage.QueueDeliveries(db, ctx); err != nil {
+			log.Printf("Error queueing deliveries: %v\n", err)
+		}
+
+		for {
+			deliveries, err := storage.ClaimDeliveries(deliveryBatchSize, deliveryLease, db, ctx)
+			if err != nil {
+				log.Printf("Error claiming deliveries: %v\n", err)
+				break
+			}
+			sendDeliveries(deliveries, db, ctx)
+			if len(deliveries) < deliveryBatchSize {
+				break
+			}
+		}
+
+		if time.Since(purged) > time.Hour {
+			if err := storage.PurgeDeliveries(time.Now().Add(-deliveryRetention), db, ctx); err != nil {
+				log.Printf("Error purging deliveries: %v\n", err)
+			}
+			purged = time.Now()
+		}
+	}
+}
+
+func sendDeliveries(deliveries []storage.Delivery, db *sql.DB, ctx context.Context) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, deliveryConcurrency)
+	for _, d := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d storage.Delivery) {
+			defer func() { <-sem; wg.Done() }()
+			status, err := sendDelivery(d)
+			if err = storage.RecordDeliveryAttempt(d, status, err, db, ctx); err != nil {
+				log.Printf("Error recording delivery %d: %v\n", d.Id, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+}
+
+// sendDelivery POSTs the delivery's entry, returning the response status if there was one.
+func sendDelivery(d storage.Delivery) (int, error) {
+	body, err := json.Marshal(d.Entry)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(deliveryHeader, strconv.FormatInt(d.Id, 10))
+	if d.Repeats > 0 {
+		req.Header.Set(repeatsHeader, strconv.Itoa(int(d.Repeats)))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, "sha256="+sign(d.Secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
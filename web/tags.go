@@ -1,18 +1,25 @@
 package web
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/karmakaze/quicklog/storage"
 	"github.com/karmakaze/quicklog/storage/span_tag"
 )
 
+// tagStatsInterval is how often the tag key and value counts are updated.
+const tagStatsInterval = 30 * time.Second
+
 type Tag struct {
 	ProjectId int32  `json:"project_id"`
 	TraceId   string `json:"trace_id"`
@@ -29,6 +36,11 @@ func NewTagsHandler(db *sql.DB) *TagsHandler {
 }
 
 func (h *TagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/tags/") {
+		h.serveKeys(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "OPTIONS":
 		respondNoContent(w)
@@ -75,6 +87,84 @@ func (h *TagsHandler) listTags(w http.ResponseWriter, r *http.Request) {
 	respondOK(toTags(spanTags), w)
 }
 
+// serveKeys serves /tags/keys and /tags/keys/{key}/values, for discovering the tags of a project.
+func (h *TagsHandler) serveKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+		return
+	case "GET":
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	// the key is path escaped, so it may contain '/'
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/tags/")
+	if path == "keys" {
+		h.listKeys(w, r)
+		return
+	}
+	if strings.HasPrefix(path, "keys/") && strings.HasSuffix(path, "/values") {
+		escapedKey := strings.TrimSuffix(strings.TrimPrefix(path, "keys/"), "/values")
+		if key, err := url.PathUnescape(escapedKey); err == nil && !strings.Contains(escapedKey, "/") {
+			h.listValues(key, w, r)
+			return
+		}
+	}
+	respondStatus(http.StatusNotFound, w)
+}
+
+// listKeys responds with the tag keys starting with the 'prefix' and their counts
+// and cardinality, highest cardinality first.
+func (h *TagsHandler) listKeys(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, err := strconv.Atoi(r.FormValue("project_id"))
+	if err != nil {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	stats, err := span_tag.ListKeyStats(projectId, r.FormValue("prefix"), h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	if len(stats) > count {
+		stats = stats[:count]
+	}
+	respondOK(stats, w)
+}
+
+// listValues responds with the most frequent values of the tag key starting with the 'prefix'.
+func (h *TagsHandler) listValues(key string, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, err := strconv.Atoi(r.FormValue("project_id"))
+	if err != nil {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+	count, ok := parseCount(r)
+	if !ok {
+		badRequest("'count' must be between 1 to 1000", w)
+		return
+	}
+
+	counts, err := span_tag.ListValueCounts(projectId, key, r.FormValue("prefix"), count, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	respondOK(counts, w)
+}
+
 func (h *TagsHandler) createTag(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
 		respondStatus(http.StatusUnsupportedMediaType, w)
@@ -163,3 +253,11 @@ func toTags(spanTags []span_tag.SpanTag) []Tag {
 	}
 	return tags
 }
+
+func updateTagStats(db *sql.DB) {
+	for range time.Tick(tagStatsInterval) {
+		if err := storage.UpdateTagStats(db, context.Background()); err != nil {
+			log.Printf("Error updating tag stats: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/karmakaze/quicklog/storage"
+)
+
+// TracesHandler serves comparisons of traces.
+type TracesHandler struct {
+	db *sql.DB
+}
+
+func NewTracesHandler(db *sql.DB) *TracesHandler {
+	return &TracesHandler{db: db}
+}
+
+func (h *TracesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/traces/diff" {
+		respondStatus(http.StatusNotFound, w)
+		return
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		respondNoContent(w)
+	case "GET":
+		h.diffTraces(w, r)
+	default:
+		respondStatus(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// diffTraces responds with the differences of trace 'b' from trace 'a', ignoring
+// changes to the comma-separated context paths 'ignore', as 'format' json (default)
+// or text (side by side).
+func (h *TracesHandler) diffTraces(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	projectId, ok := requestProjectId(r, h.db)
+	if !ok {
+		badRequest("'project_id' is required (numeric)", w)
+		return
+	}
+	a, b := r.FormValue("a"), r.FormValue("b")
+	if a == "" || b == "" {
+		badRequest("'a' and 'b' trace ids are required", w)
+		return
+	}
+	ignore := make([]string, 0)
+	for _, path := range strings.Split(r.FormValue("ignore"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "context.") {
+			badRequest("'ignore' must be context.<path>s", w)
+			return
+		}
+		ignore = append(ignore, path)
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "", "json", "text":
+	default:
+		badRequest("'format' must be 'json' or 'text'", w)
+		return
+	}
+
+	diff, err := storage.DiffTraces(projectId, a, b, ignore, h.db, r.Context())
+	if err != nil {
+		respondError(http.StatusInternalServerError, err, w)
+		return
+	}
+	if diff == nil {
+		sendMessage(http.StatusNotFound, fmt.Sprintf("trace '%s' or '%s' not found", a, b), w)
+		return
+	}
+
+	if format == "text" {
+		respondText("text/plain; charset=utf-8", traceDiffText(*diff), w)
+	} else {
+		respondOK(diff, w)
+	}
+}
+
+// traceDiffColumn is the width of each side of the text diff.
+const traceDiffColumn = 56
+
+// traceDiffText renders the spans of a and b side by side, each marked with
+// ' ' (matched), '~' (reordered), '-' (missing), '+' (added) or '!' (context
+// changed), followed by the changes and the timing deltas.
+func traceDiffText(d storage.TraceDiff) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  %s | %s\n",
+		traceDiffCell(fmt.Sprintf("a: %s (%d spans, %s)", d.A.TraceId, d.A.Spans, formatMs(d.A.DurationMs))),
+		fmt.Sprintf("b: %s (%d spans, %s) %s", d.B.TraceId, d.B.Spans, formatMs(d.B.DurationMs),
+			formatDeltaMs(d.DurationDeltaMs)))
+	fmt.Fprintf(&b, "  %d added, %d missing, %d reordered, %d changed\n\n", d.Added, d.Missing, d.Reordered, d.Changed)
+
+	for _, s := range d.Spans {
+		marker := " "
+		switch {
+		case s.Status == storage.SpanAdded:
+			marker = "+"
+		case s.Status == storage.SpanMissing:
+			marker = "-"
+		case s.Status == storage.SpanReordered:
+			marker = "~"
+		case len(s.Changes) > 0:
+			marker = "!"
+		}
+		label := strings.Repeat("  ", s.Depth) + s.Source + " " + s.Type
+
+		left, right := "", ""
+		if s.A != nil {
+			left = traceSpanText(label, s.A)
+		}
+		if s.B != nil {
+			right = traceSpanText(label, s.B)
+		}
+		if s.OffsetDeltaMs != nil && *s.OffsetDeltaMs != 0 {
+			right += " @" + formatDeltaMs(*s.OffsetDeltaMs)
+		}
+		if s.DurationDeltaMs != nil && *s.DurationDeltaMs != 0 {
+			right += " " + formatDeltaMs(*s.DurationDeltaMs)
+		}
+		b.WriteString(strings.TrimRight(marker+" "+traceDiffCell(left)+" | "+right, " ") + "\n")
+
+		indent := strings.Repeat("  ", s.Depth+2)
+		for _, c := range s.Changes {
+			fmt.Fprintf(&b, "  %s | %s\n", traceDiffCell(indent+c.Field+": "+changeValue(c.A)),
+				indent+c.Field+": "+changeValue(c.B))
+		}
+	}
+	return b.String()
+}
+
+// traceSpanText is the label of a span with its offset and duration.
+func traceSpanText(label string, s *storage.TraceSpan) string {
+	timing := "@" + formatMs(s.OffsetMs)
+	if s.DurationMs != nil {
+		timing += " " + formatMs(*s.DurationMs)
+	}
+	if width := traceDiffColumn - len(timing) - 1; len(label) > width {
+		label = label[:width]
+	}
+	return fmt.Sprintf("%-*s %s", traceDiffColumn-len(timing)-1, label, timing)
+}
+
+// traceDiffCell pads or truncates text to the width of a column.
+func traceDiffCell(text string) string {
+	if len(text) > traceDiffColumn {
+		return text[:traceDiffColumn]
+	}
+	return fmt.Sprintf("%-*s", traceDiffColumn, text)
+}
+
+func changeValue(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bytes)
+}
+
+func formatMs(ms float64) string {
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+func formatDeltaMs(ms float64) string {
+	return fmt.Sprintf("%+.1fms", ms)
+}
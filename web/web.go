@@ -1,9 +1,15 @@
 package web
 
 import (
+	"context"
+	"database/sql"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/karmakaze/quicklog/client/middleware"
+	"github.com/karmakaze/quicklog/enrich"
 	"github.com/karmakaze/quicklog/storage"
 )
 
@@ -21,8 +27,20 @@ func (ws *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ws.baseHandler.ServeHTTP(w, r)
 }
 
-func Serve(port int, dbUrl string) error {
-    db, err := storage.OpenDB(dbUrl)
+type Config struct {
+	Port  int
+	DbUrl string
+	// TraceProjectId, if set, is the project that quicklog logs its own requests to.
+	TraceProjectId int32
+	// IngestLogDir, if set, is the directory of the write-ahead log that POSTed
+	// entries are appended to (responding 202 Accepted) and written from in batches.
+	IngestLogDir string
+	// GeoIPDatabase, if set, is the MaxMind format (.mmdb) database file of "geoip" enrichers.
+	GeoIPDatabase string
+}
+
+func Serve(config Config) error {
+    db, err := storage.OpenDB(config.DbUrl)
     if db != nil {
         defer db.Close()
     }
@@ -30,11 +48,63 @@ func Serve(port int, dbUrl string) error {
         return err
     }
 
+	if config.GeoIPDatabase != "" {
+		if err = enrich.OpenGeoIP(config.GeoIPDatabase); err != nil {
+			return err
+		}
+	}
+
+	go purgeIdempotencyKeys(db)
+	go updateServiceMap(db)
+	go updateFieldValues(db)
+	go updateTagStats(db)
+	go evaluateAlerts(db)
+	go deliverSubscriptions(db)
+
+	usage := newUsageTracker(db)
+
 	// these get added to http.DefaultServeMux
-	http.Handle("/projects", NewProjectsHandler(db))
-	http.Handle("/entries", NewEntriesHandler(db))
-	http.Handle("/tags", NewTagsHandler(db))
+	projectsHandler := NewProjectsHandler(db)
+	projectsHandler.usage = usage
+	http.Handle("/projects", projectsHandler)
+	http.Handle("/projects/", projectsHandler)
+	entriesHandler := NewEntriesHandler(db)
+	entriesHandler.usage = usage
+	if config.IngestLogDir != "" {
+		if entriesHandler.ingest, err = newIngestWriter(config.IngestLogDir, db); err != nil {
+			return err
+		}
+	}
+	http.Handle("/entries", entriesHandler)
+	http.Handle("/entries/", entriesHandler)
+	tagsHandler := NewTagsHandler(db)
+	http.Handle("/tags", tagsHandler)
+	http.Handle("/tags/", tagsHandler)
+	entitiesHandler := NewEntitiesHandler(db)
+	http.Handle("/entities", entitiesHandler)
+	http.Handle("/entities/", entitiesHandler)
+	http.Handle("/graph", NewGraphHandler(db))
+	http.Handle("/service-map", NewServiceMapHandler(db))
+	http.Handle("/schemas", NewSchemasHandler(db))
+	http.Handle("/fields/", NewFieldsHandler(db))
+	http.Handle("/traces/", NewTracesHandler(db))
+	http.Handle("/funnel", NewFunnelHandler(db))
+	http.Handle("/sessions", NewSessionsHandler(db))
+
+	var handler http.Handler = http.DefaultServeMux
+	if config.TraceProjectId > 0 {
+		handler = middleware.Handler(newEntryWriter(config.TraceProjectId, db), handler,
+			&middleware.Options{Source: "quicklog", Route: route})
+	}
 
-    log.Printf("Listening on port %d\n", port)
-    return http.ListenAndServe(":" + strconv.Itoa(port), nil)
+    log.Printf("Listening on port %d\n", config.Port)
+    return http.ListenAndServe(":" + strconv.Itoa(config.Port), handler)
+}
+
+func purgeIdempotencyKeys(db *sql.DB) {
+	for range time.Tick(time.Hour) {
+		if err := storage.PurgeIdempotencyKeys(db, context.Background()); err != nil {
+			log.Printf("Error purging idempotency keys: %v\n", err)
+		}
+	}
 }